@@ -0,0 +1,123 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// metaSuffix is added to the name of an object's file to name its metadata file
+const metaSuffix = ".meta"
+
+// ErrBackupNotFound is returned by a Backend's Get when there is no object at the key
+var ErrBackupNotFound = errors.New("Backup not found")
+
+// Backend stores backups of the kdb as objects named by slash separated keys
+type Backend interface {
+	// Put stores everything read from r at the key, with the metadata, replacing
+	// any existing object. A failed Put leaves any existing object in place
+	Put(key string, r io.Reader, meta map[string]string) error
+	// Get returns a reader of the object at the key, or ErrBackupNotFound. The
+	// object may only be checked against its stored checksum when the reader is closed
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object at the key. It is not an error if there is none
+	Delete(key string) error
+	// String describes where the backend stores objects, for logs
+	String() string
+}
+
+// DirBackend is a Backend which stores objects as files under a local or network
+// mounted directory. Keys with slashes are stored in subdirectories. An object's
+// metadata is stored beside it, in a file with metaSuffix added to its name
+type DirBackend struct {
+	Dir string
+}
+
+// NewDirBackend returns a DirBackend which stores objects under dir
+func NewDirBackend(dir string) *DirBackend {
+	return &DirBackend{Dir: dir}
+}
+
+func (b *DirBackend) path(key string) string {
+	return filepath.Join(b.Dir, filepath.FromSlash(key))
+}
+
+// Put writes the object to a temporary file, fsyncs it and renames it into place.
+// Its metadata is then written beside it, as "name: value" lines
+func (b *DirBackend) Put(key string, r io.Reader, meta map[string]string) error {
+	path := b.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(path, r)
+	if err != nil {
+		return err
+	}
+
+	if len(meta) == 0 {
+		err = os.Remove(path + metaSuffix)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var names []string
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s: %s\n", name, meta[name])
+	}
+	return writeFileAtomic(path+metaSuffix, &buf)
+}
+
+// writeFileAtomic writes everything read from r to a temporary file, fsyncs it
+// and renames it to path
+func writeFileAtomic(path string, r io.Reader) error {
+	tmpFilename := path + ".part"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, path)
+}
+
+func (b *DirBackend) Get(key string) (io.ReadCloser, error) {
+	file, err := os.Open(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBackupNotFound
+	}
+	return file, err
+}
+
+func (b *DirBackend) Delete(key string) error {
+	for _, path := range []string{b.path(key), b.path(key) + metaSuffix} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *DirBackend) String() string {
+	return "dir:" + b.Dir
+}
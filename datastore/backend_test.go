@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type BackendS struct{}
+
+var _ = Suite(&BackendS{})
+
+// checkBackend checks that the backend stores, replaces, reads and deletes objects
+func checkBackend(c *C, b Backend) {
+	_, err := b.Get("kawana.kdb")
+	c.Check(err, Equals, ErrBackupNotFound)
+
+	for _, data := range []string{"first", "second"} {
+		c.Assert(b.Put("host/kawana.kdb", bytes.NewReader([]byte(data)), nil), IsNil)
+		r, err := b.Get("host/kawana.kdb")
+		c.Assert(err, IsNil)
+		got, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		c.Assert(r.Close(), IsNil)
+		c.Check(string(got), Equals, data)
+	}
+
+	c.Assert(b.Delete("host/kawana.kdb"), IsNil)
+	_, err = b.Get("host/kawana.kdb")
+	c.Check(err, Equals, ErrBackupNotFound)
+	c.Check(b.Delete("host/kawana.kdb"), IsNil)
+}
+
+func (s *BackendS) TestDirBackend(c *C) {
+	dir := c.MkDir()
+	b := NewDirBackend(dir)
+	checkBackend(c, b)
+	c.Check(b.String(), Equals, "dir:"+dir)
+
+	// nothing is left behind by puts
+	c.Assert(b.Put("a/b/c", bytes.NewReader([]byte("x")), nil), IsNil)
+	files, err := ioutil.ReadDir(filepath.Join(dir, "a", "b"))
+	c.Assert(err, IsNil)
+	c.Assert(len(files), Equals, 1)
+	c.Check(files[0].Name(), Equals, "c")
+}
+
+func (s *BackendS) TestDirBackendMetadata(c *C) {
+	b := NewDirBackend(c.MkDir())
+	meta := map[string]string{KeyIDMetadata: "k1", "b": "2"}
+	c.Assert(b.Put("kawana.kdb", bytes.NewReader([]byte("kdb")), meta), IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(b.Dir, "kawana.kdb"+metaSuffix))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "b: 2\n"+KeyIDMetadata+": k1\n")
+
+	// replacing the object without metadata removes it
+	c.Assert(b.Put("kawana.kdb", bytes.NewReader([]byte("kdb")), nil), IsNil)
+	_, err = os.Stat(filepath.Join(b.Dir, "kawana.kdb"+metaSuffix))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	c.Assert(b.Put("kawana.kdb", bytes.NewReader([]byte("kdb")), meta), IsNil)
+	c.Assert(b.Delete("kawana.kdb"), IsNil)
+	files, _ := ioutil.ReadDir(b.Dir)
+	c.Check(len(files), Equals, 0)
+}
+
+// failingReader returns an error after its data
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, os.ErrInvalid
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (s *BackendS) TestDirBackendFailedPut(c *C) {
+	b := NewDirBackend(c.MkDir())
+	c.Assert(b.Put("kawana.kdb", bytes.NewReader([]byte("good")), nil), IsNil)
+	c.Check(b.Put("kawana.kdb", &failingReader{[]byte("bad")}, nil), Equals, os.ErrInvalid)
+
+	r, err := b.Get("kawana.kdb")
+	c.Assert(err, IsNil)
+	defer r.Close()
+	got, _ := ioutil.ReadAll(r)
+	c.Check(string(got), Equals, "good")
+	_, err = os.Stat(filepath.Join(b.Dir, "kawana.kdb.part"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,286 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Each backup is stored at <prefix>/<host>/kawana.kdb.<time>, with the time in
+// snapshotTimeFormat. Backends can't list their objects, so the keys of the
+// host's retained backups are kept in an index object, one per line, oldest
+// first. The latest object holds the key of the newest backup
+const (
+	backupIndexName  = "index"
+	backupLatestName = "latest"
+)
+
+// BackupConfig sets where the store's backups are kept in its backend, and for how long
+type BackupConfig struct {
+	Prefix string // key prefix of every backup. May be empty
+	Host   string // name of the host the backups are from. os.Hostname() if empty
+	// Keep is the number of backups kept, and MaxAge removes backups older than
+	// it. With both 0, every backup is kept. The newest backup is always kept
+	Keep   int
+	MaxAge time.Duration
+	// Keys encrypts backups before they are written to the backend, with the key
+	// ID recorded in the object's metadata. nil to write backups unencrypted.
+	// Encrypted backups are restored with whichever of the keys they were written with
+	Keys *EncryptionKeys
+}
+
+// Backup writes the kawana.kdb to the store's backend as a new timestamped
+// backup, points the latest object at it, and then deletes the backups beyond
+// the store's retention. Backups run one at a time, so each is kept in the index
+func (store *IPDataStore) Backup() error {
+	return store.backupAtTime(time.Now())
+}
+
+// backupAtTime performs the real work of Backup, and takes the current time as
+// a parameter to aid in testing.
+func (store *IPDataStore) backupAtTime(now time.Time) error {
+	if store.backend == nil {
+		return errors.New("No backup backend")
+	}
+	store.backingUp.Lock()
+	defer store.backingUp.Unlock()
+
+	// open file to upload
+	file, err := os.Open(store.kdbPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	key := store.backupKey(kdbFile + "." + now.UTC().Format(snapshotTimeFormat))
+	var r io.Reader = file
+	var meta map[string]string
+	if keys := store.backupConfig.Keys; keys != nil {
+		pr := encryptPipe(keys, file)
+		defer pr.Close()
+		r = pr
+		meta = map[string]string{KeyIDMetadata: keys.CurrentID()}
+	}
+	err = store.backend.Put(key, r, meta)
+	if err != nil {
+		return err
+	}
+
+	keys, err := store.backupIndex()
+	if err != nil {
+		return err
+	}
+	keep, prune := store.retainBackups(append(keys, key), now)
+
+	// the pointers are updated before anything is deleted, so a failure
+	// leaves unindexed objects behind rather than pointers to missing ones
+	err = store.backend.Put(store.backupKey(backupLatestName), strings.NewReader(key), nil)
+	if err != nil {
+		return err
+	}
+	err = store.backend.Put(store.backupKey(backupIndexName), strings.NewReader(strings.Join(keep, "\n")+"\n"), nil)
+	if err != nil {
+		return err
+	}
+	for _, k := range prune {
+		err = store.backend.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptPipe returns a reader of r encrypted with the keys. Closing the reader
+// stops the encryption if it has not been read to the end
+func encryptPipe(keys *EncryptionKeys, r io.Reader) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		ew, err := keys.NewEncryptWriter(pw)
+		if err == nil {
+			_, err = io.Copy(ew, r)
+		}
+		if err == nil {
+			err = ew.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// retainBackups splits the keys of the host's backups, oldest first, into those
+// kept and those pruned by the store's retention. The newest key is always kept
+func (store *IPDataStore) retainBackups(keys []string, now time.Time) (keep, prune []string) {
+	n := len(keys)
+	if store.backupConfig.Keep > 0 && store.backupConfig.Keep < n {
+		n = store.backupConfig.Keep
+	}
+	for i, key := range keys {
+		tooMany := i < len(keys)-n
+		tooOld := false
+		if store.backupConfig.MaxAge > 0 {
+			t, err := backupTime(key)
+			tooOld = err == nil && now.Sub(t) > store.backupConfig.MaxAge
+		}
+		if (tooMany || tooOld) && i != len(keys)-1 {
+			prune = append(prune, key)
+		} else {
+			keep = append(keep, key)
+		}
+	}
+	return keep, prune
+}
+
+// backupTime returns the time in a backup's key
+func backupTime(key string) (time.Time, error) {
+	name := path.Base(key)
+	if !strings.HasPrefix(name, kdbFile+".") {
+		return time.Time{}, fmt.Errorf("Invalid backup key %s", key)
+	}
+	return time.Parse(snapshotTimeFormat, name[len(kdbFile)+1:])
+}
+
+// backupIndex returns the keys of the host's retained backups, oldest first
+func (store *IPDataStore) backupIndex() ([]string, error) {
+	data, err := store.readBackupObject(backupIndexName)
+	if err == ErrBackupNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// readBackupObject returns the contents of the host's object with the name
+func (store *IPDataStore) readBackupObject(name string) ([]byte, error) {
+	r, err := store.backend.Get(store.backupKey(name))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	closeErr := r.Close()
+	if err != nil {
+		return nil, err
+	}
+	return data, closeErr
+}
+
+// latestBackup returns the key of the host's newest backup. Before backups were
+// timestamped, the only backup was kdbFile at the top of the backend
+func (store *IPDataStore) latestBackup() (string, error) {
+	data, err := store.readBackupObject(backupLatestName)
+	if err == ErrBackupNotFound {
+		return kdbFile, nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// RestoreFromBackup downloads the host's latest backup as the kdb, decrypting it
+// if it is encrypted. The download is checked by the backend, and decoded in
+// full, before it replaces anything. It returns false if the backend has no backup
+func (store *IPDataStore) RestoreFromBackup() (bool, error) {
+	if store.backend == nil {
+		return false, errors.New("No backup backend")
+	}
+
+	key, err := store.latestBackup()
+	if err != nil {
+		return false, err
+	}
+	r, err := store.backend.Get(key)
+	if err == ErrBackupNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	kdb, err := OpenKDB(r, store.backupConfig.Keys)
+	if err != nil {
+		r.Close()
+		return false, fmt.Errorf("Backup %s in %s can't be restored: %s", key, store.backend, err)
+	}
+
+	tmpFilename := store.kdbPath() + ".part"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		r.Close()
+		return false, err
+	}
+	defer file.Close()
+	defer os.Remove(tmpFilename)
+
+	_, err = io.Copy(file, kdb)
+	if err != nil {
+		r.Close()
+		return false, fmt.Errorf("Backup %s in %s can't be restored: %s", key, store.backend, err)
+	}
+	// the backend's checksum may only be checked when the reader is closed
+	err = r.Close()
+	if err != nil {
+		return false, err
+	}
+	err = file.Sync()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return false, err
+	}
+	err = NewDecoder(file).DecodeEvery(func(Prefix, *IPData) {})
+	if err != nil {
+		return false, fmt.Errorf("Backup %s in %s can't be restored: %s", key, store.backend, err)
+	}
+
+	err = os.Rename(tmpFilename, store.kdbPath())
+	if err != nil {
+		return false, err
+	}
+	log.Printf("Restored %s from %s in %s", kdbFile, key, store.backend)
+	return true, nil
+}
+
+// restoreIfMissing restores the kdb from the backend if there is no local kdb.
+// Starting empty is only safe when the backend has no backup, so any other
+// failure is returned
+func (store *IPDataStore) restoreIfMissing() error {
+	_, err := os.Stat(store.kdbPath())
+	if err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	log.Printf("No local %s, restoring the latest backup of %s from %s...", kdbFile, store.backupConfig.Host, store.backend)
+	restored, err := store.RestoreFromBackup()
+	if err != nil {
+		return err
+	}
+	if !restored {
+		log.Println("No backup found, starting with an empty store")
+	}
+	return nil
+}
+
+// backupKey returns the key of the host's object with the name
+func (store *IPDataStore) backupKey(name string) string {
+	return path.Join(store.backupConfig.Prefix, store.backupConfig.Host, name)
+}
@@ -0,0 +1,253 @@
+package datastore
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type BackupS struct{}
+
+var _ = Suite(&BackupS{})
+
+func (s *BackupS) TestBackupAndRestore(c *C) {
+	backend := NewDirBackend(c.MkDir())
+	ip := IPLong(1).IPAddr()
+	store := newStore(c, Config{DataDir: c.MkDir(), Backend: backend})
+	store.LogIP(ip, ImpactAmount(3), BWBlacklist)
+	c.Assert(store.Persist(), IsNil)
+	c.Assert(store.Backup(), IsNil)
+
+	// a fresh host starts from the backup
+	store = newStore(c, Config{DataDir: filepath.Join(c.MkDir(), "data"), Backend: backend, RestoreFromBackup: true})
+	data := getRecord(store, ip.HostPrefix())
+	c.Assert(data, NotNil)
+	c.Check(data.MaxImpacts[0], Equals, ImpactAmount(3))
+	c.Check(data.BlackWhite, Not(Equals), byte(0))
+}
+
+func (s *BackupS) TestRestoreKeepsLocalKDB(c *C) {
+	backend := NewDirBackend(c.MkDir())
+	store := newStore(c, Config{DataDir: c.MkDir(), Backend: backend})
+	store.LogIP(IPLong(1).IPAddr(), ImpactAmount(3), BWNop)
+	c.Assert(store.Persist(), IsNil)
+	c.Assert(store.Backup(), IsNil)
+
+	dir := c.MkDir()
+	store = newStore(c, Config{DataDir: dir})
+	store.LogIP(IPLong(2).IPAddr(), ImpactAmount(3), BWNop)
+	c.Assert(store.Persist(), IsNil)
+
+	store = newStore(c, Config{DataDir: dir, Backend: backend, RestoreFromBackup: true})
+	c.Check(getRecord(store, IPLong(1).IPAddr().HostPrefix()), IsNil)
+	c.Check(getRecord(store, IPLong(2).IPAddr().HostPrefix()), NotNil)
+}
+
+func (s *BackupS) TestRestoreNoBackup(c *C) {
+	backend := NewDirBackend(c.MkDir())
+	store := newStore(c, Config{DataDir: c.MkDir(), Backend: backend})
+	restored, err := store.RestoreFromBackup()
+	c.Assert(err, IsNil)
+	c.Check(restored, Equals, false)
+
+	// starts empty
+	store = newStore(c, Config{DataDir: c.MkDir(), Backend: backend, RestoreFromBackup: true})
+	c.Check(store.Len(), Equals, 0)
+}
+
+func (s *BackupS) TestRestoreLegacyBackup(c *C) {
+	// before backups were timestamped, the only backup was kawana.kdb at the top
+	backend := NewDirBackend(c.MkDir())
+	c.Assert(backend.Put(kdbFile, bytes.NewReader(encodeTestStore(c, 3)), nil), IsNil)
+
+	store := newStore(c, Config{DataDir: c.MkDir(), Backend: backend, RestoreFromBackup: true})
+	c.Check(store.Len(), Equals, 3)
+}
+
+func (s *BackupS) TestRestoreCorruptedBackup(c *C) {
+	backend := NewDirBackend(c.MkDir())
+	kdb := encodeTestStore(c, 3)
+	kdb[len(kdb)-1] = 'X'
+	c.Assert(backend.Put(kdbFile, bytes.NewReader(kdb), nil), IsNil)
+
+	dir := c.MkDir()
+	store := newStore(c, Config{DataDir: dir, Backend: backend})
+	restored, err := store.RestoreFromBackup()
+	c.Check(restored, Equals, false)
+	c.Check(err, ErrorMatches, ".*can't be restored: kdb corrupted.*")
+
+	// nothing is left behind
+	_, err = os.Stat(filepath.Join(dir, kdbFile))
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(filepath.Join(dir, kdbFile+".part"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+// backupFiles returns the names of the files in the backend's directory for the host
+func backupFiles(c *C, backend *DirBackend, host string) []string {
+	files, err := ioutil.ReadDir(filepath.Join(backend.Dir, "kawana", host))
+	c.Assert(err, IsNil)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names
+}
+
+func (s *BackupS) TestTimestampedBackups(c *C) {
+	backend := NewDirBackend(c.MkDir())
+	ip := IPLong(1).IPAddr()
+	config := Config{DataDir: c.MkDir(), Backend: backend, Backup: BackupConfig{Prefix: "kawana", Host: "a", Keep: 2}}
+	store := newStore(c, config)
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		store.LogIP(ip, ImpactAmount(1), BWNop)
+		c.Assert(store.Persist(), IsNil)
+		c.Assert(store.backupAtTime(start.Add(time.Duration(i)*time.Hour)), IsNil)
+	}
+
+	// the oldest backup was pruned
+	c.Check(backupFiles(c, backend, "a"), DeepEquals, []string{
+		"index",
+		"kawana.kdb.20260102T040405.000000000Z",
+		"kawana.kdb.20260102T050405.000000000Z",
+		"latest",
+	})
+	keys, err := store.backupIndex()
+	c.Assert(err, IsNil)
+	c.Check(keys, DeepEquals, []string{
+		"kawana/a/kawana.kdb.20260102T040405.000000000Z",
+		"kawana/a/kawana.kdb.20260102T050405.000000000Z",
+	})
+	latest, err := store.latestBackup()
+	c.Assert(err, IsNil)
+	c.Check(latest, Equals, "kawana/a/kawana.kdb.20260102T050405.000000000Z")
+
+	// the latest backup is restored, on another host
+	config.DataDir = c.MkDir()
+	config.RestoreFromBackup = true
+	store = newStore(c, config)
+	c.Check(getRecord(store, ip.HostPrefix()).MaxImpacts[0], Equals, ImpactAmount(3))
+}
+
+// blockingBackend is a Backend whose Puts of backup kdbs wait for release
+type blockingBackend struct {
+	Backend
+	started chan string
+	release chan struct{}
+}
+
+func (b *blockingBackend) Put(key string, r io.Reader, meta map[string]string) error {
+	if strings.Contains(key, kdbFile) {
+		b.started <- key
+		<-b.release
+	}
+	return b.Backend.Put(key, r, meta)
+}
+
+func (s *BackupS) TestConcurrentBackups(c *C) {
+	backend := &blockingBackend{NewDirBackend(c.MkDir()), make(chan string, 2), make(chan struct{})}
+	store := newStore(c, Config{DataDir: c.MkDir(), Backend: backend, Backup: BackupConfig{Host: "a"}})
+	c.Assert(store.Persist(), IsNil)
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func(now time.Time) {
+			done <- store.backupAtTime(now)
+		}(start.Add(time.Duration(i) * time.Hour))
+	}
+
+	// the second backup waits for the first to update the index
+	<-backend.started
+	select {
+	case key := <-backend.started:
+		c.Fatalf("%s started during another backup", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(backend.release)
+	c.Assert(<-done, IsNil)
+	c.Assert(<-done, IsNil)
+
+	keys, err := store.backupIndex()
+	c.Assert(err, IsNil)
+	c.Check(keys, HasLen, 2)
+}
+
+func (s *BackupS) TestPruneBackupsByAge(c *C) {
+	backend := NewDirBackend(c.MkDir())
+	store := newStore(c, Config{DataDir: c.MkDir(), Backend: backend, Backup: BackupConfig{Prefix: "kawana", Host: "a", MaxAge: 24 * time.Hour}})
+	c.Assert(store.Persist(), IsNil)
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.Assert(store.backupAtTime(start), IsNil)
+	c.Assert(store.backupAtTime(start.Add(time.Hour)), IsNil)
+	c.Check(len(backupFiles(c, backend, "a")), Equals, 4)
+
+	c.Assert(store.backupAtTime(start.Add(24*time.Hour+30*time.Minute)), IsNil)
+	keys, _ := store.backupIndex()
+	c.Check(len(keys), Equals, 2)
+	c.Check(len(backupFiles(c, backend, "a")), Equals, 4)
+
+	// the newest backup is kept, however old
+	c.Assert(store.backupAtTime(start.Add(24*time.Hour+31*time.Minute)), IsNil)
+	store.backupConfig.MaxAge = time.Nanosecond
+	keep, prune := store.retainBackups([]string{"kawana/a/kawana.kdb.20260102T030405.000000000Z"}, start.Add(1000*time.Hour))
+	c.Check(keep, DeepEquals, []string{"kawana/a/kawana.kdb.20260102T030405.000000000Z"})
+	c.Check(len(prune), Equals, 0)
+}
+
+func (s *BackupS) TestHostsAreSeparate(c *C) {
+	backend := NewDirBackend(c.MkDir())
+	a := newStore(c, Config{DataDir: c.MkDir(), Backend: backend, Backup: BackupConfig{Prefix: "kawana", Host: "a", Keep: 1}})
+	a.LogIP(IPLong(1).IPAddr(), ImpactAmount(1), BWNop)
+	c.Assert(a.Persist(), IsNil)
+	c.Assert(a.Backup(), IsNil)
+
+	b := newStore(c, Config{DataDir: c.MkDir(), Backend: backend, Backup: BackupConfig{Prefix: "kawana", Host: "b", Keep: 1}})
+	c.Assert(b.Persist(), IsNil)
+	c.Assert(b.Backup(), IsNil)
+
+	c.Check(len(backupFiles(c, backend, "a")), Equals, 3)
+	c.Check(len(backupFiles(c, backend, "b")), Equals, 3)
+}
+
+func (s *BackupS) TestEncryptedBackup(c *C) {
+	backend := NewDirBackend(c.MkDir())
+	keys := testKeys(c)
+	ip := IPLong(1).IPAddr()
+	config := Config{DataDir: c.MkDir(), Backend: backend, Backup: BackupConfig{Prefix: "kawana", Host: "a", Keys: keys}}
+	store := newStore(c, config)
+	store.LogIP(ip, ImpactAmount(3), BWNop)
+	c.Assert(store.Persist(), IsNil)
+	c.Assert(store.Backup(), IsNil)
+
+	key, err := store.latestBackup()
+	c.Assert(err, IsNil)
+	r, err := backend.Get(key)
+	c.Assert(err, IsNil)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	c.Check(string(data[0:4]), Equals, encryptMagic)
+	meta, err := ioutil.ReadFile(backend.path(key) + metaSuffix)
+	c.Assert(err, IsNil)
+	c.Check(string(meta), Equals, KeyIDMetadata+": k2\n")
+
+	// restoring needs the key
+	config.DataDir = c.MkDir()
+	config.Backup.Keys = nil
+	store = newStore(c, config)
+	_, err = store.RestoreFromBackup()
+	c.Check(err, ErrorMatches, ".*can't be restored: Encrypted, but no key file was given")
+
+	config.Backup.Keys = keys
+	config.RestoreFromBackup = true
+	store = newStore(c, config)
+	c.Check(getRecord(store, ip.HostPrefix()).MaxImpacts[0], Equals, ImpactAmount(3))
+}
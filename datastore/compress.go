@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression selects how the blocks and footer of a kdb are compressed.
+// The header is never compressed, so the compression can be read from it
+type Compression byte
+
+const (
+	// CompressNone writes the blocks uncompressed
+	CompressNone Compression = iota
+	// CompressGzip writes the blocks as a single gzip stream
+	CompressGzip
+)
+
+// ParseCompression parses "none" or "gzip"
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "none":
+		return CompressNone, nil
+	case "gzip":
+		return CompressGzip, nil
+	default:
+		return CompressNone, fmt.Errorf("Unknown compression %q", s)
+	}
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressNone:
+		return "none"
+	case CompressGzip:
+		return "gzip"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+// nopWriteCloser adds a Close which does nothing to a Writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter returns a writer which compresses to w. It must be closed
+// to finish the compressed stream, which does not close w
+func (c Compression) compressWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressNone:
+		return nopWriteCloser{w}, nil
+	case CompressGzip:
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	default:
+		return nil, fmt.Errorf("Unknown compression %d", byte(c))
+	}
+}
+
+// decompressReader returns a reader which decompresses from r
+func (c Compression) decompressReader(r io.Reader) (io.Reader, error) {
+	switch c {
+	case CompressNone:
+		return r, nil
+	case CompressGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		// the footer is the end of the kdb, so a second stream is corruption
+		gr.Multistream(false)
+		return gr, nil
+	default:
+		return nil, fmt.Errorf("Unknown compression %d", byte(c))
+	}
+}
+
+// isCompressionError returns true if err is an error from decompressing corrupted data
+func isCompressionError(err error) bool {
+	if err == gzip.ErrChecksum || err == gzip.ErrHeader {
+		return true
+	}
+	_, ok := err.(flate.CorruptInputError)
+	return ok
+}
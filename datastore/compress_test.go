@@ -0,0 +1,35 @@
+package datastore
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type CompressS struct{}
+
+var _ = Suite(&CompressS{})
+
+func (s *CompressS) TestParseCompression(c *C) {
+	compression, err := ParseCompression("gzip")
+	c.Assert(err, IsNil)
+	c.Check(compression, Equals, CompressGzip)
+	c.Check(compression.String(), Equals, "gzip")
+
+	compression, err = ParseCompression("none")
+	c.Assert(err, IsNil)
+	c.Check(compression, Equals, CompressNone)
+
+	_, err = ParseCompression("lz4")
+	c.Check(err, NotNil)
+}
+
+func (s *CompressS) TestPersistCompressed(c *C) {
+	dir := c.MkDir()
+	ip := IPLong(1).IPAddr()
+	store := newStore(c, Config{DataDir: dir, Compression: CompressGzip})
+	store.LogIP(ip, ImpactAmount(3), BWNop)
+	c.Assert(store.Persist(), IsNil)
+
+	// a compressed kdb is loaded whatever the store's compression is
+	store = newStore(c, Config{DataDir: dir})
+	c.Check(getRecord(store, ip.HostPrefix()).MaxImpacts[0], Equals, ImpactAmount(3))
+}
@@ -1,10 +1,13 @@
 package datastore
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 const kdbFile = "kawana.kdb"
@@ -19,14 +22,122 @@ const (
 	BWUnBlacklist
 )
 
-// IPDataStore is a lockable struct which holds data about IPs,
-// a write-ahead log, and options
+// Valid returns true if the modifier is BWNop or one of the known changes
+func (m BWModifier) Valid() bool {
+	return m >= BWNop && m <= BWUnBlacklist
+}
+
+// Config holds the options for an IPDataStore
+type Config struct {
+	DataDir  string
+	Backend  Backend       // where Backup writes and RestoreFromBackup reads backups. nil for none
+	Backup   BackupConfig  // keys and retention of backups in Backend
+	Windows  Windows       // time windows to count impacts over. DefaultWindows if empty
+	Counter  CounterType   // how impacts are counted within each window
+	Buckets  int           // buckets per window for CounterSliding. DefaultBuckets if 0
+	HalfLife time.Duration // half-life of each IP's decaying score. DefaultHalfLife if 0
+
+	// Prefix lengths to roll each ipv4 and ipv6 address's impacts up into, e.g. 24 and 16 for ipv4
+	Prefixes4 []int
+	Prefixes6 []int
+
+	TTL         time.Duration // idle time after which SweepIdle removes a record. 0 to keep records forever
+	EvictListed bool          // allow SweepIdle to remove whitelisted and blacklisted records
+
+	Shards int // number of independently locked partitions. DefaultShards if 0
+
+	// Caps on the number of records and their estimated memory use. When a cap
+	// is reached, a record chosen by Eviction is removed for each new one. 0 for no cap.
+	// Each shard holds an equal share of the cap, rounded down, so a cap must allow
+	// at least one record per shard
+	MaxRecords int
+	MaxBytes   int64
+	Eviction   EvictionPolicy
+
+	// OpLog appends every operation to a log on disk, so that operations since
+	// the last Persist survive a crash. OpLogSync sets how often it is fsynced
+	OpLog     bool
+	OpLogSync SyncPolicy
+	// Compression compresses the kdb written by Persist. kdbs are read in
+	// whichever compression they were written with
+	Compression Compression
+
+	// Persist keeps the newest Snapshots timestamped copies of the kdb in the data dir,
+	// removing any older than SnapshotMaxAge. With both 0, no copies are kept
+	Snapshots      int
+	SnapshotMaxAge time.Duration
+	// Snapshot names a snapshot to restore as the kdb on startup,
+	// discarding the kdb and op log written since it was taken. It is restored
+	// by every New it is set for, so is meant for a single start
+	Snapshot string
+	// RestoreFromBackup downloads the backup from Backend on startup if there is no local kdb
+	RestoreFromBackup bool
+	// Recovery chooses what New does when the kdb can't be decoded
+	Recovery RecoveryPolicy
+}
+
+func (config *Config) validatePrefixes() error {
+	for _, bits := range config.Prefixes4 {
+		if bits < 1 || bits > 31 {
+			return fmt.Errorf("Invalid ipv4 prefix length %d", bits)
+		}
+	}
+	for _, bits := range config.Prefixes6 {
+		if bits < 1 || bits > 127 {
+			return fmt.Errorf("Invalid ipv6 prefix length %d", bits)
+		}
+	}
+	return nil
+}
+
+func (config *Config) counting() *counting {
+	c := &counting{
+		windows:  config.Windows,
+		counter:  config.Counter,
+		buckets:  config.Buckets,
+		halfLife: config.HalfLife,
+	}
+	if c.halfLife == 0 {
+		c.halfLife = DefaultHalfLife
+	}
+	if len(c.windows) == 0 {
+		c.windows = DefaultWindows
+	}
+	if c.counter == CounterSliding && c.buckets == 0 {
+		c.buckets = DefaultBuckets
+	}
+	return c
+}
+
+// IPDataStore holds data about IPs, partitioned into independently
+// locked shards which each have a write-ahead log, and options
 type IPDataStore struct {
-	sync.RWMutex
-	s3Bucket string
-	dataDir  string
-	m        IPDataMap
-	wal      *ipWAL
+	backend      Backend
+	backupConfig BackupConfig
+	dataDir      string
+	counting     *counting
+	prefixes4    []int
+	prefixes6    []int
+	ttl          time.Duration
+	evictListed  bool
+	shards       []*ipDataShard
+	oplog        *opLog     // nil if the op log is disabled
+	logSegment   uint64     // first op log segment not included in the last kdb
+	persisting   sync.Mutex // held by Persist, so only one runs at a time
+	backingUp    sync.Mutex // held by Backup, so only one updates the index and latest objects at a time
+	compression  Compression
+	// snapshot retention, see Config
+	snapshots      int
+	snapshotMaxAge time.Duration
+	recovery       Recovery  // how New recovered from a corrupted kdb
+	lostSegments   [2]uint64 // op log segments lost by the recovery, from and to exclusive
+	stats          Stats
+}
+
+// PrefixData is a copy of the IPData of one of an IP's enclosing prefixes
+type PrefixData struct {
+	Prefix Prefix
+	Data   *IPData
 }
 
 type syncIPDataStore interface {
@@ -36,54 +147,162 @@ type syncIPDataStore interface {
 	getMap() IPDataMap
 }
 
-func (store *IPDataStore) getMap() IPDataMap {
-	return store.m
-}
-
 // New creates a new IPDataStore
-func New(dataDir, s3Bucket string) *IPDataStore {
-	s, err := newFromFile(dataDir, s3Bucket)
-	if err == nil {
-		// kdb file existed and loaded successfully
-		return s
+func New(config Config) (*IPDataStore, error) {
+	c := config.counting()
+	err := c.validate()
+	if err != nil {
+		return nil, err
+	}
+	err = config.validatePrefixes()
+	if err != nil {
+		return nil, err
+	}
+	if config.Shards < 0 {
+		return nil, errors.New("Shards must not be negative")
+	}
+	if config.Shards == 0 {
+		config.Shards = DefaultShards
+	}
+	if config.MaxRecords < 0 || config.MaxBytes < 0 {
+		return nil, errors.New("MaxRecords and MaxBytes must not be negative")
+	}
+	if config.MaxRecords > 0 && config.MaxRecords < config.Shards {
+		return nil, fmt.Errorf("MaxRecords of %d is less than one record for each of the %d shards", config.MaxRecords, config.Shards)
+	}
+	if config.MaxBytes > 0 && config.MaxBytes < int64(config.Shards)*recordSize(c) {
+		return nil, fmt.Errorf("MaxBytes of %d is less than one record for each of the %d shards", config.MaxBytes, config.Shards)
+	}
+	if config.Snapshots < 0 || config.SnapshotMaxAge < 0 {
+		return nil, errors.New("Snapshots and SnapshotMaxAge must not be negative")
+	}
+	if config.Backup.Keep < 0 || config.Backup.MaxAge < 0 {
+		return nil, errors.New("Backup Keep and MaxAge must not be negative")
+	}
+	maxRecords := config.maxShardRecords(c, config.Shards)
+
+	s := new(IPDataStore)
+	s.dataDir = config.DataDir
+	s.backend = config.Backend
+	s.backupConfig = config.Backup
+	if s.backupConfig.Host == "" {
+		s.backupConfig.Host, err = os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.counting = c
+	s.prefixes4 = config.Prefixes4
+	s.prefixes6 = config.Prefixes6
+	s.ttl = config.TTL
+	s.evictListed = config.EvictListed
+	s.compression = config.Compression
+	s.snapshots = config.Snapshots
+	s.snapshotMaxAge = config.SnapshotMaxAge
+	s.shards = make([]*ipDataShard, config.Shards)
+	for i := range s.shards {
+		s.shards[i] = newIPDataShard(maxRecords, config.Eviction)
 	}
 
-	if !os.IsNotExist(err) {
-		//kdb failed to load
-		log.Fatal(kdbFile + " appears to be corrupted: " + err.Error())
+	if config.Snapshot != "" {
+		err = s.restoreSnapshot(config.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.RestoreFromBackup {
+		if config.Backend == nil {
+			return nil, errors.New("RestoreFromBackup needs a Backend")
+		}
+		err = s.ensureDataDirExists()
+		if err != nil {
+			return nil, err
+		}
+		err = s.restoreIfMissing()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	s = new(IPDataStore)
-	s.dataDir = dataDir
-	s.s3Bucket = s3Bucket
+	segment, err := s.loadFromFile()
+	if err != nil && !os.IsNotExist(err) {
+		segment, s.recovery, err = s.recoverKDB(config.Recovery, segment, err)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	err = s.ensureDataDirExists()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	// operations since the kdb was written are replayed even if the op log
+	// is now disabled, as they are the most recent state of the store
+	s.logSegment, err = s.replayOpLog(segment)
+	if err != nil {
+		return nil, err
+	}
+	for _, shard := range s.shards {
+		shard.enforceCap()
+	}
+	if s.recovery == RecoveryPartial {
+		// replace the corrupted kdb, so the records recovered from it are kept
+		err = s.Persist()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.OpLog {
+		s.oplog, err = openOpLog(s.dataDir, config.OpLogSync, s.logSegment)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	s.m = make(IPDataMap)
-	s.wal = newIPWAL()
-	return s
+	return s, nil
 }
 
-func newFromFile(dataDir, s3Bucket string) (*IPDataStore, error) {
-	filename := dataDir + string(filepath.Separator) + kdbFile
-	file, err := os.Open(filename)
+// loadFromFile decodes the kdb in the store's data dir into its shards.
+// It returns the first op log segment which is not included in the kdb,
+// which is 0 if the kdb's header could not be read
+func (store *IPDataStore) loadFromFile() (uint64, error) {
+	file, err := os.Open(store.kdbPath())
 	if err != nil {
-		return new(IPDataStore), err
+		return 0, err
 	}
+	defer file.Close()
 
 	log.Println("Loading " + kdbFile + "...")
+	c := store.counting
 	dec := NewDecoder(file)
-	m := make(IPDataMap)
-	err = dec.Decode(&m)
+	err = dec.DecodeEvery(func(key Prefix, ipData *IPData) {
+		if !dec.counting.equal(c) {
+			ipData = ipData.remap(dec.counting, c)
+		}
+		store.shardFor(key).m[key] = ipData
+	})
 	if err != nil {
-		return new(IPDataStore), err
+		// the records decoded before the error are left in the shards
+		return dec.LogSegment(), err
+	}
+	if !dec.counting.equal(c) {
+		log.Println(kdbFile + " was written with " + dec.counting.String() + " counting, converted to " + c.String())
+	}
+	if dec.Version() != encodingVersion {
+		log.Printf("%s is version %d, it will be rewritten as version %d on the next persist", kdbFile, dec.Version(), encodingVersion)
 	}
 	log.Println("Done loading")
-	newStore := &IPDataStore{m: m, dataDir: dataDir, s3Bucket: s3Bucket, wal: newIPWAL()}
-	return newStore, nil
+	return dec.LogSegment(), nil
+}
+
+// HalfLife returns the half-life of each IP's decaying score
+func (store *IPDataStore) HalfLife() time.Duration {
+	return store.counting.halfLife
+}
+
+// Windows returns the time windows the store counts impacts over
+func (store *IPDataStore) Windows() Windows {
+	return store.counting.windows
 }
 
 func (store *IPDataStore) ensureDataDirExists() error {
@@ -91,185 +310,349 @@ func (store *IPDataStore) ensureDataDirExists() error {
 }
 
 // LogIP adds the impact to the specified IP's time windows
-// and modifies the BlackWhite list field
-// Always takes a read lock on the store, takes a write lock if the IP did not exist yet
-func (store *IPDataStore) LogIP(ip IPLong, impact ImpactAmount, blackWhite BWModifier) IPData {
-	store.wal.status.RLock()
-	defer store.wal.status.RUnlock()
-
-	var ipStore syncIPDataStore
-	state := store.wal.status.state
-
-	if state == walWriting {
-		// copy from store to wal first,
-		// later do normal update
-		copyIPData(store.wal, store, ip)
-		ipStore = store.wal
-	} else if state == walDraining {
-		// try update WAL
-		// if not exists in wal, will do the normal update on the store
-		ipData, exists := ipStoreUpdate(store.wal, ip, impact, blackWhite)
-		if !exists {
-			ipStore = store
-		} else {
-			return ipData
+// and modifies the BlackWhite list field. It returns a copy of the IP's updated data.
+// The impact is also added to the IP's enclosing prefix records.
+// If the store has an op log, the operation is appended to it first
+// Takes a read lock on the IP's shard, and a write lock if the IP did not exist yet
+func (store *IPDataStore) LogIP(ip IPAddr, impact ImpactAmount, blackWhite BWModifier) *IPData {
+	now := time.Now()
+	if store.oplog != nil {
+		store.oplog.cut.RLock()
+		defer store.oplog.cut.RUnlock()
+		err := store.oplog.appendLogIP(ip, impact, blackWhite, now)
+		if err != nil {
+			log.Println(err)
 		}
-	} else {
-		// wal inactive
-		ipStore = store
 	}
+	return store.logIPAtTime(ip, impact, blackWhite, now)
+}
 
-	ipData, exists := ipStoreUpdate(ipStore, ip, impact, blackWhite)
-	if !exists {
-		return ipStoreInsert(ipStore, ip, impact, blackWhite)
+// logIPAtTime performs the real work of LogIP, and takes the current time as
+// a parameter so that op log entries can be replayed at their original time
+func (store *IPDataStore) logIPAtTime(ip IPAddr, impact ImpactAmount, blackWhite BWModifier, now time.Time) *IPData {
+	key := ip.HostPrefix()
+	ipData := store.shardFor(key).logKey(store.counting, key, impact, blackWhite, now)
+	if impact != 0 {
+		for _, prefix := range store.enclosingPrefixes(ip) {
+			store.shardFor(prefix).logKey(store.counting, prefix, impact, BWNop, now)
+		}
 	}
 	return ipData
 }
 
-// ForgiveIP subtracts the impacts from the specified IP's time windows
-// Always takes a read lock on the store, takes a write lock on the IPData
-func (store *IPDataStore) ForgiveIP(ip IPLong, impacts ImpactAmounts) IPData {
-	store.wal.status.RLock()
-	defer store.wal.status.RUnlock()
-
-	var ipStore syncIPDataStore
-	state := store.wal.status.state
-
-	if state == walWriting {
-		// copy from store to wal first,
-		// later do normal update
-		copyIPData(store.wal, store, ip)
-		ipStore = store.wal
-	} else if state == walDraining {
-		// try update WAL
-		// if not exists in wal, will operate on store
-		ipData, exists := ipStoreForgive(store.wal, ip, impacts)
-		if !exists {
-			ipStore = store
-		} else {
-			return ipData
+// IPImpact is an impact on an IP, one of the entries of a LogIPs batch
+type IPImpact struct {
+	IP     IPAddr
+	Impact ImpactAmount
+}
+
+// LogIPs logs each of the impacts as LogIP would, in order, and returns a copy
+// of each IP's data as it was updated. The batch is appended to the op log in a
+// single write, and each shard's locks are taken once for all of the batch's
+// records in that shard, rather than once per record
+func (store *IPDataStore) LogIPs(impacts []IPImpact) []*IPData {
+	now := time.Now()
+	if store.oplog != nil {
+		store.oplog.cut.RLock()
+		defer store.oplog.cut.RUnlock()
+		err := store.oplog.appendLogIPs(impacts, now)
+		if err != nil {
+			log.Println(err)
 		}
-	} else {
-		// wal inactive
-		ipStore = store
 	}
+	return store.logIPsAtTime(impacts, now)
+}
+
+// logIPsAtTime performs the real work of LogIPs, and takes the current time as a parameter
+func (store *IPDataStore) logIPsAtTime(impacts []IPImpact, now time.Time) []*IPData {
+	results := make([]*IPData, len(impacts))
+	batches := make([][]keyImpact, len(store.shards))
+	for i, entry := range impacts {
+		key := entry.IP.HostPrefix()
+		n := store.shardIndex(key)
+		batches[n] = append(batches[n], keyImpact{key: key, impact: entry.Impact, result: &results[i]})
+		if entry.Impact == 0 {
+			continue
+		}
+		for _, prefix := range store.enclosingPrefixes(entry.IP) {
+			n = store.shardIndex(prefix)
+			batches[n] = append(batches[n], keyImpact{key: prefix, impact: entry.Impact})
+		}
+	}
+	for n, batch := range batches {
+		if len(batch) > 0 {
+			store.shards[n].logKeys(store.counting, batch, now)
+		}
+	}
+	return results
+}
 
-	ipData, _ := ipStoreForgive(ipStore, ip, impacts)
+// ForgiveIP subtracts the impacts from the specified IP's time windows,
+// and from its enclosing prefix records.
+// It returns a copy of the IP's updated data, or an empty IPData if the IP does not exist.
+// If the store has an op log, the operation is appended to it first
+// Takes a read lock on the IP's shard, takes a write lock on the IPData
+func (store *IPDataStore) ForgiveIP(ip IPAddr, impacts ImpactAmounts) *IPData {
+	now := time.Now()
+	if store.oplog != nil {
+		store.oplog.cut.RLock()
+		defer store.oplog.cut.RUnlock()
+		err := store.oplog.appendForgiveIP(ip, impacts, now)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return store.forgiveIPAtTime(ip, impacts, now)
+}
+
+// forgiveIPAtTime performs the real work of ForgiveIP, and takes the current time as
+// a parameter so that op log entries can be replayed at their original time
+func (store *IPDataStore) forgiveIPAtTime(ip IPAddr, impacts ImpactAmounts, now time.Time) *IPData {
+	key := ip.HostPrefix()
+	ipData, exists := store.shardFor(key).forgiveKey(store.counting, key, impacts, now)
+	if !exists {
+		return newIPData(store.counting)
+	}
+	for _, prefix := range store.enclosingPrefixes(ip) {
+		store.shardFor(prefix).forgiveKey(store.counting, prefix, impacts, now)
+	}
 	return ipData
 }
 
-// ipStoreForgive attempts to retrieve the specified IP's data from the store.
-// If the IP does not exist, it returns a zero IPData and false for existence.
-// If the IP does exist, it updates the record in place.
+// GetIP returns a copy of the specified IP's data, with its score decayed to the
+// current time. Nothing in the store is modified. If the IP does not exist,
+// it returns nil and false for existence
+// Takes a read lock on the IP's shard
+func (store *IPDataStore) GetIP(ip IPAddr) (*IPData, bool) {
+	key := ip.HostPrefix()
+	ipData, exists := store.shardFor(key).lookupKey(key)
+	if !exists {
+		return nil, false
+	}
+	// the copy is not shared, so it can be brought up to date without a lock
+	ipData.decay(store.counting.halfLife, time.Now())
+	return ipData, true
+}
+
+// Prefixes returns a copy of each of the IP's enclosing prefix records,
+// from the longest prefix to the shortest. Prefixes without a record are left out
+// Takes a read lock on each prefix's shard
+func (store *IPDataStore) Prefixes(ip IPAddr) []PrefixData {
+	var result []PrefixData
+	for _, prefix := range store.enclosingPrefixes(ip) {
+		ipData, exists := store.shardFor(prefix).lookupKey(prefix)
+		if exists {
+			result = append(result, PrefixData{Prefix: prefix, Data: ipData})
+		}
+	}
+	return result
+}
+
+// Len returns the number of host and prefix records in the store
+// Takes a read lock on each shard in turn
+func (store *IPDataStore) Len() int {
+	n := 0
+	for _, shard := range store.shards {
+		n += shard.len()
+	}
+	return n
+}
+
+// enclosingPrefixes returns the IP's prefixes at each of the store's
+// prefix lengths for its address family
+func (store *IPDataStore) enclosingPrefixes(ip IPAddr) []Prefix {
+	lengths := store.prefixes6
+	if ip.Is4() {
+		lengths = store.prefixes4
+	}
+
+	prefixes := make([]Prefix, len(lengths))
+	for i, bits := range lengths {
+		prefixes[i] = ip.Prefix(bits)
+	}
+	return prefixes
+}
+
+// ipStoreGet retrieves a copy of the key's data from the store.
+// If the key does not exist, it returns nil and false for existence.
 //
 // Takes a read lock on the datastore
-func ipStoreForgive(store syncIPDataStore, ip IPLong, impacts ImpactAmounts) (ipData IPData, exists bool) {
+func ipStoreGet(store syncIPDataStore, key Prefix) (ipData *IPData, exists bool) {
 	store.RLock()
 	defer store.RUnlock()
 
-	data, ok := store.getMap()[ip]
+	data, ok := store.getMap()[key]
 	if !ok {
-		return IPData{}, false
+		return nil, false
+	}
+	return data.clone(), true
+}
+
+// ipStoreForgive attempts to retrieve the specified key's data from the store.
+// If the key does not exist, it returns nil and false for existence.
+// If the key does exist, it updates the record in place.
+//
+// Takes a read lock on the datastore
+func ipStoreForgive(store syncIPDataStore, c *counting, key Prefix, impacts ImpactAmounts, now time.Time) (ipData *IPData, exists bool) {
+	store.RLock()
+	defer store.RUnlock()
+
+	data, ok := store.getMap()[key]
+	if !ok {
+		return nil, false
 	}
 
-	data.forgive(impacts)
-	return *data, true
+	data.forgiveAtTime(c, impacts, now)
+	return data.clone(), true
 }
 
 // ipStoreInsert attempts to insert the IPData into the store.
-// If the IP does not yet exist in the map, it creates the datastructure and adds it.
-// If the IP already exists, it updates the existing record.
+// If the key does not yet exist in the map, it creates the datastructure and adds it.
+// If the key already exists, it updates the existing record.
 //
 // Takes a write lock on the whole datastore
-func ipStoreInsert(store syncIPDataStore, ip IPLong, impact ImpactAmount, blackWhite BWModifier) IPData {
+func ipStoreInsert(store syncIPDataStore, c *counting, key Prefix, impact ImpactAmount, blackWhite BWModifier, now time.Time) *IPData {
 	store.Lock()
 	defer store.Unlock()
 
 	var data *IPData
 
-	data, ok := store.getMap()[ip]
+	data, ok := store.getMap()[key]
 	if !ok {
-		data = new(IPData)
+		data = newIPData(c)
 	}
 
-	data.impact(impact, blackWhite)
-	store.getMap()[ip] = data
-	return *data
+	data.impactAtTime(c, impact, blackWhite, now)
+	store.getMap()[key] = data
+	return data.clone()
 }
 
-// ipStoreUpdate attempts to retrieve the specified IP's data from the store.
-// If the IP does not exist, it returns a zero IPData and false for existence.
-// If the IP does exist, it updates the record in place.
+// ipStoreUpdate attempts to retrieve the specified key's data from the store.
+// If the key does not exist, it returns nil and false for existence.
+// If the key does exist, it updates the record in place.
 //
 // Takes a read lock on the datastore
-func ipStoreUpdate(store syncIPDataStore, ip IPLong, impact ImpactAmount, blackWhite BWModifier) (ipData IPData, exists bool) {
+func ipStoreUpdate(store syncIPDataStore, c *counting, key Prefix, impact ImpactAmount, blackWhite BWModifier, now time.Time) (ipData *IPData, exists bool) {
 	store.RLock()
 	defer store.RUnlock()
 
-	data, ok := store.getMap()[ip]
+	data, ok := store.getMap()[key]
 	if !ok {
-		return IPData{}, false
+		return nil, false
 	}
 
-	data.impact(impact, blackWhite)
+	data.impactAtTime(c, impact, blackWhite, now)
 
-	return *data, true
+	return data.clone(), true
 }
 
-func copyIPData(dst, src syncIPDataStore, ip IPLong) {
+func copyIPData(dst, src syncIPDataStore, key Prefix) {
 	dst.Lock()
 	defer dst.Unlock()
 	src.RLock()
 	defer src.RUnlock()
 
-	_, exists := dst.getMap()[ip]
+	_, exists := dst.getMap()[key]
 	if exists {
 		return
 	}
 
-	srcIPData, exists := src.getMap()[ip]
+	srcIPData, exists := src.getMap()[key]
 	if !exists {
 		return
 	}
 
-	dst.getMap()[ip] = new(IPData)
-
-	*dst.getMap()[ip] = *srcIPData
+	dst.getMap()[key] = srcIPData.clone()
 }
 
-func moveIPData(dst, src syncIPDataStore, ip IPLong) {
+func moveIPData(dst, src syncIPDataStore, key Prefix) {
 	src.Lock()
 	defer src.Unlock()
 	dst.Lock()
 	defer dst.Unlock()
 
-	dst.getMap()[ip] = src.getMap()[ip]
-	delete(src.getMap(), ip)
+	dst.getMap()[key] = src.getMap()[key]
+	delete(src.getMap(), key)
 }
 
-// Persist asynchronously saves the data store to disk
+// Persist saves the data store to disk. Every shard's wal starts writing at the
+// same moment, so the saved kdb is a point in time snapshot of the whole store.
+// Each shard's wal is drained once the kdb has been written, and then any
+// records over the shard's cap are evicted.
+//
+// While the kdb is written, the shards' maps do not change: logging and forgiving
+// go to the wals, and the sweeper waits. So new IPs are inserted without waiting
+// for the kdb, and the encoder only holds each shard's read lock while it copies
+// the shard's records, never while it writes them.
+//
+// With the op log, a new segment is started at the same moment as the wals,
+// and the older segments are removed once the kdb has been written.
+// Finally a snapshot of the kdb is kept, if the store keeps snapshots.
+// Calls to Persist wait for one another
 func (store *IPDataStore) Persist() error {
-	store.setWALStatus(walWriting)
-	err := store.writeToFile()
-	store.setWALStatus(walDraining)
-	store.drainWAL()
-	store.setWALStatus(walInactive)
+	store.persisting.Lock()
+	defer store.persisting.Unlock()
 
-	return err
+	err := store.persist(store.writeToFile)
+	if err != nil || !store.snapshotsEnabled() {
+		return err
+	}
+	return store.saveSnapshot(time.Now())
+}
+
+// persist performs the real work of Persist, and takes the function which writes
+// the kdb as a parameter to aid in testing
+func (store *IPDataStore) persist(write func() error) error {
+	if store.oplog != nil {
+		segment, err := store.oplog.rotate(func() {
+			store.setWALStatus(walWriting)
+		})
+		if err != nil {
+			return err
+		}
+		store.logSegment = segment
+	} else {
+		store.setWALStatus(walWriting)
+	}
+
+	err := write()
+	for _, shard := range store.shards {
+		shard.setWALStatus(walDraining)
+		shard.drainWAL()
+		shard.setWALStatus(walInactive)
+		shard.enforceCap()
+	}
+	if err != nil {
+		return err
+	}
+
+	return removeOpLogSegments(store.dataDir, store.logSegment)
+}
+
+// Close stops the op log, if the store has one, after flushing it to disk
+func (store *IPDataStore) Close() error {
+	if store.oplog == nil {
+		return nil
+	}
+	return store.oplog.close()
 }
 
 func (store *IPDataStore) drainWAL() {
-	ips := store.wal.getIPs()
-	for _, ip := range ips {
-		moveIPData(store, store.wal, ip)
+	for _, shard := range store.shards {
+		shard.drainWAL()
 	}
 }
 
+// setWALStatus sets the state of every shard's wal at once, by holding
+// all of their status locks while the state changes
 func (store *IPDataStore) setWALStatus(state int) {
-	store.wal.status.Lock()
-	defer store.wal.status.Unlock()
-
-	store.wal.status.state = state
+	for _, shard := range store.shards {
+		shard.wal.status.Lock()
+	}
+	for _, shard := range store.shards {
+		shard.wal.status.state = state
+		shard.wal.status.Unlock()
+	}
 }
 
 func (store *IPDataStore) writeToFile() error {
@@ -282,6 +665,8 @@ func (store *IPDataStore) writeToFile() error {
 
 	// write the encoded IPDataMap to temp file and fsync
 	enc := newEncoder(file)
+	enc.logSegment = store.logSegment
+	enc.compression = store.compression
 	err = enc.encode(store)
 	if err != nil {
 		return err
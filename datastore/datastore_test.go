@@ -12,17 +12,47 @@ type DataStoreS struct{}
 
 var _ = Suite(&DataStoreS{})
 
-func checkForImpact(c *C, data IPData, amount ImpactAmount) {
-	c.Check(data.MaxImpacts.FiveMin, Equals, amount)
-	c.Check(data.MaxImpacts.Hour, Equals, amount)
-	c.Check(data.MaxImpacts.Day, Equals, amount)
+func checkForImpact(c *C, data *IPData, amount ImpactAmount) {
+	c.Assert(len(data.MaxImpacts), Equals, len(DefaultWindows))
+	for _, maxImpact := range data.MaxImpacts {
+		c.Check(maxImpact, Equals, amount)
+	}
+}
+
+// newStore returns a new store with the config, failing the test if it can't be created
+func newStore(c *C, config Config) *IPDataStore {
+	store, err := New(config)
+	c.Assert(err, IsNil)
+	return store
+}
+
+// getRecord returns the store's record for the key, or nil if it does not exist
+func getRecord(store *IPDataStore, key Prefix) *IPData {
+	return store.shardFor(key).m[key]
+}
+
+// walLen returns the number of records in all of the store's wals
+func walLen(store *IPDataStore) int {
+	n := 0
+	for _, shard := range store.shards {
+		n += len(shard.wal.getIPs())
+	}
+	return n
+}
+
+func (s *DataStoreS) TestBWModifierValid(c *C) {
+	for _, m := range []BWModifier{BWNop, BWWhitelist, BWUnWhitelist, BWBlacklist, BWUnBlacklist} {
+		c.Check(m.Valid(), Equals, true)
+	}
+	c.Check(BWModifier(BWUnBlacklist+1).Valid(), Equals, false)
+	c.Check(BWModifier(0xFF).Valid(), Equals, false)
 }
 
 func (s *DataStoreS) TestLogIP(c *C) {
-	store := New("/tmp", "")
-	ip := IPLong(0)
+	store := newStore(c, Config{DataDir: "/tmp"})
+	ip := IPLong(0).IPAddr()
 	amount := ImpactAmount(64)
-	var data IPData
+	var data *IPData
 
 	// impact by amount
 	data = store.LogIP(ip, amount, BWNop)
@@ -38,11 +68,43 @@ func (s *DataStoreS) TestLogIP(c *C) {
 	c.Check(data.BlackWhite, Equals, byte(3))
 }
 
+func (s *DataStoreS) TestLogIPPrefixes(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Prefixes4: []int{24, 16}, Prefixes6: []int{64}})
+	amount := ImpactAmount(64)
+
+	// two hosts in the same /24
+	a, _ := ParseIPAddr("10.1.2.3")
+	b, _ := ParseIPAddr("10.1.2.4")
+	store.LogIP(a, amount, BWNop)
+	data := store.LogIP(b, amount, BWBlacklist)
+	checkForImpact(c, data, amount)
+
+	prefixes := store.Prefixes(b)
+	c.Assert(len(prefixes), Equals, 2)
+	c.Check(prefixes[0].Prefix.String(), Equals, "10.1.2.0/24")
+	checkForImpact(c, prefixes[0].Data, 2*amount)
+	c.Check(prefixes[0].Data.BlackWhite, Equals, byte(0))
+	c.Check(prefixes[1].Prefix.String(), Equals, "10.1.0.0/16")
+	checkForImpact(c, prefixes[1].Data, 2*amount)
+
+	// forgiving a host also forgives its prefixes
+	store.ForgiveIP(a, ImpactAmounts{amount, amount, amount})
+	prefixes = store.Prefixes(a)
+	checkForImpact(c, prefixes[0].Data, amount)
+
+	// ipv6 uses its own prefix lengths
+	v6, _ := ParseIPAddr("2001:db8::1")
+	store.LogIP(v6, amount, BWNop)
+	prefixes = store.Prefixes(v6)
+	c.Assert(len(prefixes), Equals, 1)
+	c.Check(prefixes[0].Prefix.String(), Equals, "2001:db8::/64")
+}
+
 func (s *DataStoreS) TestLogNewIPWAL(c *C) {
-	store := New("/tmp", "")
-	ip := IPLong(0)
+	store := newStore(c, Config{DataDir: "/tmp"})
+	ip := IPLong(0).IPAddr()
 	amount := ImpactAmount(64)
-	var data IPData
+	var data *IPData
 
 	store.setWALStatus(walWriting)
 
@@ -60,11 +122,11 @@ func (s *DataStoreS) TestLogNewIPWAL(c *C) {
 	c.Check(data.BlackWhite, Equals, byte(0))
 
 	// ip should be in the WAL
-	c.Check(len(store.wal.getIPs()), Equals, 1)
+	c.Check(walLen(store), Equals, 1)
 
 	store.drainWAL()
 	// WAL should now be empty
-	c.Check(len(store.wal.getIPs()), Equals, 0)
+	c.Check(walLen(store), Equals, 0)
 
 	// impact
 	data = store.LogIP(ip, amount, BWNop)
@@ -75,7 +137,7 @@ func (s *DataStoreS) TestLogNewIPWAL(c *C) {
 	store.setWALStatus(walInactive)
 
 	// WAL should still be empty
-	c.Check(len(store.wal.getIPs()), Equals, 0)
+	c.Check(walLen(store), Equals, 0)
 
 	// impact
 	data = store.LogIP(ip, amount, BWNop)
@@ -85,10 +147,10 @@ func (s *DataStoreS) TestLogNewIPWAL(c *C) {
 }
 
 func (s *DataStoreS) TestLogExistingIPWAL(c *C) {
-	store := New("/tmp", "")
-	ip := IPLong(0)
+	store := newStore(c, Config{DataDir: "/tmp"})
+	ip := IPLong(0).IPAddr()
 	amount := ImpactAmount(64)
-	var data IPData
+	var data *IPData
 
 	// impact by amount
 	data = store.LogIP(ip, amount, BWNop)
@@ -113,12 +175,12 @@ func (s *DataStoreS) TestLogExistingIPWAL(c *C) {
 	c.Check(data.BlackWhite, Equals, byte(0))
 
 	// ip should be in WAL
-	c.Check(len(store.wal.getIPs()), Equals, 1)
+	c.Check(walLen(store), Equals, 1)
 
 	store.drainWAL()
 
 	// WAL should now be empty
-	c.Check(len(store.wal.getIPs()), Equals, 0)
+	c.Check(walLen(store), Equals, 0)
 
 	// impact
 	data = store.LogIP(ip, amount, BWNop)
@@ -129,7 +191,7 @@ func (s *DataStoreS) TestLogExistingIPWAL(c *C) {
 	store.setWALStatus(walInactive)
 
 	// WAL should still be empty
-	c.Check(len(store.wal.getIPs()), Equals, 0)
+	c.Check(walLen(store), Equals, 0)
 
 	// impact
 	data = store.LogIP(ip, amount, BWNop)
@@ -137,3 +199,97 @@ func (s *DataStoreS) TestLogExistingIPWAL(c *C) {
 	c.Check(data.Forgiven, Equals, ForgivenNum(0))
 	c.Check(data.BlackWhite, Equals, byte(0))
 }
+
+func (s *DataStoreS) TestGetIP(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Prefixes4: []int{24}})
+	ip := IPLong(1).IPAddr()
+
+	// looking up a missing IP does not create it
+	_, exists := store.GetIP(ip)
+	c.Check(exists, Equals, false)
+	c.Check(store.Len(), Equals, 0)
+
+	store.LogIP(ip, ImpactAmount(5), BWBlacklist)
+	data, exists := store.GetIP(ip)
+	c.Assert(exists, Equals, true)
+	checkForImpact(c, data, 5)
+	c.Check(data.BlackWhite, Not(Equals), byte(0))
+
+	// the returned copy is detached from the store
+	data.MaxImpacts[0] = 0
+	data, _ = store.GetIP(ip)
+	c.Check(data.MaxImpacts[0], Equals, ImpactAmount(5))
+
+	// records written to the wal during a persist are found
+	store.setWALStatus(walWriting)
+	store.LogIP(ip, ImpactAmount(5), BWNop)
+	data, _ = store.GetIP(ip)
+	checkForImpact(c, data, 10)
+	store.setWALStatus(walInactive)
+}
+
+func (s *DataStoreS) TestLogIPs(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 4, Prefixes4: []int{24}})
+	batch := []IPImpact{
+		{IPLong(0x0A000001).IPAddr(), 2},
+		{IPLong(0x0A000002).IPAddr(), 3},
+		{IPLong(0x0A000001).IPAddr(), 4},
+		{IPLong(0x0B000001).IPAddr(), 0},
+	}
+	results := store.LogIPs(batch)
+	c.Assert(results, HasLen, 4)
+
+	// each result is the IP's data as its entry left it
+	checkForImpact(c, results[0], 2)
+	checkForImpact(c, results[1], 3)
+	checkForImpact(c, results[2], 6)
+	checkForImpact(c, results[3], 0)
+	checkForImpact(c, getRecord(store, IPLong(0x0A000001).IPAddr().HostPrefix()), 6)
+	checkForImpact(c, getRecord(store, IPLong(0x0A000001).IPAddr().Prefix(24)), 9)
+	// an entry without impact only creates the host record, as LogIP does
+	c.Check(getRecord(store, IPLong(0x0B000001).IPAddr().Prefix(24)), IsNil)
+	c.Check(store.Len(), Equals, 4)
+
+	c.Check(store.LogIPs(nil), HasLen, 0)
+}
+
+func (s *DataStoreS) TestLogIPsWAL(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 4})
+	existing := IPLong(1).IPAddr()
+	store.LogIP(existing, ImpactAmount(1), BWNop)
+
+	store.setWALStatus(walWriting)
+	results := store.LogIPs([]IPImpact{{existing, 2}, {IPLong(2).IPAddr(), 2}})
+	checkForImpact(c, results[0], 3)
+	checkForImpact(c, results[1], 2)
+	// the shards don't change while the kdb is written
+	checkForImpact(c, getRecord(store, existing.HostPrefix()), 1)
+	c.Check(getRecord(store, IPLong(2).IPAddr().HostPrefix()), IsNil)
+	c.Check(walLen(store), Equals, 2)
+
+	store.setWALStatus(walDraining)
+	results = store.LogIPs([]IPImpact{{existing, 2}, {IPLong(3).IPAddr(), 2}})
+	checkForImpact(c, results[0], 5)
+	checkForImpact(c, results[1], 2)
+	// records not in the wal are updated in the shards
+	checkForImpact(c, getRecord(store, IPLong(3).IPAddr().HostPrefix()), 2)
+	c.Check(walLen(store), Equals, 2)
+
+	store.drainWAL()
+	store.setWALStatus(walInactive)
+	c.Check(walLen(store), Equals, 0)
+	checkForImpact(c, getRecord(store, existing.HostPrefix()), 5)
+	c.Check(store.Len(), Equals, 3)
+}
+
+func (s *DataStoreS) TestLogIPsCap(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 1, MaxRecords: 3})
+	var batch []IPImpact
+	for i := 0; i < 10; i++ {
+		batch = append(batch, IPImpact{IPLong(i).IPAddr(), 1})
+	}
+	store.LogIPs(batch)
+	c.Check(store.Len(), Equals, 3)
+	// the last IPs of the batch are the most recently touched
+	c.Check(getRecord(store, IPLong(9).IPAddr().HostPrefix()), NotNil)
+}
@@ -2,64 +2,213 @@ package datastore
 
 import (
 	"encoding/binary"
-	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"math"
+	"time"
 )
 
+// CorruptionError describes where and how a kdb is corrupted
+type CorruptionError struct {
+	Offset int64 // byte offset of the start of the corrupted part
+	Block  int   // index of the corrupted block, or -1 if the part is not in a block
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Block >= 0 {
+		return fmt.Sprintf("kdb corrupted at byte %d in block %d: %s", e.Offset, e.Block, e.Reason)
+	}
+	return fmt.Sprintf("kdb corrupted at byte %d: %s", e.Offset, e.Reason)
+}
+
+// kdbReader counts the bytes read from r, and adds them to crc if it is not nil
+type kdbReader struct {
+	r      io.Reader
+	offset int64
+	crc    hash.Hash32
+}
+
+func (kr *kdbReader) Read(p []byte) (int, error) {
+	n, err := kr.r.Read(p)
+	kr.offset += int64(n)
+	if kr.crc != nil {
+		kr.crc.Write(p[:n])
+	}
+	return n, err
+}
+
 type IPDataStoreDecoder struct {
-	r io.Reader
+	r           *kdbReader
+	version     uint32
+	format      *kdbFormat
+	counting    *counting
+	created     time.Time
+	recordCount uint64
+	logSegment  uint64
+	compression Compression
+	block       int // index of the block being read, or -1
+	headerRead  bool
 }
 
 func NewDecoder(r io.Reader) *IPDataStoreDecoder {
-	return &IPDataStoreDecoder{r: r}
+	return &IPDataStoreDecoder{r: &kdbReader{r: r}, block: -1}
 }
 
-func (dec *IPDataStoreDecoder) DecodeEvery(fn func(IPLong, *IPData)) error {
-	// read encoding version
-	var buf [43]byte
-	var version uint32
+// corrupted returns a CorruptionError for the part of the kdb starting at offset
+func (dec *IPDataStoreDecoder) corrupted(offset int64, reason string) error {
+	return &CorruptionError{Offset: offset, Block: dec.block, Reason: reason}
+}
+
+// readFull fills buf from the kdb. If the kdb ends first, or can't be
+// decompressed, it returns a CorruptionError for the part named by what
+func (dec *IPDataStoreDecoder) readFull(buf []byte, what string) error {
+	offset := dec.r.offset
+	_, err := io.ReadFull(dec.r, buf)
+	return dec.readError(err, offset, what)
+}
 
-	_, err := io.ReadFull(dec.r, buf[0:4])
+// readError converts an error reading the part of the kdb named by what,
+// starting at offset, to a CorruptionError if it is caused by the kdb's contents
+func (dec *IPDataStoreDecoder) readError(err error, offset int64, what string) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return dec.corrupted(offset, "truncated "+what)
+	}
+	if isCompressionError(err) {
+		return dec.corrupted(offset, "invalid compressed "+what+": "+err.Error())
+	}
+	return err
+}
+
+// ReadHeader reads the kdb's version and header. It is called by DecodeEvery
+// if it has not been called yet
+func (dec *IPDataStoreDecoder) ReadHeader() error {
+	if dec.headerRead {
+		return nil
+	}
+
+	// read encoding version
+	dec.r.crc = crc32.NewIEEE()
+	var buf [8]byte
+	err := dec.readFull(buf[0:4], "header")
 	if err != nil {
 		return err
 	}
-	version = binary.LittleEndian.Uint32(buf[0:4])
-	if version != encodingVersion {
-		return errors.New("Wrong version kdb")
+	dec.version = binary.LittleEndian.Uint32(buf[0:4])
+
+	format, ok := kdbFormats[dec.version]
+	if !ok {
+		return fmt.Errorf("Wrong version kdb: %d is not a known version", dec.version)
 	}
+	dec.format = format
 
-FileLoop:
-	for {
-		_, err := io.ReadFull(dec.r, buf[0:])
-		if err == io.EOF {
-			break FileLoop
-		} else if err != nil {
-			return err
-		}
-
-		// unpack buf into ip and the fields of IPData
-		ipData := &IPData{}
-		ip := IPLong(binary.LittleEndian.Uint32(buf[0:4]))
-		ipData.CurImpacts.FiveMin = ImpactAmount(binary.LittleEndian.Uint32(buf[4:8]))
-		ipData.CurImpacts.Hour = ImpactAmount(binary.LittleEndian.Uint32(buf[8:12]))
-		ipData.CurImpacts.Day = ImpactAmount(binary.LittleEndian.Uint32(buf[12:16]))
-		ipData.MaxImpacts.FiveMin = ImpactAmount(binary.LittleEndian.Uint32(buf[16:20]))
-		ipData.MaxImpacts.Hour = ImpactAmount(binary.LittleEndian.Uint32(buf[20:24]))
-		ipData.MaxImpacts.Day = ImpactAmount(binary.LittleEndian.Uint32(buf[24:28]))
-		ipData.StartTimes.FiveMin = binary.LittleEndian.Uint32(buf[28:32])
-		ipData.StartTimes.Hour = binary.LittleEndian.Uint32(buf[32:36])
-		ipData.StartTimes.Day = binary.LittleEndian.Uint32(buf[36:40])
-		ipData.Forgiven = ForgivenNum(binary.LittleEndian.Uint16(buf[40:42]))
-		ipData.BlackWhite = buf[42]
-
-		fn(ip, ipData)
+	dec.counting = &counting{windows: DefaultWindows, counter: CounterFixed, halfLife: DefaultHalfLife}
+	err = format.readHeader(dec)
+	dec.r.crc = nil
+	if err != nil {
+		return err
+	}
+
+	err = dec.counting.validate()
+	if err != nil {
+		return err
 	}
 
+	dec.headerRead = true
 	return nil
 }
 
+// Version returns the kdb's encoding version.
+// It is only valid after the header has been read
+func (dec *IPDataStoreDecoder) Version() uint32 {
+	return dec.version
+}
+
+// Created returns the time the kdb was written, or the zero time for kdbs
+// before version 7. It is only valid after the header has been read
+func (dec *IPDataStoreDecoder) Created() time.Time {
+	return dec.created
+}
+
+// RecordCount returns the number of records in the kdb, or 0 for kdbs
+// before version 7. It is only valid after the header has been read
+func (dec *IPDataStoreDecoder) RecordCount() uint64 {
+	return dec.recordCount
+}
+
+// LogSegment returns the first op log segment which is not included in the kdb,
+// or 0 for kdbs before version 8. It is only valid after the header has been read
+func (dec *IPDataStoreDecoder) LogSegment() uint64 {
+	return dec.logSegment
+}
+
+// Compression returns how the kdb after the header is compressed.
+// It is only valid after the header has been read
+func (dec *IPDataStoreDecoder) Compression() Compression {
+	return dec.compression
+}
+
+// Windows returns the time windows the kdb was written with.
+// It is only valid after the header has been read
+func (dec *IPDataStoreDecoder) Windows() Windows {
+	return dec.counting.windows
+}
+
+// HalfLife returns the score half-life the kdb was written with.
+// It is only valid after the header has been read
+func (dec *IPDataStoreDecoder) HalfLife() time.Duration {
+	return dec.counting.halfLife
+}
+
+// CounterType returns the counter type the kdb was written with.
+// It is only valid after the header has been read
+func (dec *IPDataStoreDecoder) CounterType() CounterType {
+	return dec.counting.counter
+}
+
+// DecodeEvery calls fn with each record of the kdb. Records of a version 7 block
+// are only passed to fn once the block's CRC has been checked. A kdb which is
+// truncated, or fails a check, returns a *CorruptionError
+func (dec *IPDataStoreDecoder) DecodeEvery(fn func(Prefix, *IPData)) error {
+	err := dec.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	dataSize := ipDataSize(dec.counting)
+	if !dec.format.hasScore {
+		dataSize -= scoreSize
+	}
+	return dec.format.decode(dec, dec.format.keySize+dataSize, fn)
+}
+
 func (dec *IPDataStoreDecoder) Decode(m *IPDataMap) error {
-	return dec.DecodeEvery(func(ip IPLong, ipData *IPData) {
-		(*m)[ip] = ipData
+	return dec.DecodeEvery(func(key Prefix, ipData *IPData) {
+		(*m)[key] = ipData
 	})
 }
+
+// getIPData unpacks an IPData laid out for the counting from buf, which must be
+// ipDataSize(c) long, or ipDataSize(c)-scoreSize long for kdbs without a score
+func getIPData(buf []byte, c *counting) *IPData {
+	n := len(c.windows)
+	ipData := newIPData(c)
+	for i := 0; i < n; i++ {
+		ipData.CurImpacts[i] = ImpactAmount(binary.LittleEndian.Uint32(buf[4*i : 4*i+4]))
+		ipData.MaxImpacts[i] = ImpactAmount(binary.LittleEndian.Uint32(buf[4*(n+i) : 4*(n+i)+4]))
+		ipData.StartTimes[i] = binary.LittleEndian.Uint32(buf[4*(2*n+i) : 4*(2*n+i)+4])
+	}
+	ipData.Forgiven = ForgivenNum(binary.LittleEndian.Uint16(buf[12*n : 12*n+2]))
+	ipData.BlackWhite = buf[12*n+2]
+	for i := range ipData.Buckets {
+		ipData.Buckets[i] = ImpactAmount(binary.LittleEndian.Uint32(buf[12*n+3+4*i : 12*n+7+4*i]))
+	}
+	off := 12*n + 3 + 4*c.numBuckets()
+	if len(buf) >= off+scoreSize {
+		ipData.Score = math.Float64frombits(binary.LittleEndian.Uint64(buf[off : off+8]))
+		ipData.ScoreTime = binary.LittleEndian.Uint32(buf[off+8 : off+12])
+	}
+	return ipData
+}
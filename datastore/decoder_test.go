@@ -0,0 +1,286 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	. "gopkg.in/check.v1"
+	"hash/crc32"
+	"time"
+)
+
+type DecoderS struct{}
+
+var _ = Suite(&DecoderS{})
+
+func (s *DecoderS) TestDecodeV1(c *C) {
+	var buf [4 + 4 + 39]byte
+	binary.LittleEndian.PutUint32(buf[0:4], 1)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(0x0A000001)) // 10.0.0.1
+	binary.LittleEndian.PutUint32(buf[8:12], 7)                 // CurImpacts.FiveMin
+	binary.LittleEndian.PutUint32(buf[20:24], 9)                // MaxImpacts.FiveMin
+	buf[len(buf)-1] = 2                                         // BlackWhite
+
+	m := make(IPDataMap)
+	err := NewDecoder(bytes.NewReader(buf[0:])).Decode(&m)
+	c.Assert(err, IsNil)
+	c.Assert(len(m), Equals, 1)
+
+	ip, err := ParseIPAddr("10.0.0.1")
+	c.Assert(err, IsNil)
+	data, ok := m[ip.HostPrefix()]
+	c.Assert(ok, Equals, true)
+	c.Check(data.CurImpacts[0], Equals, ImpactAmount(7))
+	c.Check(data.MaxImpacts[0], Equals, ImpactAmount(9))
+	c.Check(data.BlackWhite, Equals, byte(2))
+}
+
+func (s *DecoderS) TestEncodeDecode(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir()})
+	ip4 := IPLong(0x0A000001).IPAddr()
+	ip6, err := ParseIPAddr("2001:db8::1")
+	c.Assert(err, IsNil)
+
+	store.LogIP(ip4, ImpactAmount(3), BWNop)
+	store.LogIP(ip6, ImpactAmount(5), BWBlacklist)
+
+	var buf bytes.Buffer
+	err = newEncoder(&buf).encode(store)
+	c.Assert(err, IsNil)
+
+	m := make(IPDataMap)
+	err = NewDecoder(&buf).Decode(&m)
+	c.Assert(err, IsNil)
+	c.Assert(len(m), Equals, 2)
+	c.Check(m[ip4.HostPrefix()].MaxImpacts[2], Equals, ImpactAmount(3))
+	c.Check(m[ip6.HostPrefix()].MaxImpacts[2], Equals, ImpactAmount(5))
+	c.Check(m[ip6.HostPrefix()].BlackWhite, Equals, byte(2))
+	c.Check(m[ip6.HostPrefix()].Score, Equals, float64(5))
+	c.Check(m[ip6.HostPrefix()].ScoreTime, Not(Equals), uint32(0))
+}
+
+func (s *DecoderS) TestEncodeDecodeWindows(c *C) {
+	windows := Windows{time.Minute, 7 * 24 * time.Hour}
+	store := newStore(c, Config{DataDir: c.MkDir(), Windows: windows})
+	ip := IPLong(1).IPAddr()
+	store.LogIP(ip, ImpactAmount(3), BWNop)
+
+	var buf bytes.Buffer
+	err := newEncoder(&buf).encode(store)
+	c.Assert(err, IsNil)
+
+	dec := NewDecoder(&buf)
+	m := make(IPDataMap)
+	err = dec.Decode(&m)
+	c.Assert(err, IsNil)
+	c.Check(dec.Windows(), DeepEquals, windows)
+	c.Check(dec.HalfLife(), Equals, DefaultHalfLife)
+	c.Check(m[ip.HostPrefix()].MaxImpacts, DeepEquals, ImpactAmounts{3, 3})
+}
+
+func (s *DecoderS) TestLoadConvertsWindows(c *C) {
+	dir := c.MkDir()
+	ip := IPLong(1).IPAddr()
+	store := newStore(c, Config{DataDir: dir, Windows: Windows{time.Minute, time.Hour}})
+	store.LogIP(ip, ImpactAmount(3), BWNop)
+	c.Assert(store.Persist(), IsNil)
+
+	store = newStore(c, Config{DataDir: dir, Windows: Windows{time.Hour, 24 * time.Hour}})
+	c.Check(getRecord(store, ip.HostPrefix()).MaxImpacts, DeepEquals, ImpactAmounts{3, 0})
+}
+
+func (s *DecoderS) TestEncodeDecodeSliding(c *C) {
+	config := Config{DataDir: c.MkDir(), Windows: Windows{time.Minute}, Counter: CounterSliding, Buckets: 6}
+	store := newStore(c, config)
+	ip := IPLong(1).IPAddr()
+	store.LogIP(ip, ImpactAmount(3), BWNop)
+	c.Assert(store.Persist(), IsNil)
+
+	store = newStore(c, config)
+	data := getRecord(store, ip.HostPrefix())
+	c.Check(data.CurImpacts, DeepEquals, ImpactAmounts{3})
+	c.Check(len(data.Buckets), Equals, 6)
+	c.Check(sum(data.Buckets), Equals, ImpactAmount(3))
+}
+
+func (s *DecoderS) TestLoadFixedAsSliding(c *C) {
+	dir := c.MkDir()
+	ip := IPLong(1).IPAddr()
+	store := newStore(c, Config{DataDir: dir})
+	store.LogIP(ip, ImpactAmount(3), BWNop)
+	c.Assert(store.Persist(), IsNil)
+
+	store = newStore(c, Config{DataDir: dir, Counter: CounterSliding})
+	data := getRecord(store, ip.HostPrefix())
+	c.Check(data.CurImpacts, DeepEquals, ImpactAmounts{3, 3, 3})
+	c.Check(len(data.Buckets), Equals, 3*DefaultBuckets)
+	c.Check(sum(data.Buckets), Equals, ImpactAmount(9))
+}
+
+func (s *DecoderS) TestEncodeDecodePrefixes(c *C) {
+	dir := c.MkDir()
+	config := Config{DataDir: dir, Prefixes4: []int{24}}
+	store := newStore(c, config)
+	ip := IPLong(0x0A000001).IPAddr()
+	store.LogIP(ip, ImpactAmount(3), BWNop)
+	c.Assert(store.Persist(), IsNil)
+
+	store = newStore(c, config)
+	c.Check(store.Len(), Equals, 2)
+	c.Check(getRecord(store, ip.HostPrefix()).MaxImpacts[0], Equals, ImpactAmount(3))
+	c.Check(getRecord(store, ip.Prefix(24)).MaxImpacts[0], Equals, ImpactAmount(3))
+}
+
+func (s *DecoderS) TestDecodeWrongVersion(c *C) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[0:4], 99)
+
+	m := make(IPDataMap)
+	err := NewDecoder(bytes.NewReader(buf[0:])).Decode(&m)
+	c.Check(err, NotNil)
+}
+
+// encodeTestStore returns a kdb of a store with n host records
+func encodeTestStore(c *C, n int) []byte {
+	return encodeCompressedTestStore(c, n, CompressNone)
+}
+
+// encodeCompressedTestStore returns a kdb of a store with n host records,
+// compressed with compression
+func encodeCompressedTestStore(c *C, n int, compression Compression) []byte {
+	store := newStore(c, Config{DataDir: c.MkDir()})
+	for i := 0; i < n; i++ {
+		store.LogIP(IPLong(i).IPAddr(), ImpactAmount(1), BWNop)
+	}
+	var buf bytes.Buffer
+	enc := newEncoder(&buf)
+	enc.compression = compression
+	c.Assert(enc.encode(store), IsNil)
+	return buf.Bytes()
+}
+
+// checkCorrupted decodes the kdb and checks that it fails with a CorruptionError
+func checkCorrupted(c *C, kdb []byte, block int, reason string) *CorruptionError {
+	m := make(IPDataMap)
+	err := NewDecoder(bytes.NewReader(kdb)).Decode(&m)
+	corruption, ok := err.(*CorruptionError)
+	c.Assert(ok, Equals, true, Commentf("%v", err))
+	c.Check(corruption.Block, Equals, block)
+	c.Check(corruption.Reason, Matches, reason)
+	return corruption
+}
+
+func (s *DecoderS) TestDecodeHeader(c *C) {
+	kdb := encodeTestStore(c, 5)
+	dec := NewDecoder(bytes.NewReader(kdb))
+	c.Assert(dec.ReadHeader(), IsNil)
+	c.Check(dec.Version(), Equals, encodingVersion)
+	c.Check(dec.RecordCount(), Equals, uint64(5))
+	c.Check(time.Since(dec.Created()) < time.Minute, Equals, true)
+}
+
+func (s *DecoderS) TestDecodeBlocks(c *C) {
+	n := 2*blockRecords + 1
+	kdb := encodeTestStore(c, n)
+
+	m := make(IPDataMap)
+	c.Assert(NewDecoder(bytes.NewReader(kdb)).Decode(&m), IsNil)
+	c.Check(len(m), Equals, n)
+}
+
+func (s *DecoderS) TestDecodeEmpty(c *C) {
+	kdb := encodeTestStore(c, 0)
+	m := make(IPDataMap)
+	c.Assert(NewDecoder(bytes.NewReader(kdb)).Decode(&m), IsNil)
+	c.Check(len(m), Equals, 0)
+}
+
+func (s *DecoderS) TestDecodeTruncated(c *C) {
+	kdb := encodeTestStore(c, blockRecords+1)
+	headerSize := 11 + 4*len(DefaultWindows) + 29
+	recordSize := keySize + ipDataSize(fixedCounting)
+
+	checkCorrupted(c, kdb[0:2], -1, "truncated header")
+	checkCorrupted(c, kdb[0:headerSize-1], -1, "truncated header")
+	// cut in the middle of the second block's record
+	corruption := checkCorrupted(c, kdb[0:len(kdb)-30], 1, "truncated block")
+	c.Check(corruption.Offset, Equals, int64(headerSize+4+blockRecords*recordSize+4+4))
+	// cut at the end of a block, before the end of blocks marker
+	checkCorrupted(c, kdb[0:len(kdb)-16], 2, "truncated block")
+	checkCorrupted(c, kdb[0:len(kdb)-4], -1, "truncated footer")
+}
+
+func (s *DecoderS) TestDecodeChecksums(c *C) {
+	kdb := encodeTestStore(c, blockRecords+1)
+	headerSize := 11 + 4*len(DefaultWindows) + 29
+	recordSize := keySize + ipDataSize(fixedCounting)
+
+	corrupt := append([]byte(nil), kdb...)
+	corrupt[12] ^= 0xff
+	checkCorrupted(c, corrupt, -1, "header checksum mismatch")
+
+	corrupt = append([]byte(nil), kdb...)
+	secondBlock := headerSize + 4 + blockRecords*recordSize + 4
+	corrupt[secondBlock+10] ^= 0xff
+	corruption := checkCorrupted(c, corrupt, 1, "block checksum mismatch")
+	c.Check(corruption.Offset, Equals, int64(secondBlock))
+}
+
+func (s *DecoderS) TestDecodeFooter(c *C) {
+	kdb := encodeTestStore(c, 3)
+
+	corrupt := append([]byte(nil), kdb...)
+	corrupt[len(corrupt)-1] = 'X'
+	checkCorrupted(c, corrupt, -1, "invalid footer")
+
+	corrupt = append([]byte(nil), kdb...)
+	corrupt[len(corrupt)-12] = 9
+	checkCorrupted(c, corrupt, -1, "record count mismatch.*")
+
+	checkCorrupted(c, append(kdb, 0), -1, "data after footer")
+}
+
+func (s *DecoderS) TestDecodeTruncatedV1(c *C) {
+	var buf [4 + 4 + 39 + 10]byte
+	binary.LittleEndian.PutUint32(buf[0:4], 1)
+
+	corruption := checkCorrupted(c, buf[0:], -1, "truncated record")
+	c.Check(corruption.Offset, Equals, int64(4+4+39))
+}
+
+func (s *DecoderS) TestDecodeCompressed(c *C) {
+	n := blockRecords + 1
+	kdb := encodeCompressedTestStore(c, n, CompressGzip)
+	c.Check(len(kdb) < len(encodeTestStore(c, n)), Equals, true)
+
+	dec := NewDecoder(bytes.NewReader(kdb))
+	m := make(IPDataMap)
+	c.Assert(dec.Decode(&m), IsNil)
+	c.Check(dec.Compression(), Equals, CompressGzip)
+	c.Check(len(m), Equals, n)
+	c.Check(m[IPLong(1).IPAddr().HostPrefix()].MaxImpacts[0], Equals, ImpactAmount(1))
+}
+
+func (s *DecoderS) TestDecodeCompressedCorrupted(c *C) {
+	kdb := encodeCompressedTestStore(c, blockRecords+1, CompressGzip)
+	headerSize := 11 + 4*len(DefaultWindows) + 29
+
+	// the end of the gzip stream is missing
+	corruption := checkCorrupted(c, kdb[0:len(kdb)-4], -1, "truncated footer|invalid compressed.*")
+	c.Check(corruption.Offset > int64(headerSize), Equals, true)
+	checkCorrupted(c, kdb[0:headerSize+5], -1, "invalid compressed data")
+
+	// a changed byte in the gzip stream fails to decompress, or fails gzip's checksum
+	corrupt := append([]byte(nil), kdb...)
+	corrupt[len(corrupt)-6] ^= 0xff
+	m := make(IPDataMap)
+	err := NewDecoder(bytes.NewReader(corrupt)).Decode(&m)
+	_, ok := err.(*CorruptionError)
+	c.Check(ok, Equals, true, Commentf("%v", err))
+
+	// unknown compression
+	corrupt = append([]byte(nil), kdb...)
+	corrupt[headerSize-5] = 9
+	binary.LittleEndian.PutUint32(corrupt[headerSize-4:headerSize], crc32.ChecksumIEEE(corrupt[0:headerSize-4]))
+	err = NewDecoder(bytes.NewReader(corrupt)).Decode(&m)
+	c.Check(err, ErrorMatches, "Unknown compression 9")
+}
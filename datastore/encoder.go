@@ -2,53 +2,235 @@ package datastore
 
 import (
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"time"
 )
 
-const encodingVersion uint32 = 1
+// encodingVersion is the kdb version written by the encoder.
+//
+// Version 1 records are a 4 byte little endian ipv4 address followed by the IPData,
+// counted over DefaultWindows.
+// Version 2 records are a 16 byte network order IPAddr followed by the IPData,
+// counted over DefaultWindows.
+// Version 3 adds a header after the version of a 1 byte window count and each
+// window's duration as 4 byte little endian seconds. Its records are a 16 byte
+// network order IPAddr followed by the IPData, counted over the header's windows.
+// Version 4 adds a 1 byte counter type and 1 byte buckets per window to the start
+// of the header. With CounterSliding, each IPData is followed by its buckets.
+// Version 5 adds the score half-life as 4 byte little endian seconds after the
+// buckets in the header, and ends each IPData with an 8 byte little endian
+// float64 score and its 4 byte little endian unix time.
+// Version 6 records start with a 16 byte network order IPAddr and its 1 byte
+// prefix length, so prefix records are stored alongside host records.
+// Version 7 ends the header with an 8 byte little endian unix creation time,
+// an 8 byte little endian record count and a 4 byte CRC-32 of the header.
+// Records are grouped into blocks of a 4 byte little endian record count,
+// at most blockRecords records and a 4 byte CRC-32 of the count and records.
+// A block count of 0 ends the blocks, and is followed by a footer of the
+// 8 byte little endian record count and footerMagic.
+// Version 8 adds an 8 byte little endian op log segment to the header, before the
+// CRC. Op log segments before it are included in the kdb, and are not replayed.
+// Version 9 adds a 1 byte Compression to the header, before the CRC. Everything
+// after the header is compressed with it.
+const encodingVersion uint32 = 9
+
+const keySize = 17
+
+const scoreSize = 12
+
+// blockRecords is the most records in a version 7 block
+const blockRecords = 4096
+
+// footerMagic ends a version 7 kdb
+const footerMagic = "KEND"
+
+// ipDataSize returns the encoded size of an IPData with the counting's windows:
+// a cur impact, max impact and start time per window, then forgiven and blackwhite,
+// then the impact of every bucket, then the score and score time
+func ipDataSize(c *counting) int {
+	return 12*len(c.windows) + 3 + 4*c.numBuckets() + scoreSize
+}
 
 type ipDataStoreEncoder struct {
-	w io.Writer
+	w           io.Writer
+	logSegment  uint64 // first op log segment not included in the kdb
+	compression Compression
+	snapshot    []byte // encoded records of the shard being written
+	block       []byte // encoded records waiting to be written as a block
+	records     int    // number of records in block
+	written     uint64 // number of records written in blocks
 }
 
 func newEncoder(w io.Writer) *ipDataStoreEncoder {
 	return &ipDataStoreEncoder{w: w}
 }
 
+// encode writes the store as a kdb. The store must not change while it is
+// encoded, which Persist ensures by sending every change to the wal
 func (enc *ipDataStoreEncoder) encode(store *IPDataStore) error {
-	store.RLock()
-	defer store.RUnlock()
-
-	var buf [43]byte
+	// write encoding version and header
+	count := uint64(store.Len())
+	err := enc.writeHeader(store.counting, time.Now(), count)
+	if err != nil {
+		return err
+	}
 
-	// write encoding version
-	binary.LittleEndian.PutUint32(buf[0:4], uint32(encodingVersion))
-	_, err := enc.w.Write(buf[0:4])
+	// everything after the header is written through the compressor
+	raw := enc.w
+	compressor, err := enc.compression.compressWriter(raw)
 	if err != nil {
 		return err
 	}
+	enc.w = compressor
+	defer func() { enc.w = raw }()
 
-	for ip, ipData := range store.m {
-		// pack the ipData's individual data into a byte array
-		binary.LittleEndian.PutUint32(buf[0:4], uint32(ip))
-		binary.LittleEndian.PutUint32(buf[4:8], uint32(ipData.CurImpacts.FiveMin))
-		binary.LittleEndian.PutUint32(buf[8:12], uint32(ipData.CurImpacts.Hour))
-		binary.LittleEndian.PutUint32(buf[12:16], uint32(ipData.CurImpacts.Day))
-		binary.LittleEndian.PutUint32(buf[16:20], uint32(ipData.MaxImpacts.FiveMin))
-		binary.LittleEndian.PutUint32(buf[20:24], uint32(ipData.MaxImpacts.Hour))
-		binary.LittleEndian.PutUint32(buf[24:28], uint32(ipData.MaxImpacts.Day))
-		binary.LittleEndian.PutUint32(buf[28:32], uint32(ipData.StartTimes.FiveMin))
-		binary.LittleEndian.PutUint32(buf[32:36], uint32(ipData.StartTimes.Hour))
-		binary.LittleEndian.PutUint32(buf[36:40], uint32(ipData.StartTimes.Day))
-		binary.LittleEndian.PutUint16(buf[40:42], uint16(ipData.Forgiven))
-		buf[42] = ipData.BlackWhite
-
-		// write the buffer
-		_, err := enc.w.Write(buf[0:])
+	recordSize := keySize + ipDataSize(store.counting)
+	enc.block = make([]byte, 0, blockRecords*recordSize)
+	for _, shard := range store.shards {
+		err = enc.encodeShard(shard, store.counting, recordSize)
 		if err != nil {
 			return err
 		}
 	}
+	err = enc.flushBlock()
+	if err != nil {
+		return err
+	}
+
+	if enc.written != count {
+		return fmt.Errorf("Store changed while encoding: expected %d records, wrote %d", count, enc.written)
+	}
+	err = enc.writeFooter()
+	if err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// encodeShard adds every record in the shard to blocks. The records are packed
+// into the encoder's snapshot under the shard's read lock, which is released
+// before any of them are written, so a slow disk never holds up the shard
+func (enc *ipDataStoreEncoder) encodeShard(shard *ipDataShard, c *counting, recordSize int) error {
+	enc.snapshotShard(shard, c, recordSize)
+
+	for off := 0; off < len(enc.snapshot); off += recordSize {
+		enc.block = append(enc.block, enc.snapshot[off:off+recordSize]...)
+		enc.records++
+		if enc.records == blockRecords {
+			err := enc.flushBlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// snapshotShard replaces the encoder's snapshot with every record in the shard
+//
+// Takes a read lock on the shard
+func (enc *ipDataStoreEncoder) snapshotShard(shard *ipDataShard, c *counting, recordSize int) {
+	shard.RLock()
+	defer shard.RUnlock()
+
+	n := len(shard.m) * recordSize
+	if cap(enc.snapshot) < n {
+		enc.snapshot = make([]byte, n)
+	}
+	enc.snapshot = enc.snapshot[:n]
+
+	off := 0
+	for key, ipData := range shard.m {
+		// pack the key and the ipData's individual data into a byte array
+		buf := enc.snapshot[off : off+recordSize]
+		copy(buf[0:16], key.Addr[0:])
+		buf[16] = key.Bits
+		putIPData(buf[keySize:], c, ipData)
+		off += recordSize
+	}
+}
+
+// flushBlock writes the waiting records as a block, if there are any
+func (enc *ipDataStoreEncoder) flushBlock() error {
+	if enc.records == 0 {
+		return nil
+	}
+
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(enc.records))
+	crc := crc32.NewIEEE()
+	crc.Write(buf[0:4])
+	crc.Write(enc.block)
 
+	_, err := enc.w.Write(buf[0:4])
+	if err != nil {
+		return err
+	}
+	_, err = enc.w.Write(enc.block)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(buf[0:4], crc.Sum32())
+	_, err = enc.w.Write(buf[0:4])
+	if err != nil {
+		return err
+	}
+
+	enc.written += uint64(enc.records)
+	enc.block = enc.block[:0]
+	enc.records = 0
 	return nil
 }
+
+func (enc *ipDataStoreEncoder) writeHeader(c *counting, created time.Time, count uint64) error {
+	n := len(c.windows)
+	buf := make([]byte, 11+4*n+29)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(encodingVersion))
+	buf[4] = byte(c.counter)
+	buf[5] = byte(c.buckets)
+	binary.LittleEndian.PutUint32(buf[6:10], uint32(c.halfLife/time.Second))
+	buf[10] = byte(n)
+	for i, d := range c.windows {
+		binary.LittleEndian.PutUint32(buf[11+4*i:15+4*i], uint32(d/time.Second))
+	}
+	off := 11 + 4*n
+	binary.LittleEndian.PutUint64(buf[off:off+8], uint64(created.Unix()))
+	binary.LittleEndian.PutUint64(buf[off+8:off+16], count)
+	binary.LittleEndian.PutUint64(buf[off+16:off+24], enc.logSegment)
+	buf[off+24] = byte(enc.compression)
+	binary.LittleEndian.PutUint32(buf[off+25:off+29], crc32.ChecksumIEEE(buf[0:off+25]))
+	_, err := enc.w.Write(buf)
+	return err
+}
+
+// writeFooter writes the end of blocks marker and the footer
+func (enc *ipDataStoreEncoder) writeFooter() error {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf[4:12], enc.written)
+	copy(buf[12:16], footerMagic)
+	_, err := enc.w.Write(buf)
+	return err
+}
+
+// putIPData packs the IPData's fields into buf, which must be at least
+// ipDataSize(c) long
+func putIPData(buf []byte, c *counting, ipData *IPData) {
+	n := len(c.windows)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint32(buf[4*i:4*i+4], uint32(ipData.CurImpacts[i]))
+		binary.LittleEndian.PutUint32(buf[4*(n+i):4*(n+i)+4], uint32(ipData.MaxImpacts[i]))
+		binary.LittleEndian.PutUint32(buf[4*(2*n+i):4*(2*n+i)+4], ipData.StartTimes[i])
+	}
+	binary.LittleEndian.PutUint16(buf[12*n:12*n+2], uint16(ipData.Forgiven))
+	buf[12*n+2] = ipData.BlackWhite
+	for i := 0; i < c.numBuckets(); i++ {
+		binary.LittleEndian.PutUint32(buf[12*n+3+4*i:12*n+7+4*i], uint32(ipData.Buckets[i]))
+	}
+	off := 12*n + 3 + 4*c.numBuckets()
+	binary.LittleEndian.PutUint64(buf[off:off+8], math.Float64bits(ipData.Score))
+	binary.LittleEndian.PutUint32(buf[off+8:off+12], ipData.ScoreTime)
+}
@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type EncoderS struct{}
+
+var _ = Suite(&EncoderS{})
+
+// blockingWriter blocks the first write after the header until release is closed
+type blockingWriter struct {
+	writes  int
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes == 2 {
+		close(w.blocked)
+		<-w.release
+	}
+	return len(p), nil
+}
+
+// within returns true if fn returns before the timeout
+func within(timeout time.Duration, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (s *EncoderS) TestPersistDoesNotHoldShardLocks(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 4})
+	for i := 0; i < 100; i++ {
+		store.LogIP(IPLong(i).IPAddr(), ImpactAmount(1), BWNop)
+	}
+
+	w := &blockingWriter{blocked: make(chan struct{}), release: make(chan struct{})}
+	persisted := make(chan error)
+	go func() {
+		persisted <- store.persist(func() error {
+			return newEncoder(w).encode(store)
+		})
+	}()
+	<-w.blocked
+
+	// while the first block is being written, no shard is locked
+	for _, shard := range store.shards {
+		ok := within(time.Second, func() {
+			shard.Lock()
+			shard.Unlock()
+		})
+		c.Check(ok, Equals, true)
+	}
+
+	// and new and existing IPs are logged
+	ok := within(time.Second, func() {
+		store.LogIP(IPLong(1000).IPAddr(), ImpactAmount(1), BWNop)
+		store.LogIP(IPLong(1).IPAddr(), ImpactAmount(1), BWNop)
+	})
+	c.Check(ok, Equals, true)
+
+	close(w.release)
+	c.Assert(<-persisted, IsNil)
+	c.Check(store.Len(), Equals, 101)
+	c.Check(getRecord(store, IPLong(1).IPAddr().HostPrefix()).MaxImpacts[0], Equals, ImpactAmount(2))
+}
+
+func (s *EncoderS) TestInsertLatencyDuringPersist(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir()})
+	for i := 0; i < 4*blockRecords; i++ {
+		store.LogIP(IPLong(i).IPAddr(), ImpactAmount(1), BWNop)
+	}
+
+	w := &blockingWriter{blocked: make(chan struct{}), release: make(chan struct{})}
+	persisted := make(chan error)
+	go func() {
+		persisted <- store.persist(func() error {
+			return newEncoder(w).encode(store)
+		})
+	}()
+	<-w.blocked
+
+	// new IPs are logged while the persist can't finish, each well within a
+	// generous bound, which an insert waiting for the persist would never meet
+	const inserts = 100
+	latencies := make(chan time.Duration, inserts)
+	go func() {
+		for i := 0; i < inserts; i++ {
+			start := time.Now()
+			store.LogIP(IPLong(1<<24+i).IPAddr(), ImpactAmount(1), BWNop)
+			latencies <- time.Since(start)
+		}
+	}()
+	var maxLatency time.Duration
+	for i := 0; i < inserts; i++ {
+		select {
+		case latency := <-latencies:
+			if latency > maxLatency {
+				maxLatency = latency
+			}
+		case <-time.After(time.Second):
+			c.Fatalf("insert %d took over a second during a persist", i)
+		}
+	}
+	select {
+	case <-persisted:
+		c.Fatal("the persist finished before it was released")
+	default:
+	}
+	c.Logf("%d inserts during a persist, max latency %s", inserts, maxLatency)
+	c.Check(maxLatency < time.Second, Equals, true)
+
+	close(w.release)
+	c.Assert(<-persisted, IsNil)
+	c.Check(store.Len(), Equals, 4*blockRecords+inserts)
+}
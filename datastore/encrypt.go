@@ -0,0 +1,300 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// An encrypted stream is encryptMagic, a version byte, a 1 byte key ID length,
+// the key ID, and an 8 byte random nonce prefix, followed by chunks. Each chunk
+// is a 4 byte little endian length and up to encryptChunkSize bytes of plaintext
+// sealed with AES-GCM. A chunk's nonce is the prefix followed by the chunk's
+// 4 byte index, and its additional data is a byte which is 1 for the last chunk
+// and 0 otherwise, so reordered, dropped and truncated chunks fail to open
+const (
+	encryptMagic     = "KENC"
+	encryptVersion   = 1
+	encryptChunkSize = 64 * 1024
+)
+
+// KeyIDMetadata is the name of the object metadata which holds the
+// ID of the key an encrypted backup was encrypted with
+const KeyIDMetadata = "kawana-key-id"
+
+// ErrNoKey is returned when reading an encrypted stream without any keys
+var ErrNoKey = errors.New("Encrypted, but no key file was given")
+
+// EncryptionKeys holds AES-256 keys by ID. New streams are encrypted with
+// the first key, and streams encrypted with any of the keys can be decrypted
+type EncryptionKeys struct {
+	ids  []string
+	keys map[string][]byte
+}
+
+// ParseKeys parses a key file, which has a key on each line as an ID and 64 hex
+// digits separated by whitespace. Empty lines and lines starting with # are skipped
+func ParseKeys(data []byte) (*EncryptionKeys, error) {
+	k := &EncryptionKeys{keys: make(map[string][]byte)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Key file line %d: expected a key ID and a key", i+1)
+		}
+		id := fields[0]
+		if len(id) > 255 {
+			return nil, fmt.Errorf("Key file line %d: key ID is longer than 255 bytes", i+1)
+		}
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("Key file line %d: duplicate key ID %s", i+1, id)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Key file line %d: key must be 64 hex digits", i+1)
+		}
+		k.ids = append(k.ids, id)
+		k.keys[id] = key
+	}
+	if len(k.ids) == 0 {
+		return nil, errors.New("Key file has no keys")
+	}
+	return k, nil
+}
+
+// LoadKeyFile reads and parses the key file at path
+func LoadKeyFile(path string) (*EncryptionKeys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeys(data)
+}
+
+// CurrentID returns the ID of the key which new streams are encrypted with
+func (k *EncryptionKeys) CurrentID() string {
+	return k.ids[0]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptWriter seals everything written to it in chunks. Close writes
+// the last chunk, and does not close the underlying writer
+type encryptWriter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	nonce  []byte
+	chunk  uint32
+	buf    []byte
+	sealed []byte
+}
+
+// NewEncryptWriter returns a writer which encrypts to w with the current key
+func (k *EncryptionKeys) NewEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	id := k.CurrentID()
+	gcm, err := newGCM(k.keys[id])
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(encryptMagic)+2+len(id)+8)
+	header = append(header, encryptMagic...)
+	header = append(header, encryptVersion, byte(len(id)))
+	header = append(header, id...)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce[0:8])
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, nonce[0:8]...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, gcm: gcm, nonce: nonce, buf: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(ew.buf) == encryptChunkSize {
+			err := ew.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := encryptChunkSize - len(ew.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		ew.buf = append(ew.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ew *encryptWriter) Close() error {
+	return ew.seal(true)
+}
+
+// seal writes the buffered plaintext as a chunk
+func (ew *encryptWriter) seal(last bool) error {
+	binary.LittleEndian.PutUint32(ew.nonce[8:12], ew.chunk)
+	ew.chunk++
+	ad := []byte{0}
+	if last {
+		ad[0] = 1
+	}
+	ew.sealed = ew.gcm.Seal(ew.sealed[:0], ew.nonce, ew.buf, ad)
+	ew.buf = ew.buf[:0]
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[0:4], uint32(len(ew.sealed)))
+	_, err := ew.w.Write(length[0:4])
+	if err != nil {
+		return err
+	}
+	_, err = ew.w.Write(ew.sealed)
+	return err
+}
+
+// decryptReader opens the chunks of an encrypted stream
+type decryptReader struct {
+	r     io.Reader
+	gcm   cipher.AEAD
+	nonce []byte
+	chunk uint32
+	buf   []byte // opened plaintext not yet read
+	done  bool   // the last chunk has been opened
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		err := dr.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk
+func (dr *decryptReader) open() error {
+	var length [4]byte
+	_, err := io.ReadFull(dr.r, length[0:4])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("Encrypted stream is truncated")
+	} else if err != nil {
+		return err
+	}
+	n := binary.LittleEndian.Uint32(length[0:4])
+	if n > encryptChunkSize+uint32(dr.gcm.Overhead()) {
+		return errors.New("Encrypted stream has an invalid chunk length")
+	}
+	sealed := make([]byte, n)
+	_, err = io.ReadFull(dr.r, sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("Encrypted stream is truncated")
+	} else if err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(dr.nonce[8:12], dr.chunk)
+	dr.chunk++
+	// try the chunk as a middle chunk, and then as the last
+	dr.buf, err = dr.gcm.Open(sealed[:0:0], dr.nonce, sealed, []byte{0})
+	if err != nil {
+		dr.buf, err = dr.gcm.Open(sealed[:0:0], dr.nonce, sealed, []byte{1})
+		if err != nil {
+			return errors.New("Encrypted stream can't be decrypted: wrong key or corrupted data")
+		}
+		dr.done = true
+		// nothing may follow the last chunk
+		var extra [1]byte
+		if m, _ := io.ReadFull(dr.r, extra[0:1]); m > 0 {
+			return errors.New("Encrypted stream has data after its last chunk")
+		}
+	}
+	return nil
+}
+
+// IsEncrypted returns true if the stream read by r starts like an encrypted stream
+func IsEncrypted(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(encryptMagic))
+	return err == nil && bytes.Equal(magic, []byte(encryptMagic))
+}
+
+// NewDecryptReader returns a reader of the plaintext of the encrypted stream read
+// by r, and the ID of the key it was encrypted with. It returns ErrNoKey if k is nil
+func (k *EncryptionKeys) NewDecryptReader(r io.Reader) (io.Reader, string, error) {
+	header := make([]byte, len(encryptMagic)+2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, "", err
+	}
+	if string(header[0:4]) != encryptMagic {
+		return nil, "", errors.New("Not an encrypted stream")
+	}
+	if header[4] != encryptVersion {
+		return nil, "", fmt.Errorf("Unknown encrypted stream version %d", header[4])
+	}
+	id := make([]byte, header[5])
+	_, err = io.ReadFull(r, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if k == nil {
+		return nil, string(id), ErrNoKey
+	}
+	key, ok := k.keys[string(id)]
+	if !ok {
+		return nil, string(id), fmt.Errorf("Encrypted with key %s, which is not in the key file", id)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(r, nonce[0:8])
+	if err != nil {
+		return nil, "", err
+	}
+	return &decryptReader{r: r, gcm: gcm, nonce: nonce}, string(id), nil
+}
+
+// OpenKDB returns a reader of the kdb read by r, decrypting it with the keys if
+// it is encrypted. Unencrypted kdbs are read as they are, and keys may be nil
+func OpenKDB(r io.Reader, keys *EncryptionKeys) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if !IsEncrypted(br) {
+		return br, nil
+	}
+	dr, _, err := keys.NewDecryptReader(br)
+	return dr, err
+}
@@ -0,0 +1,135 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/rand"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"strings"
+)
+
+type EncryptS struct{}
+
+var _ = Suite(&EncryptS{})
+
+const testKeyFile = `# current key first
+k2 ` + "2222222222222222222222222222222222222222222222222222222222222222" + `
+k1 ` + "1111111111111111111111111111111111111111111111111111111111111111" + `
+`
+
+func testKeys(c *C) *EncryptionKeys {
+	keys, err := ParseKeys([]byte(testKeyFile))
+	c.Assert(err, IsNil)
+	return keys
+}
+
+// encrypt returns the data encrypted with the keys
+func encrypt(c *C, keys *EncryptionKeys, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := keys.NewEncryptWriter(&buf)
+	c.Assert(err, IsNil)
+	_, err = w.Write(data)
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	return buf.Bytes()
+}
+
+// decrypt returns the plaintext of the encrypted data
+func decrypt(keys *EncryptionKeys, data []byte) ([]byte, error) {
+	r, err := OpenKDB(bytes.NewReader(data), keys)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (s *EncryptS) TestParseKeys(c *C) {
+	keys := testKeys(c)
+	c.Check(keys.CurrentID(), Equals, "k2")
+
+	bad := []string{
+		"",
+		"# no keys",
+		"k1",
+		"k1 1234",
+		"k1 zz22222222222222222222222222222222222222222222222222222222222222",
+		"k1 " + strings.Repeat("1", 64) + "\nk1 " + strings.Repeat("2", 64),
+	}
+	for _, data := range bad {
+		_, err := ParseKeys([]byte(data))
+		c.Check(err, NotNil, Commentf("%q", data))
+	}
+}
+
+func (s *EncryptS) TestEncryptDecrypt(c *C) {
+	keys := testKeys(c)
+	for _, size := range []int{0, 1, encryptChunkSize - 1, encryptChunkSize, 3*encryptChunkSize + 5} {
+		data := make([]byte, size)
+		rand.Read(data)
+		encrypted := encrypt(c, keys, data)
+		c.Check(bytes.Contains(encrypted, data[0:size/2]) && size > 16, Equals, false)
+
+		decrypted, err := decrypt(keys, encrypted)
+		c.Assert(err, IsNil, Commentf("size %d", size))
+		c.Check(bytes.Equal(decrypted, data), Equals, true, Commentf("size %d", size))
+	}
+}
+
+func (s *EncryptS) TestDecryptWithOlderKey(c *C) {
+	old, err := ParseKeys([]byte("k1 " + strings.Repeat("1", 64)))
+	c.Assert(err, IsNil)
+	encrypted := encrypt(c, old, []byte("kdb"))
+
+	// a key file with a newer current key still decrypts
+	decrypted, err := decrypt(testKeys(c), encrypted)
+	c.Assert(err, IsNil)
+	c.Check(string(decrypted), Equals, "kdb")
+
+	other, err := ParseKeys([]byte("k3 " + strings.Repeat("3", 64)))
+	c.Assert(err, IsNil)
+	_, err = decrypt(other, encrypted)
+	c.Check(err, ErrorMatches, "Encrypted with key k1, which is not in the key file")
+
+	_, err = decrypt(nil, encrypted)
+	c.Check(err, Equals, ErrNoKey)
+}
+
+func (s *EncryptS) TestDecryptTampered(c *C) {
+	keys := testKeys(c)
+	data := make([]byte, 2*encryptChunkSize+10)
+	encrypted := encrypt(c, keys, data)
+	headerSize := len(encryptMagic) + 2 + len("k2") + 8
+	chunkSize := 4 + encryptChunkSize + 16
+
+	// a changed byte
+	corrupt := append([]byte(nil), encrypted...)
+	corrupt[len(corrupt)-20] ^= 1
+	_, err := decrypt(keys, corrupt)
+	c.Check(err, ErrorMatches, ".*can't be decrypted.*")
+
+	// a dropped last chunk
+	_, err = decrypt(keys, encrypted[0:headerSize+2*chunkSize])
+	c.Check(err, ErrorMatches, ".*truncated")
+
+	// swapped chunks
+	corrupt = append([]byte(nil), encrypted[0:headerSize]...)
+	corrupt = append(corrupt, encrypted[headerSize+chunkSize:headerSize+2*chunkSize]...)
+	corrupt = append(corrupt, encrypted[headerSize:headerSize+chunkSize]...)
+	corrupt = append(corrupt, encrypted[headerSize+2*chunkSize:]...)
+	_, err = decrypt(keys, corrupt)
+	c.Check(err, ErrorMatches, ".*can't be decrypted.*")
+
+	// data after the last chunk
+	_, err = decrypt(keys, append(encrypted, 0))
+	c.Check(err, ErrorMatches, ".*after its last chunk")
+}
+
+func (s *EncryptS) TestOpenUnencryptedKDB(c *C) {
+	kdb := encodeTestStore(c, 3)
+	plain, err := decrypt(testKeys(c), kdb)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(plain, kdb), Equals, true)
+	plain, err = decrypt(nil, kdb)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(plain, kdb), Equals, true)
+}
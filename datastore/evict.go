@@ -0,0 +1,134 @@
+package datastore
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// EvictionPolicy selects which record is removed when a full store inserts a new one
+type EvictionPolicy byte
+
+const (
+	// EvictLRU removes the least recently logged or forgiven record
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU removes the least frequently logged or forgiven record
+	EvictLFU
+)
+
+// evictionSamples is the number of records compared to choose each eviction.
+// Like Redis, the choice is approximate so that eviction is constant time
+const evictionSamples = 16
+
+// recordOverhead estimates the bytes a record uses besides its per window
+// amounts: the map entry and key, the IPData struct and its slice headers
+const recordOverhead = 200
+
+// ParseEvictionPolicy parses "lru" or "lfu"
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "lru":
+		return EvictLRU, nil
+	case "lfu":
+		return EvictLFU, nil
+	default:
+		return EvictLRU, fmt.Errorf("Unknown eviction policy %q", s)
+	}
+}
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(p))
+	}
+}
+
+// recordSize estimates the bytes of memory used by one record with the counting
+func recordSize(c *counting) int64 {
+	return int64(recordOverhead + 12*len(c.windows) + 4*c.numBuckets())
+}
+
+// maxShardRecords returns the number of records each of numShards shards may hold
+// under the config's caps, rounded down, or 0 if the store is not capped
+func (config *Config) maxShardRecords(c *counting, numShards int) int {
+	max := config.MaxRecords
+	if config.MaxBytes > 0 {
+		byBytes := int(config.MaxBytes / recordSize(c))
+		if max == 0 || byBytes < max {
+			max = byBytes
+		}
+	}
+	if max == 0 {
+		return 0
+	}
+
+	return max / numShards
+}
+
+// evictOver evicts records until the shard holds at most limit. Whitelisted and
+// blacklisted records are never evicted, so a shard of only listed records may
+// exceed its cap. It returns the number of records evicted
+//
+// Must be called with the shard's write lock held
+func (shard *ipDataShard) evictOver(limit int) int {
+	evicted := 0
+	for len(shard.m) > limit {
+		key, found := shard.chooseVictim()
+		if !found {
+			break
+		}
+		delete(shard.m, key)
+		evicted++
+	}
+	atomic.AddUint64(&shard.evictions, uint64(evicted))
+	return evicted
+}
+
+// enforceCap evicts records over the shard's cap, which may have been exceeded
+// by records inserted into the wal during a Persist
+//
+// Takes a write lock on the shard
+func (shard *ipDataShard) enforceCap() {
+	if shard.maxRecords == 0 {
+		return
+	}
+
+	shard.Lock()
+	defer shard.Unlock()
+
+	shard.evictOver(shard.maxRecords)
+}
+
+// chooseVictim samples the shard's unlisted records and returns the key of the
+// least recently or least frequently touched one
+//
+// Must be called with the shard's write lock held
+func (shard *ipDataShard) chooseVictim() (victim Prefix, found bool) {
+	var best int64
+	sampled := 0
+	// map iteration starts at a random element, which makes this a random sample
+	for key, data := range shard.m {
+		data.Mutex.RLock()
+		listed := data.BlackWhite != 0
+		rank := data.lastTouched()
+		if shard.policy == EvictLFU {
+			rank = int64(data.hits)
+		}
+		data.Mutex.RUnlock()
+
+		if listed {
+			continue
+		}
+		if !found || rank < best {
+			victim, best, found = key, rank, true
+		}
+		sampled++
+		if sampled == evictionSamples {
+			break
+		}
+	}
+	return victim, found
+}
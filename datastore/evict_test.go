@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type EvictS struct{}
+
+var _ = Suite(&EvictS{})
+
+func (s *EvictS) TestParseEvictionPolicy(c *C) {
+	p, err := ParseEvictionPolicy("lfu")
+	c.Check(err, IsNil)
+	c.Check(p, Equals, EvictLFU)
+	c.Check(p.String(), Equals, "lfu")
+	_, err = ParseEvictionPolicy("random")
+	c.Check(err, NotNil)
+}
+
+func (s *EvictS) TestMaxShardRecords(c *C) {
+	counting := (&Config{}).counting()
+	c.Check((&Config{}).maxShardRecords(counting, 4), Equals, 0)
+	c.Check((&Config{MaxRecords: 100}).maxShardRecords(counting, 4), Equals, 25)
+	c.Check((&Config{MaxRecords: 10}).maxShardRecords(counting, 4), Equals, 2)
+
+	// the smaller of the two caps wins
+	bytes := 40 * recordSize(counting)
+	c.Check((&Config{MaxBytes: bytes}).maxShardRecords(counting, 4), Equals, 10)
+	c.Check((&Config{MaxRecords: 100, MaxBytes: bytes}).maxShardRecords(counting, 4), Equals, 10)
+}
+
+func (s *EvictS) TestCapBelowShards(c *C) {
+	_, err := New(Config{DataDir: c.MkDir(), Shards: 4, MaxRecords: 3})
+	c.Check(err, ErrorMatches, "MaxRecords of 3 is less than one record for each of the 4 shards")
+	counting := (&Config{}).counting()
+	_, err = New(Config{DataDir: c.MkDir(), Shards: 4, MaxBytes: 3 * recordSize(counting)})
+	c.Check(err, ErrorMatches, "MaxBytes of .* is less than one record for each of the 4 shards")
+}
+
+func (s *EvictS) TestMaxRecords(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 4, MaxRecords: 40})
+	for i := 0; i < 1000; i++ {
+		store.LogIP(IPLong(i).IPAddr(), ImpactAmount(1), BWNop)
+	}
+	c.Check(store.Len() <= 40, Equals, true)
+	c.Check(store.Stats().CapEvictions, Equals, uint64(1000-store.Len()))
+}
+
+func (s *EvictS) TestEvictLRU(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 1, MaxRecords: 3})
+	shard := store.shards[0]
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		key := IPLong(i).IPAddr().HostPrefix()
+		data := newIPData(store.counting)
+		data.impactAtTime(store.counting, ImpactAmount(1), BWNop, now.Add(time.Duration(i)*time.Second))
+		shard.m[key] = data
+	}
+	// touch the oldest again so the second becomes least recently used
+	getRecord(store, IPLong(1).IPAddr().HostPrefix()).touch(now.Add(time.Minute))
+
+	store.LogIP(IPLong(4).IPAddr(), ImpactAmount(1), BWNop)
+	c.Check(store.Len(), Equals, 3)
+	c.Check(getRecord(store, IPLong(2).IPAddr().HostPrefix()), IsNil)
+}
+
+func (s *EvictS) TestEvictLFU(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 1, MaxRecords: 3, Eviction: EvictLFU})
+	for i := 1; i <= 3; i++ {
+		for j := 0; j < 4-i; j++ {
+			store.LogIP(IPLong(i).IPAddr(), ImpactAmount(1), BWNop)
+		}
+	}
+
+	// 3 was logged least often
+	store.LogIP(IPLong(4).IPAddr(), ImpactAmount(1), BWNop)
+	c.Check(store.Len(), Equals, 3)
+	c.Check(getRecord(store, IPLong(3).IPAddr().HostPrefix()), IsNil)
+}
+
+func (s *EvictS) TestListedNotEvicted(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 1, MaxRecords: 2})
+	store.LogIP(IPLong(1).IPAddr(), ImpactAmount(1), BWBlacklist)
+	store.LogIP(IPLong(2).IPAddr(), ImpactAmount(1), BWWhitelist)
+	store.LogIP(IPLong(3).IPAddr(), ImpactAmount(1), BWNop)
+	store.LogIP(IPLong(4).IPAddr(), ImpactAmount(1), BWNop)
+
+	// only unlisted records make room
+	c.Check(getRecord(store, IPLong(1).IPAddr().HostPrefix()), NotNil)
+	c.Check(getRecord(store, IPLong(2).IPAddr().HostPrefix()), NotNil)
+	c.Check(getRecord(store, IPLong(3).IPAddr().HostPrefix()), IsNil)
+	c.Check(getRecord(store, IPLong(4).IPAddr().HostPrefix()), NotNil)
+}
+
+func (s *EvictS) TestCapAfterPersist(c *C) {
+	dir := c.MkDir()
+	store := newStore(c, Config{DataDir: dir, Shards: 1, MaxRecords: 2})
+
+	// records inserted during a persist go to the wal, which is not capped
+	store.setWALStatus(walWriting)
+	for i := 0; i < 5; i++ {
+		store.LogIP(IPLong(i).IPAddr(), ImpactAmount(1), BWNop)
+	}
+	store.setWALStatus(walInactive)
+	store.drainWAL()
+	c.Check(store.Len(), Equals, 5)
+
+	c.Assert(store.Persist(), IsNil)
+	c.Check(store.Len(), Equals, 2)
+
+	// a kdb bigger than the cap is trimmed on load
+	store = newStore(c, Config{DataDir: dir, Shards: 1})
+	for i := 0; i < 5; i++ {
+		store.LogIP(IPLong(i).IPAddr(), ImpactAmount(1), BWNop)
+	}
+	c.Assert(store.Persist(), IsNil)
+	store = newStore(c, Config{DataDir: dir, Shards: 1, MaxRecords: 3})
+	c.Check(store.Len(), Equals, 3)
+}
@@ -0,0 +1,254 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// kdbFormat describes how the decoder reads one kdb encoding version.
+// See encodingVersion for the layout of each version
+type kdbFormat struct {
+	// readHeader reads the rest of the header after the version
+	readHeader func(dec *IPDataStoreDecoder) error
+	// decode reads every record after the header, each recordSize bytes long
+	decode   func(dec *IPDataStoreDecoder, recordSize int, fn func(Prefix, *IPData)) error
+	keySize  int
+	getKey   func(buf []byte) Prefix
+	hasScore bool // whether each IPData ends with a score and score time
+}
+
+// kdbFormats holds the format of every kdb version which can be decoded, by version.
+// A new encodingVersion must be added here, and older versions kept so their kdbs
+// can still be loaded and rewritten in the current version
+var kdbFormats = map[uint32]*kdbFormat{
+	1: {readHeader: readNoHeader, decode: (*IPDataStoreDecoder).decodeRecords, keySize: 4, getKey: getIPLongKey},
+	2: {readHeader: readNoHeader, decode: (*IPDataStoreDecoder).decodeRecords, keySize: 16, getKey: getHostKey},
+	3: {readHeader: (*IPDataStoreDecoder).readWindows, decode: (*IPDataStoreDecoder).decodeRecords, keySize: 16, getKey: getHostKey},
+	4: {readHeader: (*IPDataStoreDecoder).readCounterHeader, decode: (*IPDataStoreDecoder).decodeRecords, keySize: 16, getKey: getHostKey},
+	5: {readHeader: (*IPDataStoreDecoder).readScoreHeader, decode: (*IPDataStoreDecoder).decodeRecords, keySize: 16, getKey: getHostKey, hasScore: true},
+	6: {readHeader: (*IPDataStoreDecoder).readScoreHeader, decode: (*IPDataStoreDecoder).decodeRecords, keySize: keySize, getKey: getPrefixKey, hasScore: true},
+	7: {readHeader: (*IPDataStoreDecoder).readCheckedHeader, decode: (*IPDataStoreDecoder).decodeBlocks, keySize: keySize, getKey: getPrefixKey, hasScore: true},
+	8: {readHeader: (*IPDataStoreDecoder).readCheckedHeader, decode: (*IPDataStoreDecoder).decodeBlocks, keySize: keySize, getKey: getPrefixKey, hasScore: true},
+	9: {readHeader: (*IPDataStoreDecoder).readCheckedHeader, decode: (*IPDataStoreDecoder).decodeBlocks, keySize: keySize, getKey: getPrefixKey, hasScore: true},
+}
+
+// readNoHeader is the header reader of versions without a header
+func readNoHeader(dec *IPDataStoreDecoder) error {
+	return nil
+}
+
+// readWindows reads a header's 1 byte window count and 4 byte little endian window seconds
+func (dec *IPDataStoreDecoder) readWindows() error {
+	var buf [4]byte
+	err := dec.readFull(buf[0:1], "header")
+	if err != nil {
+		return err
+	}
+	dec.counting.windows = make(Windows, int(buf[0]))
+	for i := range dec.counting.windows {
+		err = dec.readFull(buf[0:4], "header")
+		if err != nil {
+			return err
+		}
+		dec.counting.windows[i] = time.Duration(binary.LittleEndian.Uint32(buf[0:4])) * time.Second
+	}
+	return nil
+}
+
+// readCounterHeader reads a version 4 header of the counter type,
+// buckets per window and windows
+func (dec *IPDataStoreDecoder) readCounterHeader() error {
+	var buf [2]byte
+	err := dec.readFull(buf[0:2], "header")
+	if err != nil {
+		return err
+	}
+	dec.counting.counter = CounterType(buf[0])
+	dec.counting.buckets = int(buf[1])
+	return dec.readWindows()
+}
+
+// readScoreHeader reads a version 5 or 6 header of the counter type,
+// buckets per window, half-life and windows
+func (dec *IPDataStoreDecoder) readScoreHeader() error {
+	var buf [4]byte
+	err := dec.readFull(buf[0:2], "header")
+	if err != nil {
+		return err
+	}
+	dec.counting.counter = CounterType(buf[0])
+	dec.counting.buckets = int(buf[1])
+
+	err = dec.readFull(buf[0:4], "header")
+	if err != nil {
+		return err
+	}
+	dec.counting.halfLife = time.Duration(binary.LittleEndian.Uint32(buf[0:4])) * time.Second
+	return dec.readWindows()
+}
+
+// readCheckedHeader reads a version 7 to 9 header, which is a version 6 header
+// followed by the creation time, record count, op log segment, compression and CRC
+func (dec *IPDataStoreDecoder) readCheckedHeader() error {
+	err := dec.readScoreHeader()
+	if err != nil {
+		return err
+	}
+	return dec.readHeaderEnd()
+}
+
+// readHeaderEnd reads a version 7 to 9 header's creation time, record count,
+// op log segment and compression, and checks the header's CRC. The rest of
+// the kdb is then read through the decompressor
+func (dec *IPDataStoreDecoder) readHeaderEnd() error {
+	var buf [16]byte
+	err := dec.readFull(buf[0:16], "header")
+	if err != nil {
+		return err
+	}
+	dec.created = time.Unix(int64(binary.LittleEndian.Uint64(buf[0:8])), 0)
+	dec.recordCount = binary.LittleEndian.Uint64(buf[8:16])
+	if dec.version >= 8 {
+		err = dec.readFull(buf[0:8], "header")
+		if err != nil {
+			return err
+		}
+		dec.logSegment = binary.LittleEndian.Uint64(buf[0:8])
+	}
+	if dec.version >= 9 {
+		err = dec.readFull(buf[0:1], "header")
+		if err != nil {
+			return err
+		}
+		dec.compression = Compression(buf[0])
+	}
+
+	sum := dec.r.crc.Sum32()
+	dec.r.crc = nil
+	err = dec.readFull(buf[0:4], "header")
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(buf[0:4]) != sum {
+		return dec.corrupted(0, "header checksum mismatch")
+	}
+
+	// offsets after the header are of the decompressed data
+	offset := dec.r.offset
+	r, err := dec.compression.decompressReader(dec.r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || isCompressionError(err) {
+		return dec.corrupted(offset, "invalid compressed data")
+	} else if err != nil {
+		return err
+	}
+	dec.r = &kdbReader{r: r, offset: offset}
+	return nil
+}
+
+// decodeRecords decodes the records of a kdb before version 7, which
+// follow the header until the end of the file
+func (dec *IPDataStoreDecoder) decodeRecords(recordSize int, fn func(Prefix, *IPData)) error {
+	buf := make([]byte, recordSize)
+	for {
+		offset := dec.r.offset
+		_, err := io.ReadFull(dec.r, buf[0:])
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			return dec.corrupted(offset, "truncated record")
+		} else if err != nil {
+			return err
+		}
+
+		fn(dec.format.getKey(buf), getIPData(buf[dec.format.keySize:], dec.counting))
+	}
+}
+
+// decodeBlocks decodes the blocks and footer of a version 7 kdb
+func (dec *IPDataStoreDecoder) decodeBlocks(recordSize int, fn func(Prefix, *IPData)) error {
+	var buf [12]byte
+	var decoded uint64
+	block := make([]byte, blockRecords*recordSize)
+
+	for dec.block = 0; ; dec.block++ {
+		blockStart := dec.r.offset
+		dec.r.crc = crc32.NewIEEE()
+		err := dec.readFull(buf[0:4], "block")
+		if err != nil {
+			return err
+		}
+		records := int(binary.LittleEndian.Uint32(buf[0:4]))
+		if records == 0 {
+			dec.r.crc = nil
+			break
+		}
+		if records > blockRecords {
+			return dec.corrupted(blockStart, fmt.Sprintf("invalid block record count %d", records))
+		}
+
+		err = dec.readFull(block[0:records*recordSize], "block")
+		if err != nil {
+			return err
+		}
+		sum := dec.r.crc.Sum32()
+		dec.r.crc = nil
+		err = dec.readFull(buf[0:4], "block")
+		if err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(buf[0:4]) != sum {
+			return dec.corrupted(blockStart, "block checksum mismatch")
+		}
+
+		for i := 0; i < records; i++ {
+			record := block[i*recordSize : (i+1)*recordSize]
+			fn(dec.format.getKey(record), getIPData(record[dec.format.keySize:], dec.counting))
+		}
+		decoded += uint64(records)
+	}
+	dec.block = -1
+
+	footerStart := dec.r.offset
+	err := dec.readFull(buf[0:12], "footer")
+	if err != nil {
+		return err
+	}
+	if string(buf[8:12]) != footerMagic {
+		return dec.corrupted(footerStart, "invalid footer")
+	}
+	footerCount := binary.LittleEndian.Uint64(buf[0:8])
+	if footerCount != decoded || dec.recordCount != decoded {
+		return dec.corrupted(footerStart, fmt.Sprintf("record count mismatch: header %d, footer %d, decoded %d", dec.recordCount, footerCount, decoded))
+	}
+
+	// reading to the end also checks the decompressor's own checksum
+	_, err = io.ReadFull(dec.r, buf[0:1])
+	if err == nil {
+		return dec.corrupted(dec.r.offset-1, "data after footer")
+	} else if err != io.EOF {
+		return dec.readError(err, dec.r.offset, "footer")
+	}
+	return nil
+}
+
+// getIPLongKey unpacks a 4 byte little endian ipv4 host key
+func getIPLongKey(buf []byte) Prefix {
+	return IPLong(binary.LittleEndian.Uint32(buf[0:4])).IPAddr().HostPrefix()
+}
+
+// getHostKey unpacks a 16 byte network order host key
+func getHostKey(buf []byte) Prefix {
+	var ip IPAddr
+	copy(ip[0:], buf[0:16])
+	return ip.HostPrefix()
+}
+
+// getPrefixKey unpacks a 16 byte network order address and its 1 byte prefix length
+func getPrefixKey(buf []byte) Prefix {
+	var ip IPAddr
+	copy(ip[0:], buf[0:16])
+	return ip.Prefix(int(buf[16]))
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// IPAddr is an ipv4 or ipv6 address in 16 byte network order form.
+// IPv4 addresses are stored as IPv4-mapped IPv6 addresses (::ffff:a.b.c.d),
+// so both families can share a single map key type
+type IPAddr [16]byte
+
+var v4InV6Prefix = [12]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+// IPAddr converts the ipv4 IPLong to its IPv4-mapped IPAddr
+func (ip IPLong) IPAddr() IPAddr {
+	var addr IPAddr
+	copy(addr[0:12], v4InV6Prefix[0:])
+	addr[12] = byte(ip >> 24)
+	addr[13] = byte(ip >> 16)
+	addr[14] = byte(ip >> 8)
+	addr[15] = byte(ip)
+	return addr
+}
+
+// IPAddrFromIP converts a net.IP of either family to an IPAddr
+func IPAddrFromIP(ip net.IP) (IPAddr, error) {
+	var addr IPAddr
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return addr, errors.New("Invalid IP address")
+	}
+	copy(addr[0:], ip16)
+	return addr, nil
+}
+
+// ParseIPAddr parses an ipv4 or ipv6 address in its string form
+func ParseIPAddr(s string) (IPAddr, error) {
+	return IPAddrFromIP(net.ParseIP(s))
+}
+
+// Is4 returns true if the IPAddr is an IPv4-mapped address
+func (addr IPAddr) Is4() bool {
+	for i, b := range v4InV6Prefix {
+		if addr[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// IPLong returns the ipv4 address as an IPLong. The bool result
+// is false if the IPAddr is not an ipv4 address
+func (addr IPAddr) IPLong() (IPLong, bool) {
+	if !addr.Is4() {
+		return 0, false
+	}
+	ip := IPLong(addr[12])<<24 | IPLong(addr[13])<<16 | IPLong(addr[14])<<8 | IPLong(addr[15])
+	return ip, true
+}
+
+func (addr IPAddr) String() string {
+	return net.IP(addr[0:]).String()
+}
+
+// Prefix is an IPAddr masked to its first Bits bits. Bits is relative to the
+// address family, so ipv4 prefixes are at most 32 bits and ipv6 at most 128.
+// Host records are keyed by a full length Prefix
+type Prefix struct {
+	Addr IPAddr
+	Bits uint8
+}
+
+// Prefix returns the enclosing prefix of the address with the given number of bits,
+// relative to the address family. bits is clamped to the family's address length
+func (addr IPAddr) Prefix(bits int) Prefix {
+	offset := 0
+	if addr.Is4() {
+		offset = 96
+	}
+	if bits < 0 {
+		bits = 0
+	}
+	if bits > 128-offset {
+		bits = 128 - offset
+	}
+
+	masked := addr
+	for i := offset + bits; i < 128; i++ {
+		masked[i/8] &^= 0x80 >> uint(i%8)
+	}
+	return Prefix{Addr: masked, Bits: uint8(bits)}
+}
+
+// HostPrefix returns the full length Prefix that keys the address's own record
+func (addr IPAddr) HostPrefix() Prefix {
+	return addr.Prefix(128)
+}
+
+// IsHost returns true if the Prefix covers a single address
+func (p Prefix) IsHost() bool {
+	if p.Addr.Is4() {
+		return p.Bits == 32
+	}
+	return p.Bits == 128
+}
+
+func (p Prefix) String() string {
+	if p.IsHost() {
+		return p.Addr.String()
+	}
+	return fmt.Sprintf("%s/%d", p.Addr, p.Bits)
+}
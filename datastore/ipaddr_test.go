@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type IPAddrS struct{}
+
+var _ = Suite(&IPAddrS{})
+
+func (s *IPAddrS) TestIPLongRoundTrip(c *C) {
+	ip := IPLong(0xC0A80101)
+	addr := ip.IPAddr()
+	c.Check(addr.Is4(), Equals, true)
+	c.Check(addr.String(), Equals, "192.168.1.1")
+
+	back, ok := addr.IPLong()
+	c.Check(ok, Equals, true)
+	c.Check(back, Equals, ip)
+}
+
+func (s *IPAddrS) TestParseIPAddr(c *C) {
+	addr, err := ParseIPAddr("2001:db8::1")
+	c.Assert(err, IsNil)
+	c.Check(addr.Is4(), Equals, false)
+	c.Check(addr.String(), Equals, "2001:db8::1")
+
+	_, ok := addr.IPLong()
+	c.Check(ok, Equals, false)
+
+	v4, err := ParseIPAddr("10.0.0.1")
+	c.Assert(err, IsNil)
+	c.Check(v4, Equals, IPLong(0x0A000001).IPAddr())
+
+	_, err = ParseIPAddr("not an ip")
+	c.Check(err, NotNil)
+}
+
+func (s *IPAddrS) TestPrefix(c *C) {
+	ip, err := ParseIPAddr("10.1.2.3")
+	c.Assert(err, IsNil)
+
+	p := ip.Prefix(24)
+	c.Check(p.String(), Equals, "10.1.2.0/24")
+	c.Check(p.IsHost(), Equals, false)
+	c.Check(ip.Prefix(16).String(), Equals, "10.1.0.0/16")
+	c.Check(ip.Prefix(20).String(), Equals, "10.1.0.0/20")
+	c.Check(ip.HostPrefix().String(), Equals, "10.1.2.3")
+	c.Check(ip.HostPrefix().IsHost(), Equals, true)
+
+	other, err := ParseIPAddr("10.1.2.200")
+	c.Assert(err, IsNil)
+	c.Check(other.Prefix(24), Equals, p)
+
+	ip6, err := ParseIPAddr("2001:db8:1:2:3:4:5:6")
+	c.Assert(err, IsNil)
+	c.Check(ip6.Prefix(64).String(), Equals, "2001:db8:1:2::/64")
+	c.Check(ip6.HostPrefix().Bits, Equals, uint8(128))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -19,18 +20,21 @@ type ImpactAmount uint32
 // ForgivenNum is an integer number of times an IP addr has been forgiven
 type ForgivenNum uint16
 
-// ImpactAmounts is a struct of 3 time windows' impacts
-type ImpactAmounts struct {
-	FiveMin, Hour, Day ImpactAmount
-}
+// ImpactAmounts holds one impact per time window, in the order of the store's Windows
+type ImpactAmounts []ImpactAmount
 
-// StartTimes is a struct of 3 time window start times
-type StartTimes struct {
-	FiveMin, Hour, Day uint32
-}
+// StartTimes holds one unix start time per time window, in the order of the store's Windows
+type StartTimes []uint32
 
 // IPData holds impact amounts, time window starts, forgiveness,
-// and white/black list info for an IP address
+// and white/black list info for an IP address.
+//
+// With CounterSliding, Buckets holds each window's ring of bucket impacts
+// one window after another, and StartTimes holds the start of each window's
+// most recently impacted bucket.
+//
+// Score is the sum of every impact, decayed exponentially by the store's
+// half-life, as of the unix time ScoreTime
 type IPData struct {
 	Mutex      sync.RWMutex
 	CurImpacts ImpactAmounts
@@ -38,30 +42,36 @@ type IPData struct {
 	StartTimes StartTimes
 	Forgiven   ForgivenNum
 	BlackWhite byte
+	Buckets    ImpactAmounts
+	Score      float64
+	ScoreTime  uint32
+
+	// in memory only, for choosing which record to evict when the store is full
+	touched int64  // unix nanoseconds of the last log or forgive
+	hits    uint32 // number of logs and forgives
 }
 
-// IPDataMap is a map from IPLong to *IPData
-type IPDataMap map[IPLong]*IPData
+// IPDataMap is a map from a host or prefix to its *IPData
+type IPDataMap map[Prefix]*IPData
 
 type Stringser interface {
 	Strings() []string
 }
 
 func (a ImpactAmounts) Strings() []string {
-	return []string{
-		fmt.Sprintf("%d", a.FiveMin),
-		fmt.Sprintf("%d", a.Hour),
-		fmt.Sprintf("%d", a.Day),
+	result := make([]string, len(a))
+	for i, amount := range a {
+		result[i] = fmt.Sprintf("%d", amount)
 	}
+	return result
 }
 
 func (s StartTimes) Strings() []string {
-
-	return []string{
-		fmt.Sprintf("%d", s.FiveMin),
-		fmt.Sprintf("%d", s.Hour),
-		fmt.Sprintf("%d", s.Day),
+	result := make([]string, len(s))
+	for i, t := range s {
+		result[i] = fmt.Sprintf("%d", t)
 	}
+	return result
 }
 
 func (f ForgivenNum) Strings() []string {
@@ -81,6 +91,8 @@ func (data *IPData) Strings() []string {
 		result = append(result, stringser.Strings()...)
 	}
 	result = append(result, fmt.Sprintf("%d", data.BlackWhite))
+	result = append(result, strconv.FormatFloat(data.Score, 'f', -1, 64))
+	result = append(result, fmt.Sprintf("%d", data.ScoreTime))
 	return result
 }
 
@@ -88,20 +100,105 @@ func (ip IPLong) String() string {
 	return fmt.Sprintf("%d.%d.%d.%d", byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip))
 }
 
-func IPDataHeaders() []string {
-	return []string{
-		"CurFiveMin",
-		"CurHour",
-		"CurDay",
-		"MaxFiveMin",
-		"MaxHour",
-		"MaxDay",
-		"TimeFiveMin",
-		"TimeHour",
-		"TimeDay",
-		"Forgiven",
-		"BlackWhite",
+// IPDataHeaders returns the column names matching IPData.Strings for the given windows
+func IPDataHeaders(windows Windows) []string {
+	names := windows.Names()
+	result := []string{}
+	for _, prefix := range []string{"Cur", "Max", "Time"} {
+		for _, name := range names {
+			result = append(result, prefix+name)
+		}
+	}
+	return append(result, "Forgiven", "BlackWhite", "Score", "ScoreTime")
+}
+
+// newIPData creates an IPData with room for the counting's windows and buckets
+func newIPData(c *counting) *IPData {
+	data := new(IPData)
+	data.grow(c)
+	return data
+}
+
+// grow extends the IPData's per window slices to hold at least the counting's windows and buckets
+func (data *IPData) grow(c *counting) {
+	for len(data.CurImpacts) < len(c.windows) {
+		data.CurImpacts = append(data.CurImpacts, 0)
+	}
+	for len(data.MaxImpacts) < len(c.windows) {
+		data.MaxImpacts = append(data.MaxImpacts, 0)
+	}
+	for len(data.StartTimes) < len(c.windows) {
+		data.StartTimes = append(data.StartTimes, 0)
+	}
+	for len(data.Buckets) < c.numBuckets() {
+		data.Buckets = append(data.Buckets, 0)
+	}
+}
+
+// clone returns a deep copy of the IPData's fields, without its Mutex
+//
+// Takes a read lock on the IPData
+func (data *IPData) clone() *IPData {
+	data.Mutex.RLock()
+	defer data.Mutex.RUnlock()
+
+	return &IPData{
+		CurImpacts: append(ImpactAmounts(nil), data.CurImpacts...),
+		MaxImpacts: append(ImpactAmounts(nil), data.MaxImpacts...),
+		StartTimes: append(StartTimes(nil), data.StartTimes...),
+		Forgiven:   data.Forgiven,
+		BlackWhite: data.BlackWhite,
+		Buckets:    append(ImpactAmounts(nil), data.Buckets...),
+		Score:      data.Score,
+		ScoreTime:  data.ScoreTime,
+		touched:    data.touched,
+		hits:       data.hits,
+	}
+}
+
+// remap returns a copy of the IPData laid out for the counting in to,
+// given that it is currently laid out for the counting in from.
+// Windows that are not in from start out empty. When the buckets of a
+// window can't be carried over, its current impact is placed in the
+// bucket of its start time
+func (data *IPData) remap(from, to *counting) *IPData {
+	result := newIPData(to)
+	for i, d := range to.windows {
+		j := from.windows.index(d)
+		if j < 0 || j >= len(data.CurImpacts) {
+			continue
+		}
+		result.CurImpacts[i] = data.CurImpacts[j]
+		result.MaxImpacts[i] = data.MaxImpacts[j]
+		result.StartTimes[i] = data.StartTimes[j]
+
+		if to.counter != CounterSliding {
+			continue
+		}
+		if from.counter == CounterSliding && from.buckets == to.buckets {
+			copy(result.windowBuckets(to, i), data.windowBuckets(from, j))
+			continue
+		}
+		width := bucketWidth(d, to.buckets)
+		head := int64(result.StartTimes[i]) / width
+		result.StartTimes[i] = uint32(head * width)
+		result.windowBuckets(to, i)[head%int64(to.buckets)] = result.CurImpacts[i]
 	}
+	result.Forgiven = data.Forgiven
+	result.BlackWhite = data.BlackWhite
+	result.Score = data.Score
+	result.ScoreTime = data.ScoreTime
+	return result
+}
+
+// windowBuckets returns the ring of buckets for the i'th window
+func (data *IPData) windowBuckets(c *counting, i int) ImpactAmounts {
+	return data.Buckets[i*c.buckets : (i+1)*c.buckets]
+}
+
+// bucketWidth returns the width in seconds of each of a sliding window's buckets
+func bucketWidth(window time.Duration, buckets int) int64 {
+	return int64(window/time.Second) / int64(buckets)
 }
 
 func (data *IPData) blackWhite(blackWhite BWModifier) error {
@@ -128,16 +225,18 @@ func (data *IPData) blackWhite(blackWhite BWModifier) error {
 // impact updates the IPData arg in place by adding the impact to the time windows.
 //
 // Takes a write lock on the IPData
-func (data *IPData) impact(impact ImpactAmount, blackWhite BWModifier) {
-	data.impactAtTime(impact, blackWhite, time.Now())
+func (data *IPData) impact(c *counting, impact ImpactAmount, blackWhite BWModifier) {
+	data.impactAtTime(c, impact, blackWhite, time.Now())
 }
 
 // impactAtTime performs the real work of impact, and takes the current time as
 // a parameter to aid in testing.
-func (data *IPData) impactAtTime(impact ImpactAmount, blackWhite BWModifier, now time.Time) {
+func (data *IPData) impactAtTime(c *counting, impact ImpactAmount, blackWhite BWModifier, now time.Time) {
 	data.Mutex.Lock()
 	defer data.Mutex.Unlock()
 
+	data.touch(now)
+
 	if blackWhite != BWNop {
 		err := data.blackWhite(blackWhite)
 		if err != nil {
@@ -145,52 +244,193 @@ func (data *IPData) impactAtTime(impact ImpactAmount, blackWhite BWModifier, now
 		}
 	}
 
+	data.decay(c.halfLife, now)
 	if impact == 0 {
 		return
 	}
+	data.Score += float64(impact)
+
+	data.grow(c)
+	for i, window := range c.windows {
+		if c.counter == CounterSliding {
+			data.slide(c, i, now)
+			buckets := data.windowBuckets(c, i)
+			head := int64(data.StartTimes[i]) / bucketWidth(window, c.buckets)
+			buckets[head%int64(c.buckets)] = buckets[head%int64(c.buckets)].add(impact)
+			data.CurImpacts[i] = sum(buckets)
+		} else if now.After(time.Unix(int64(data.StartTimes[i]), 0).Add(window)) {
+			data.StartTimes[i] = uint32(now.Unix())
+			data.CurImpacts[i] = impact
+		} else {
+			data.CurImpacts[i] = data.CurImpacts[i].add(impact)
+		}
+		data.MaxImpacts[i] = max(data.CurImpacts[i], data.MaxImpacts[i])
+	}
+}
 
-	// five minute window
-	if now.After(time.Unix(int64(data.StartTimes.FiveMin), 0).Add(5 * time.Minute)) {
-		data.StartTimes.FiveMin = uint32(now.Unix())
-		data.CurImpacts.FiveMin = impact
-	} else {
-		data.CurImpacts.FiveMin = data.CurImpacts.FiveMin.add(impact)
+// slide advances the i'th window's ring of buckets to the bucket containing now,
+// zeroing every bucket which has fallen out of the window
+func (data *IPData) slide(c *counting, i int, now time.Time) {
+	buckets := data.windowBuckets(c, i)
+	numBuckets := int64(c.buckets)
+	width := bucketWidth(c.windows[i], c.buckets)
+	head := int64(data.StartTimes[i]) / width
+	cur := now.Unix() / width
+
+	if cur <= head {
+		// still in the head bucket, or the clock went backwards
+		return
 	}
-	data.MaxImpacts.FiveMin = max(data.CurImpacts.FiveMin, data.MaxImpacts.FiveMin)
 
-	// 1 hour window
-	if now.After(time.Unix(int64(data.StartTimes.Hour), 0).Add(time.Hour)) {
-		data.StartTimes.Hour = uint32(now.Unix())
-		data.CurImpacts.Hour = impact
+	if cur-head >= numBuckets {
+		for j := range buckets {
+			buckets[j] = 0
+		}
 	} else {
-		data.CurImpacts.Hour = data.CurImpacts.Hour.add(impact)
+		for j := head + 1; j <= cur; j++ {
+			buckets[j%numBuckets] = 0
+		}
 	}
-	data.MaxImpacts.Hour = max(data.CurImpacts.Hour, data.MaxImpacts.Hour)
+	data.StartTimes[i] = uint32(cur * width)
+}
 
-	// 1 day window
-	if now.After(time.Unix(int64(data.StartTimes.Day), 0).Add(24 * time.Hour)) {
-		data.StartTimes.Day = uint32(now.Unix())
-		data.CurImpacts.Day = impact
-	} else {
-		data.CurImpacts.Day = data.CurImpacts.Day.add(impact)
+// currentImpact returns the i'th window's current impact as of now, leaving out
+// impacts which have fallen out of the window since the IPData was last impacted.
+// Unlike slide, it does not modify the IPData
+func (data *IPData) currentImpact(c *counting, i int, now time.Time) ImpactAmount {
+	if i >= len(data.CurImpacts) {
+		return 0
+	}
+
+	if c.counter != CounterSliding {
+		if now.After(time.Unix(int64(data.StartTimes[i]), 0).Add(c.windows[i])) {
+			return 0
+		}
+		return data.CurImpacts[i]
+	}
+
+	buckets := data.windowBuckets(c, i)
+	numBuckets := int64(c.buckets)
+	width := bucketWidth(c.windows[i], c.buckets)
+	head := int64(data.StartTimes[i]) / width
+	cur := now.Unix() / width
+	if cur <= head {
+		return data.CurImpacts[i]
 	}
-	data.MaxImpacts.Day = max(data.CurImpacts.Day, data.MaxImpacts.Day)
+	if cur-head >= numBuckets {
+		return 0
+	}
+
+	current := data.CurImpacts[i]
+	for j := head + 1; j <= cur; j++ {
+		current = current.sub(buckets[j%numBuckets])
+	}
+	return current
+}
+
+// forgive subtracts the given amounts from all the IPData's impact amounts.
+// With CounterFixed, each window's current impact is reset to its max impact.
+// With CounterSliding, the amount is also taken out of the window's buckets
+// which are still in the window, oldest first. Windows without a matching amount are left unreduced.
+// The score is reduced by the largest of the amounts
+//
+// Takes a write lock on the IPData
+func (data *IPData) forgive(c *counting, impacts ImpactAmounts) {
+	data.forgiveAtTime(c, impacts, time.Now())
 }
 
-// forgive subtracts the given amounts from all the IPData's impact amounts
-func (data *IPData) forgive(impacts ImpactAmounts) {
-	data.MaxImpacts.FiveMin = data.MaxImpacts.FiveMin.sub(impacts.FiveMin)
-	data.CurImpacts.FiveMin = data.MaxImpacts.FiveMin
+// forgiveAtTime performs the real work of forgive, and takes the current time as
+// a parameter to aid in testing.
+func (data *IPData) forgiveAtTime(c *counting, impacts ImpactAmounts, now time.Time) {
+	data.Mutex.Lock()
+	defer data.Mutex.Unlock()
 
-	data.MaxImpacts.Hour = data.MaxImpacts.Hour.sub(impacts.Hour)
-	data.CurImpacts.Hour = data.MaxImpacts.Hour
+	data.touch(now)
 
-	data.MaxImpacts.Day = data.MaxImpacts.Day.sub(impacts.Day)
-	data.CurImpacts.Day = data.MaxImpacts.Day
+	var largest ImpactAmount
+	for _, amount := range impacts {
+		largest = max(largest, amount)
+	}
+	data.decay(c.halfLife, now)
+	data.Score = math.Max(data.Score-float64(largest), 0)
+
+	data.grow(c)
+	for i := range c.windows {
+		var amount ImpactAmount
+		if i < len(impacts) {
+			amount = impacts[i]
+		}
+		data.MaxImpacts[i] = data.MaxImpacts[i].sub(amount)
+
+		if c.counter != CounterSliding {
+			data.CurImpacts[i] = data.MaxImpacts[i]
+			continue
+		}
+
+		data.slide(c, i, now)
+		buckets := data.windowBuckets(c, i)
+		head := int64(data.StartTimes[i]) / bucketWidth(c.windows[i], c.buckets)
+		for j := int64(1); j <= int64(c.buckets) && amount > 0; j++ {
+			k := (head + j) % int64(c.buckets) // oldest bucket first
+			taken := amount
+			if buckets[k] < taken {
+				taken = buckets[k]
+			}
+			buckets[k] -= taken
+			amount -= taken
+		}
+		data.CurImpacts[i] = sum(buckets)
+	}
 
 	data.Forgiven++
 }
 
+// touch records an access for eviction
+func (data *IPData) touch(now time.Time) {
+	data.touched = now.UnixNano()
+	if data.hits < math.MaxUint32 {
+		data.hits++
+	}
+}
+
+// lastTouched returns the unix nanoseconds of the record's last access.
+// Records loaded from a kdb which have not been touched since fall back to lastActive
+func (data *IPData) lastTouched() int64 {
+	if data.touched == 0 {
+		return data.lastActive() * int64(time.Second)
+	}
+	return data.touched
+}
+
+// lastActive returns the unix time the record was last logged or forgiven.
+// Records from kdbs without a score fall back to their latest window start
+func (data *IPData) lastActive() int64 {
+	last := int64(data.ScoreTime)
+	for _, start := range data.StartTimes {
+		if int64(start) > last {
+			last = int64(start)
+		}
+	}
+	return last
+}
+
+// decay brings the score forward from ScoreTime to now
+func (data *IPData) decay(halfLife time.Duration, now time.Time) {
+	data.Score = data.decayedScore(halfLife, now)
+	if now.Unix() > int64(data.ScoreTime) {
+		data.ScoreTime = uint32(now.Unix())
+	}
+}
+
+// decayedScore returns what the score has decayed to by the time now
+func (data *IPData) decayedScore(halfLife time.Duration, now time.Time) float64 {
+	elapsed := now.Unix() - int64(data.ScoreTime)
+	if elapsed <= 0 || data.Score == 0 {
+		return data.Score
+	}
+	return data.Score * math.Exp2(-float64(elapsed)/halfLife.Seconds())
+}
+
 // add adds 2 impact amounts and returns the result.
 // If the result would be larger than a uint32, it instead returns MaxUint32
 func (a ImpactAmount) add(b ImpactAmount) ImpactAmount {
@@ -210,6 +450,15 @@ func (a ImpactAmount) sub(b ImpactAmount) ImpactAmount {
 	return a - b
 }
 
+// sum adds up impact amounts, without overflowing
+func sum(amounts ImpactAmounts) ImpactAmount {
+	var total ImpactAmount
+	for _, amount := range amounts {
+		total = total.add(amount)
+	}
+	return total
+}
+
 // max returns the larger of 2 impact amounts
 func max(a, b ImpactAmount) ImpactAmount {
 	if a > b {
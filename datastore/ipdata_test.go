@@ -10,17 +10,19 @@ type IPDataS struct{}
 
 var _ = Suite(&IPDataS{})
 
+var fixedCounting = &counting{windows: DefaultWindows, counter: CounterFixed, halfLife: DefaultHalfLife}
+
 func (s *IPDataS) TestImpact(c *C) {
 	d := new(IPData)
-	c.Assert(*d, Equals, IPData{})
+	c.Assert(len(d.MaxImpacts), Equals, 0)
 
 	amount := ImpactAmount(42)
-	d.impact(amount, BWNop)
+	d.impact(fixedCounting, amount, BWNop)
 
 	// all time window max impacts should be set to the amount we impacted
-	c.Check(d.MaxImpacts.FiveMin, Equals, amount)
-	c.Check(d.MaxImpacts.Hour, Equals, amount)
-	c.Check(d.MaxImpacts.Day, Equals, amount)
+	c.Check(d.MaxImpacts[0], Equals, amount)
+	c.Check(d.MaxImpacts[1], Equals, amount)
+	c.Check(d.MaxImpacts[2], Equals, amount)
 	// forgiven should remain 0
 	c.Check(d.Forgiven, Equals, ForgivenNum(0))
 	// BlackWhite should remain 0
@@ -34,14 +36,14 @@ func (s *IPDataS) TestImpactBlackWhite(c *C) {
 
 	// whitelist is 0x01, blacklist is 0x02
 
-	d.impact(amount, BWWhitelist)
+	d.impact(fixedCounting, amount, BWWhitelist)
 	c.Check(d.BlackWhite, Equals, byte(1))
-	d.impact(amount, BWBlacklist)
+	d.impact(fixedCounting, amount, BWBlacklist)
 	c.Check(d.BlackWhite, Equals, byte(3))
 
-	d.impact(amount, BWUnWhitelist)
+	d.impact(fixedCounting, amount, BWUnWhitelist)
 	c.Check(d.BlackWhite, Equals, byte(2))
-	d.impact(amount, BWUnBlacklist)
+	d.impact(fixedCounting, amount, BWUnBlacklist)
 	c.Check(d.BlackWhite, Equals, byte(0))
 }
 
@@ -50,52 +52,230 @@ func (s *IPDataS) TestImpactAtTIme(c *C) {
 	amount := ImpactAmount(42)
 
 	when := time.Now()
-	d.impactAtTime(amount, BWNop, when)
+	d.impactAtTime(fixedCounting, amount, BWNop, when)
 
 	// simulate 5 minutes passing
 	when = when.Add(5 * time.Minute)
-	d.impactAtTime(amount, BWNop, when)
+	d.impactAtTime(fixedCounting, amount, BWNop, when)
 
-	c.Check(d.MaxImpacts.FiveMin, Equals, amount)
-	c.Check(d.MaxImpacts.Hour, Equals, 2*amount)
-	c.Check(d.MaxImpacts.Day, Equals, 2*amount)
+	c.Check(d.MaxImpacts[0], Equals, amount)
+	c.Check(d.MaxImpacts[1], Equals, 2*amount)
+	c.Check(d.MaxImpacts[2], Equals, 2*amount)
 
 	// simulate 1 hour passing
 	when = when.Add(time.Hour)
-	d.impactAtTime(amount, BWNop, when)
-	c.Check(d.MaxImpacts.FiveMin, Equals, amount)
-	c.Check(d.MaxImpacts.Hour, Equals, 2*amount)
-	c.Check(d.MaxImpacts.Day, Equals, 3*amount)
+	d.impactAtTime(fixedCounting, amount, BWNop, when)
+	c.Check(d.MaxImpacts[0], Equals, amount)
+	c.Check(d.MaxImpacts[1], Equals, 2*amount)
+	c.Check(d.MaxImpacts[2], Equals, 3*amount)
 }
 
 func (s *IPDataS) TestForgive(c *C) {
 	amount := ImpactAmount(100)
 
 	d := IPData{
-		MaxImpacts: ImpactAmounts{
-			FiveMin: amount,
-			Hour:    amount,
-			Day:     amount,
-		},
+		MaxImpacts: ImpactAmounts{amount, amount, amount},
 	}
 
 	forg := amount - ImpactAmount(1)
-	forgiveAmounts := ImpactAmounts{
-		FiveMin: forg,
-		Hour:    forg,
-		Day:     forg,
-	}
+	forgiveAmounts := ImpactAmounts{forg, forg, forg}
 
-	d.forgive(forgiveAmounts)
+	d.forgive(fixedCounting, forgiveAmounts)
 
 	// all time window max impacts should be reduced
-	c.Check(d.MaxImpacts.FiveMin, Equals, amount-forg)
-	c.Check(d.MaxImpacts.Hour, Equals, amount-forg)
-	c.Check(d.MaxImpacts.Day, Equals, amount-forg)
+	c.Check(d.MaxImpacts[0], Equals, amount-forg)
+	c.Check(d.MaxImpacts[1], Equals, amount-forg)
+	c.Check(d.MaxImpacts[2], Equals, amount-forg)
 	// forgiven should be incremented
 	c.Check(d.Forgiven, Equals, ForgivenNum(1))
 }
 
+func (s *IPDataS) TestImpactCustomWindows(c *C) {
+	custom := &counting{windows: Windows{time.Minute, 7 * 24 * time.Hour}, halfLife: DefaultHalfLife}
+	d := newIPData(custom)
+	amount := ImpactAmount(42)
+
+	when := time.Now()
+	d.impactAtTime(custom, amount, BWNop, when)
+
+	// simulate 1 day passing
+	when = when.Add(24 * time.Hour)
+	d.impactAtTime(custom, amount, BWNop, when)
+
+	c.Check(d.CurImpacts[0], Equals, amount)
+	c.Check(d.MaxImpacts[0], Equals, amount)
+	c.Check(d.CurImpacts[1], Equals, 2*amount)
+	c.Check(d.MaxImpacts[1], Equals, 2*amount)
+}
+
+func (s *IPDataS) TestRemap(c *C) {
+	from := &counting{windows: Windows{time.Minute, time.Hour}}
+	to := &counting{windows: Windows{time.Hour, 24 * time.Hour}}
+	d := newIPData(from)
+	d.MaxImpacts[0] = 1
+	d.MaxImpacts[1] = 2
+	d.StartTimes[1] = 3
+	d.BlackWhite = 1
+
+	r := d.remap(from, to)
+	c.Check(r.MaxImpacts, DeepEquals, ImpactAmounts{2, 0})
+	c.Check(r.StartTimes, DeepEquals, StartTimes{3, 0})
+	c.Check(r.BlackWhite, Equals, byte(1))
+}
+
+func (s *IPDataS) TestRemapToSliding(c *C) {
+	from := &counting{windows: Windows{5 * time.Minute}}
+	to := &counting{windows: Windows{5 * time.Minute}, counter: CounterSliding, buckets: 10}
+	d := newIPData(from)
+	d.CurImpacts[0] = 7
+	d.MaxImpacts[0] = 9
+	d.StartTimes[0] = 3*30 + 5
+
+	r := d.remap(from, to)
+	c.Check(r.CurImpacts[0], Equals, ImpactAmount(7))
+	c.Check(r.MaxImpacts[0], Equals, ImpactAmount(9))
+	c.Check(r.StartTimes[0], Equals, uint32(3*30))
+	c.Check(r.Buckets, DeepEquals, ImpactAmounts{0, 0, 0, 7, 0, 0, 0, 0, 0, 0})
+}
+
+func (s *IPDataS) TestImpactSliding(c *C) {
+	sliding := &counting{windows: Windows{5 * time.Minute}, counter: CounterSliding, buckets: 10, halfLife: DefaultHalfLife}
+	fixed := &counting{windows: Windows{5 * time.Minute}, counter: CounterFixed, halfLife: DefaultHalfLife}
+	ds := newIPData(sliding)
+	df := newIPData(fixed)
+	amount := ImpactAmount(42)
+
+	// start on a 30 second bucket boundary
+	start := time.Unix(1500000000-1500000000%30, 0)
+	impactBoth := func(offset time.Duration) {
+		ds.impactAtTime(sliding, amount, BWNop, start.Add(offset))
+		df.impactAtTime(fixed, amount, BWNop, start.Add(offset))
+	}
+
+	impactBoth(0)
+	impactBoth(290 * time.Second)
+	c.Check(ds.CurImpacts[0], Equals, 2*amount)
+	c.Check(df.CurImpacts[0], Equals, 2*amount)
+
+	// the fixed window resets, the sliding window only drops the first impact
+	impactBoth(310 * time.Second)
+	c.Check(ds.CurImpacts[0], Equals, 2*amount)
+	c.Check(df.CurImpacts[0], Equals, amount)
+
+	// long after, only the latest impact is in the window
+	impactBoth(1000 * time.Second)
+	c.Check(ds.CurImpacts[0], Equals, amount)
+	c.Check(ds.MaxImpacts[0], Equals, 2*amount)
+	c.Check(ds.StartTimes[0], Equals, uint32(start.Unix()+990))
+}
+
+func (s *IPDataS) TestForgiveSliding(c *C) {
+	sliding := &counting{windows: Windows{time.Minute}, counter: CounterSliding, buckets: 2, halfLife: DefaultHalfLife}
+	d := newIPData(sliding)
+
+	start := time.Unix(1500000000-1500000000%30, 0)
+	d.impactAtTime(sliding, ImpactAmount(10), BWNop, start)
+	d.impactAtTime(sliding, ImpactAmount(5), BWNop, start.Add(30*time.Second))
+	c.Check(d.CurImpacts[0], Equals, ImpactAmount(15))
+
+	// the older bucket is forgiven first
+	d.forgiveAtTime(sliding, ImpactAmounts{12}, start.Add(45*time.Second))
+	c.Check(d.Buckets, DeepEquals, ImpactAmounts{0, 3})
+	c.Check(d.CurImpacts[0], Equals, ImpactAmount(3))
+	c.Check(d.MaxImpacts[0], Equals, ImpactAmount(3))
+	c.Check(d.Forgiven, Equals, ForgivenNum(1))
+}
+
+func (s *IPDataS) TestForgiveSlidingExpired(c *C) {
+	sliding := &counting{windows: Windows{time.Minute}, counter: CounterSliding, buckets: 2, halfLife: DefaultHalfLife}
+	d := newIPData(sliding)
+
+	start := time.Unix(1500000000-1500000000%30, 0)
+	d.impactAtTime(sliding, ImpactAmount(10), BWNop, start)
+	d.impactAtTime(sliding, ImpactAmount(5), BWNop, start.Add(30*time.Second))
+
+	// the first bucket has left the window, so only the second is forgiven
+	d.forgiveAtTime(sliding, ImpactAmounts{4}, start.Add(60*time.Second))
+	c.Check(d.Buckets, DeepEquals, ImpactAmounts{0, 1})
+	c.Check(d.CurImpacts[0], Equals, ImpactAmount(1))
+	c.Check(d.StartTimes[0], Equals, uint32(start.Unix()+60))
+}
+
+func (s *IPDataS) TestIPDataHeaders(c *C) {
+	headers := IPDataHeaders(DefaultWindows)
+	c.Check(headers, DeepEquals, []string{
+		"Cur5m", "Cur1h", "Cur1d",
+		"Max5m", "Max1h", "Max1d",
+		"Time5m", "Time1h", "Time1d",
+		"Forgiven", "BlackWhite", "Score", "ScoreTime",
+	})
+}
+
+func (s *IPDataS) TestParseWindows(c *C) {
+	windows, err := ParseWindows("1m, 5m,1h,1d,7d")
+	c.Assert(err, IsNil)
+	c.Check(windows, DeepEquals, Windows{
+		time.Minute, 5 * time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour,
+	})
+	c.Check(windows.String(), Equals, "1m,5m,1h,1d,7d")
+
+	_, err = ParseWindows("500ms")
+	c.Check(err, NotNil)
+	_, err = ParseWindows("")
+	c.Check(err, NotNil)
+}
+
+func (s *IPDataS) TestScoreDecays(c *C) {
+	d := newIPData(fixedCounting)
+	when := time.Unix(1500000000, 0)
+
+	d.impactAtTime(fixedCounting, ImpactAmount(100), BWNop, when)
+	c.Check(d.Score, Equals, float64(100))
+	c.Check(d.ScoreTime, Equals, uint32(when.Unix()))
+
+	// after one half-life the score has halved, and new impacts add to it
+	when = when.Add(DefaultHalfLife)
+	c.Check(d.decayedScore(DefaultHalfLife, when), Equals, float64(50))
+	d.impactAtTime(fixedCounting, ImpactAmount(10), BWNop, when)
+	c.Check(d.Score, Equals, float64(60))
+
+	// an impact of 0 only decays the score
+	when = when.Add(2 * DefaultHalfLife)
+	d.impactAtTime(fixedCounting, ImpactAmount(0), BWNop, when)
+	c.Check(d.Score, Equals, float64(15))
+	c.Check(d.ScoreTime, Equals, uint32(when.Unix()))
+}
+
+func (s *IPDataS) TestForgiveScore(c *C) {
+	d := newIPData(fixedCounting)
+	when := time.Unix(1500000000, 0)
+	d.impactAtTime(fixedCounting, ImpactAmount(100), BWNop, when)
+
+	d.forgiveAtTime(fixedCounting, ImpactAmounts{10, 30, 20}, when)
+	c.Check(d.Score, Equals, float64(70))
+
+	d.forgiveAtTime(fixedCounting, ImpactAmounts{100, 100, 100}, when)
+	c.Check(d.Score, Equals, float64(0))
+}
+
+func (s *IPDataS) TestParseCounterType(c *C) {
+	t, err := ParseCounterType("sliding")
+	c.Assert(err, IsNil)
+	c.Check(t, Equals, CounterSliding)
+	c.Check(t.String(), Equals, "sliding")
+
+	_, err = ParseCounterType("bogus")
+	c.Check(err, NotNil)
+}
+
+func (s *IPDataS) TestValidateSliding(c *C) {
+	ok := &counting{windows: Windows{time.Minute}, counter: CounterSliding, buckets: 10, halfLife: time.Hour}
+	c.Check(ok.validate(), IsNil)
+
+	uneven := &counting{windows: Windows{time.Minute}, counter: CounterSliding, buckets: 7, halfLife: time.Hour}
+	c.Check(uneven.validate(), NotNil)
+}
+
 func (s *IPDataS) TestAdd(c *C) {
 	a := ImpactAmount(2)
 	b := ImpactAmount(2)
@@ -0,0 +1,406 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// opLogFile is the name of the op log. Each segment of it is a separate
+// file, named opLogFile followed by a dot and the segment number
+const opLogFile = "kawana.oplog"
+
+// SyncPolicy selects how often the op log is flushed to disk with fsync
+type SyncPolicy byte
+
+const (
+	// SyncEverySecond fsyncs the op log once a second, if it has been written
+	SyncEverySecond SyncPolicy = iota
+	// SyncAlways fsyncs the op log after every operation
+	SyncAlways
+	// SyncNever leaves flushing the op log to the operating system
+	SyncNever
+)
+
+// op log entry types
+const (
+	opLogIP     byte = 1
+	opForgiveIP byte = 2
+)
+
+// maxOpSize is the largest op log entry body: a forgive with an amount for every window
+const maxOpSize = 1 + 8 + 16 + 1 + 4*maxWindows
+
+// ParseSyncPolicy parses "always", "second" or "never"
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "second":
+		return SyncEverySecond, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return SyncEverySecond, fmt.Errorf("Unknown sync policy %q", s)
+	}
+}
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncEverySecond:
+		return "second"
+	case SyncNever:
+		return "never"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(p))
+	}
+}
+
+// opLog is an append-only log of every LogIP and ForgiveIP since the last Persist.
+// Each entry is a 4 byte little endian body length, the body, and a 4 byte
+// little endian CRC-32 of the body. A body is a 1 byte op type, the 8 byte little
+// endian unix nanosecond time of the op and the 16 byte network order IP, followed by:
+// for LogIP, the 4 byte little endian impact and 1 byte blackwhite modifier;
+// for ForgiveIP, a 1 byte count and a 4 byte little endian amount per window.
+//
+// Persist starts a new segment at the moment it snapshots the store,
+// and removes the older segments once the kdb has been written
+type opLog struct {
+	cut     sync.RWMutex // held for reading by each operation, and for writing by rotate
+	mu      sync.Mutex   // guards the fields below
+	dataDir string
+	policy  SyncPolicy
+	file    *os.File
+	segment uint64
+	dirty   bool // written since the last fsync
+	done    chan struct{}
+}
+
+func opLogPath(dataDir string, segment uint64) string {
+	return fmt.Sprintf("%s%c%s.%d", dataDir, filepath.Separator, opLogFile, segment)
+}
+
+// openOpLog starts appending to a new segment of the op log in dataDir
+func openOpLog(dataDir string, policy SyncPolicy, segment uint64) (*opLog, error) {
+	file, err := os.OpenFile(opLogPath(dataDir, segment), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &opLog{
+		dataDir: dataDir,
+		policy:  policy,
+		file:    file,
+		segment: segment,
+		done:    make(chan struct{}),
+	}
+	if policy == SyncEverySecond {
+		go l.syncEverySecond()
+	}
+	return l, nil
+}
+
+func (l *opLog) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.dirty {
+				err := l.file.Sync()
+				if err != nil {
+					log.Println(err)
+				}
+				l.dirty = false
+			}
+			l.mu.Unlock()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// appendLogIP appends a LogIP operation
+func (l *opLog) appendLogIP(ip IPAddr, impact ImpactAmount, blackWhite BWModifier, now time.Time) error {
+	return l.append(logIPBody(ip, impact, blackWhite, now))
+}
+
+// appendLogIPs appends a LogIP operation for each of the impacts, in a single write
+func (l *opLog) appendLogIPs(impacts []IPImpact, now time.Time) error {
+	bodies := make([][]byte, len(impacts))
+	for i, entry := range impacts {
+		bodies[i] = logIPBody(entry.IP, entry.Impact, BWNop, now)
+	}
+	return l.append(bodies...)
+}
+
+func logIPBody(ip IPAddr, impact ImpactAmount, blackWhite BWModifier, now time.Time) []byte {
+	body := make([]byte, 1+8+16+4+1)
+	putOpHeader(body[0:25], opLogIP, ip, now)
+	binary.LittleEndian.PutUint32(body[25:29], uint32(impact))
+	body[29] = byte(blackWhite)
+	return body
+}
+
+// appendForgiveIP appends a ForgiveIP operation
+func (l *opLog) appendForgiveIP(ip IPAddr, impacts ImpactAmounts, now time.Time) error {
+	if len(impacts) > maxWindows {
+		impacts = impacts[0:maxWindows]
+	}
+	body := make([]byte, 1+8+16+1+4*len(impacts))
+	putOpHeader(body[0:25], opForgiveIP, ip, now)
+	body[25] = byte(len(impacts))
+	for i, amount := range impacts {
+		binary.LittleEndian.PutUint32(body[26+4*i:30+4*i], uint32(amount))
+	}
+	return l.append(body)
+}
+
+func putOpHeader(buf []byte, op byte, ip IPAddr, now time.Time) {
+	buf[0] = op
+	binary.LittleEndian.PutUint64(buf[1:9], uint64(now.UnixNano()))
+	copy(buf[9:25], ip[0:])
+}
+
+// append writes an entry with each body in a single write,
+// and fsyncs them if the policy is SyncAlways
+func (l *opLog) append(bodies ...[]byte) error {
+	size := 0
+	for _, body := range bodies {
+		size += 4 + len(body) + 4
+	}
+	entries := make([]byte, size)
+	off := 0
+	for _, body := range bodies {
+		binary.LittleEndian.PutUint32(entries[off:off+4], uint32(len(body)))
+		copy(entries[off+4:], body)
+		off += 4 + len(body)
+		binary.LittleEndian.PutUint32(entries[off:off+4], crc32.ChecksumIEEE(body))
+		off += 4
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := l.file.Write(entries)
+	if err != nil {
+		return err
+	}
+	if l.policy == SyncAlways {
+		return l.file.Sync()
+	}
+	l.dirty = true
+	return nil
+}
+
+// rotate starts a new segment, and calls fn while no operation is in progress,
+// so that every operation before fn is in an older segment and every operation
+// after it is in the new one. It returns the new segment
+func (l *opLog) rotate(fn func()) (uint64, error) {
+	l.cut.Lock()
+	defer l.cut.Unlock()
+
+	file, err := os.OpenFile(opLogPath(l.dataDir, l.segment+1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	old := l.file
+	l.file = file
+	l.segment++
+	l.dirty = false
+	l.mu.Unlock()
+
+	fn()
+
+	// the old segment is only needed until the kdb is written, but may be
+	// needed after a crash before then
+	if l.policy != SyncNever {
+		err = old.Sync()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	old.Close()
+	return l.segment, nil
+}
+
+// close fsyncs and closes the current segment
+func (l *opLog) close() error {
+	close(l.done)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.file.Sync()
+	if err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// opLogSegments returns the numbers of the op log segments in dataDir, in order
+func opLogSegments(dataDir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, opLogFile+".") {
+			continue
+		}
+		segment, err := strconv.ParseUint(name[len(opLogFile)+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Sort(segmentSlice(segments))
+	return segments, nil
+}
+
+type segmentSlice []uint64
+
+func (s segmentSlice) Len() int           { return len(s) }
+func (s segmentSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s segmentSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// removeOpLogSegments removes the op log segments before segment
+func removeOpLogSegments(dataDir string, segment uint64) error {
+	segments, err := opLogSegments(dataDir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= segment {
+			break
+		}
+		err = os.Remove(opLogPath(dataDir, s))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayOpLog applies the operations of every op log segment from segment on,
+// and removes the segments before it. It returns the number of the next segment
+func (store *IPDataStore) replayOpLog(segment uint64) (uint64, error) {
+	segments, err := opLogSegments(store.dataDir)
+	if err != nil {
+		return 0, err
+	}
+
+	next := segment
+	if next == 0 {
+		next = 1
+	}
+	for _, s := range segments {
+		if s < segment {
+			continue
+		}
+		log.Printf("Replaying %s.%d...", opLogFile, s)
+		ops, err := store.replaySegment(opLogPath(store.dataDir, s))
+		if err != nil {
+			return 0, err
+		}
+		log.Printf("Replayed %d operations", ops)
+		next = s + 1
+	}
+
+	err = removeOpLogSegments(store.dataDir, segment)
+	if err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// replaySegment applies the operations in one op log segment. A segment ends at
+// its first truncated or corrupted entry, which is what a crash during an append leaves
+func (store *IPDataStore) replaySegment(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	ops := 0
+	var offset int64
+	entry := make([]byte, 4+maxOpSize+4)
+	for {
+		_, err = io.ReadFull(r, entry[0:4])
+		if err == io.EOF {
+			return ops, nil
+		}
+		size := int(binary.LittleEndian.Uint32(entry[0:4]))
+		if err == nil && size > maxOpSize {
+			err = fmt.Errorf("invalid entry size %d", size)
+		}
+		if err == nil {
+			_, err = io.ReadFull(r, entry[4:8+size])
+		}
+		if err == nil && crc32.ChecksumIEEE(entry[4:4+size]) != binary.LittleEndian.Uint32(entry[4+size:8+size]) {
+			err = fmt.Errorf("checksum mismatch")
+		}
+		if err == nil {
+			err = store.applyOp(entry[4 : 4+size])
+		}
+		if err != nil {
+			log.Printf("%s is corrupted at byte %d, ignoring the rest of it: %s", path, offset, err)
+			return ops, nil
+		}
+		offset += int64(8 + size)
+		ops++
+	}
+}
+
+// applyOp applies an op log entry body to the store at the op's time
+func (store *IPDataStore) applyOp(body []byte) error {
+	if len(body) < 25 {
+		return fmt.Errorf("entry too short")
+	}
+	now := time.Unix(0, int64(binary.LittleEndian.Uint64(body[1:9])))
+	var ip IPAddr
+	copy(ip[0:], body[9:25])
+
+	switch body[0] {
+	case opLogIP:
+		if len(body) != 30 {
+			return fmt.Errorf("invalid LogIP entry size %d", len(body))
+		}
+		impact := ImpactAmount(binary.LittleEndian.Uint32(body[25:29]))
+		store.logIPAtTime(ip, impact, BWModifier(body[29]), now)
+	case opForgiveIP:
+		if len(body) < 26 || len(body) != 26+4*int(body[25]) {
+			return fmt.Errorf("invalid ForgiveIP entry size %d", len(body))
+		}
+		impacts := make(ImpactAmounts, int(body[25]))
+		for i := range impacts {
+			impacts[i] = ImpactAmount(binary.LittleEndian.Uint32(body[26+4*i : 30+4*i]))
+		}
+		store.forgiveIPAtTime(ip, impacts, now)
+	default:
+		return fmt.Errorf("unknown op %d", body[0])
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package datastore
+
+import (
+	. "gopkg.in/check.v1"
+	"os"
+	"time"
+)
+
+type OpLogS struct{}
+
+var _ = Suite(&OpLogS{})
+
+func (s *OpLogS) TestParseSyncPolicy(c *C) {
+	for _, name := range []string{"always", "second", "never"} {
+		p, err := ParseSyncPolicy(name)
+		c.Check(err, IsNil)
+		c.Check(p.String(), Equals, name)
+	}
+	_, err := ParseSyncPolicy("sometimes")
+	c.Check(err, NotNil)
+}
+
+func (s *OpLogS) TestReplayAfterCrash(c *C) {
+	dir := c.MkDir()
+	config := Config{DataDir: dir, OpLog: true, OpLogSync: SyncAlways, Prefixes4: []int{24}}
+	store := newStore(c, config)
+	ip := IPLong(0x0A000001).IPAddr()
+	store.LogIP(ip, ImpactAmount(5), BWBlacklist)
+	store.LogIP(ip, ImpactAmount(5), BWNop)
+	store.ForgiveIP(ip, ImpactAmounts{3, 3, 3})
+	// no Persist or Close, as if the process had crashed
+
+	store = newStore(c, config)
+	data, exists := store.GetIP(ip)
+	c.Assert(exists, Equals, true)
+	checkForImpact(c, data, 7)
+	c.Check(data.Forgiven, Equals, ForgivenNum(1))
+	c.Check(data.BlackWhite, Not(Equals), byte(0))
+	c.Check(getRecord(store, ip.Prefix(24)).MaxImpacts[0], Equals, ImpactAmount(7))
+}
+
+func (s *OpLogS) TestReplayLogIPs(c *C) {
+	dir := c.MkDir()
+	config := Config{DataDir: dir, OpLog: true, OpLogSync: SyncAlways, Prefixes4: []int{24}}
+	store := newStore(c, config)
+	ip := IPLong(0x0A000001).IPAddr()
+	store.LogIPs([]IPImpact{{ip, 2}, {IPLong(0x0A000002).IPAddr(), 3}, {ip, 4}})
+
+	store = newStore(c, config)
+	c.Check(getRecord(store, ip.HostPrefix()).MaxImpacts[0], Equals, ImpactAmount(6))
+	c.Check(getRecord(store, ip.Prefix(24)).MaxImpacts[0], Equals, ImpactAmount(9))
+	c.Check(store.Len(), Equals, 3)
+}
+
+func (s *OpLogS) TestReplayKeepsTime(c *C) {
+	dir := c.MkDir()
+	config := Config{DataDir: dir, OpLog: true}
+	store := newStore(c, config)
+	ip := IPLong(1).IPAddr()
+	then := time.Now().Add(-time.Hour)
+	store.oplog.appendLogIP(ip, ImpactAmount(5), BWNop, then)
+	c.Assert(store.Close(), IsNil)
+
+	store = newStore(c, config)
+	data := getRecord(store, ip.HostPrefix())
+	c.Check(data.ScoreTime, Equals, uint32(then.Unix()))
+	// the 5 minute window has passed since the op, so it does not count now
+	c.Check(data.currentImpact(store.counting, 0, time.Now()), Equals, ImpactAmount(0))
+}
+
+func (s *OpLogS) TestPersistTruncates(c *C) {
+	dir := c.MkDir()
+	config := Config{DataDir: dir, OpLog: true}
+	store := newStore(c, config)
+	ip := IPLong(1).IPAddr()
+	store.LogIP(ip, ImpactAmount(1), BWNop)
+	c.Assert(store.Persist(), IsNil)
+	store.LogIP(ip, ImpactAmount(1), BWNop)
+	c.Assert(store.Close(), IsNil)
+
+	// only the segment started by the Persist is left
+	segments, err := opLogSegments(dir)
+	c.Assert(err, IsNil)
+	c.Check(segments, DeepEquals, []uint64{2})
+
+	// ops in the kdb are not replayed again
+	store = newStore(c, config)
+	data, _ := store.GetIP(ip)
+	checkForImpact(c, data, 2)
+	c.Assert(store.Close(), IsNil)
+
+	// a new segment is started after a restart, and the replayed one is
+	// removed by the next Persist
+	segments, _ = opLogSegments(dir)
+	c.Check(segments, DeepEquals, []uint64{2, 3})
+	store = newStore(c, config)
+	c.Assert(store.Persist(), IsNil)
+	segments, _ = opLogSegments(dir)
+	c.Check(segments, DeepEquals, []uint64{5})
+	data, _ = store.GetIP(ip)
+	checkForImpact(c, data, 2)
+}
+
+func (s *OpLogS) TestReplayWithoutOpLog(c *C) {
+	dir := c.MkDir()
+	store := newStore(c, Config{DataDir: dir, OpLog: true})
+	ip := IPLong(1).IPAddr()
+	store.LogIP(ip, ImpactAmount(1), BWNop)
+	c.Assert(store.Close(), IsNil)
+
+	// the log is replayed, and removed by the next Persist, even with the op log disabled
+	store = newStore(c, Config{DataDir: dir})
+	_, exists := store.GetIP(ip)
+	c.Check(exists, Equals, true)
+	c.Assert(store.Persist(), IsNil)
+	segments, _ := opLogSegments(dir)
+	c.Check(len(segments), Equals, 0)
+
+	store = newStore(c, Config{DataDir: dir})
+	data, _ := store.GetIP(ip)
+	checkForImpact(c, data, 1)
+}
+
+func (s *OpLogS) TestReplayCorruptedTail(c *C) {
+	dir := c.MkDir()
+	config := Config{DataDir: dir, OpLog: true, OpLogSync: SyncNever}
+	store := newStore(c, config)
+	ip := IPLong(1).IPAddr()
+	store.LogIP(ip, ImpactAmount(1), BWNop)
+	store.LogIP(ip, ImpactAmount(1), BWNop)
+	c.Assert(store.Close(), IsNil)
+
+	// cut the last entry short, as a crash during an append would
+	path := opLogPath(dir, 1)
+	info, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(os.Truncate(path, info.Size()-3), IsNil)
+
+	store = newStore(c, config)
+	data, _ := store.GetIP(ip)
+	checkForImpact(c, data, 1)
+}
+
+func (s *OpLogS) TestLogIPDuringPersist(c *C) {
+	dir := c.MkDir()
+	config := Config{DataDir: dir, OpLog: true}
+	store := newStore(c, config)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			store.LogIP(IPLong(i).IPAddr(), ImpactAmount(1), BWNop)
+		}
+		done <- true
+	}()
+	for i := 0; i < 3; i++ {
+		c.Check(store.Persist(), IsNil)
+	}
+	<-done
+	c.Assert(store.Close(), IsNil)
+
+	// every op is either in the kdb or in a segment after it, never both
+	store = newStore(c, config)
+	c.Check(store.Len(), Equals, 1000)
+	for i := 0; i < 1000; i++ {
+		c.Check(getRecord(store, IPLong(i).IPAddr().HostPrefix()).MaxImpacts[0], Equals, ImpactAmount(1))
+	}
+}
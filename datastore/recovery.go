@@ -0,0 +1,207 @@
+package datastore
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RecoveryPolicy selects what New does when the kdb can't be decoded
+type RecoveryPolicy byte
+
+const (
+	// RecoverRefuse returns the kdb's error from New, leaving the kdb as it is
+	RecoverRefuse RecoveryPolicy = iota
+	// RecoverPartial quarantines the kdb and keeps the records
+	// decoded before the corruption
+	RecoverPartial
+	// RecoverFallback quarantines the kdb and loads the newest snapshot
+	// which decodes, or the latest backup if none does
+	RecoverFallback
+)
+
+// ParseRecoveryPolicy parses "refuse", "partial" or "fallback"
+func ParseRecoveryPolicy(s string) (RecoveryPolicy, error) {
+	switch s {
+	case "refuse":
+		return RecoverRefuse, nil
+	case "partial":
+		return RecoverPartial, nil
+	case "fallback":
+		return RecoverFallback, nil
+	default:
+		return RecoverRefuse, fmt.Errorf("Unknown recovery policy %q", s)
+	}
+}
+
+func (p RecoveryPolicy) String() string {
+	switch p {
+	case RecoverRefuse:
+		return "refuse"
+	case RecoverPartial:
+		return "partial"
+	case RecoverFallback:
+		return "fallback"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(p))
+	}
+}
+
+// Recovery is how New loaded the store when its kdb couldn't be decoded
+type Recovery byte
+
+const (
+	// RecoveryNone means the kdb decoded, or there was none
+	RecoveryNone Recovery = iota
+	// RecoveryPartial means the records decoded before the corruption were kept
+	RecoveryPartial
+	// RecoverySnapshot means the newest snapshot which decodes was loaded
+	RecoverySnapshot
+	// RecoveryBackup means the latest backup was loaded
+	RecoveryBackup
+)
+
+func (r Recovery) String() string {
+	switch r {
+	case RecoveryNone:
+		return "none"
+	case RecoveryPartial:
+		return "partial"
+	case RecoverySnapshot:
+		return "snapshot"
+	case RecoveryBackup:
+		return "backup"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(r))
+	}
+}
+
+// Recovery returns how New loaded the store if its kdb couldn't be decoded
+func (store *IPDataStore) Recovery() Recovery {
+	return store.recovery
+}
+
+// LostOpLogSegments returns the op log segments, from and to exclusive, whose
+// operations were lost because New fell back to a snapshot or backup older than
+// the op log kept in the data dir. from equals to if none were lost
+func (store *IPDataStore) LostOpLogSegments() (from, to uint64) {
+	return store.lostSegments[0], store.lostSegments[1]
+}
+
+// recoverKDB applies the policy after the kdb failed to load with loadErr,
+// leaving segment as the first op log segment loadFromFile found was not in
+// the kdb. It returns the first op log segment which is not in the loaded
+// records. Errors reading the kdb, rather than decoding it, are returned
+// whatever the policy
+func (store *IPDataStore) recoverKDB(policy RecoveryPolicy, segment uint64, loadErr error) (uint64, Recovery, error) {
+	corrupted := fmt.Errorf("%s appears to be corrupted: %s", kdbFile, loadErr)
+	kdbSegment := segment
+	if _, ok := loadErr.(*os.PathError); ok || policy == RecoverRefuse {
+		return 0, RecoveryNone, corrupted
+	}
+
+	quarantine, err := store.quarantineKDB(time.Now())
+	if err != nil {
+		return 0, RecoveryNone, err
+	}
+	log.Printf("%s. Quarantined it as %s, recovering with the %s policy", corrupted, quarantine, policy)
+
+	if policy == RecoverPartial {
+		log.Printf("Recovered %d records decoded before the corruption", store.Len())
+		return segment, RecoveryPartial, nil
+	}
+
+	// fall back, without the records decoded from the corrupted kdb
+	for _, shard := range store.shards {
+		shard.m = make(IPDataMap)
+	}
+	snapshots, err := ListSnapshots(store.dataDir)
+	if err != nil {
+		return 0, RecoveryNone, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		err = store.installKDB(snapshots[i].Path)
+		if err != nil {
+			log.Printf("Snapshot %s can't be loaded: %s", snapshots[i].Name, err)
+			continue
+		}
+		segment, err = store.loadFromFile()
+		if err != nil {
+			return 0, RecoveryNone, err
+		}
+		log.Printf("Recovered %d records from snapshot %s", store.Len(), snapshots[i].Name)
+		err = store.checkOpLogGap("snapshot "+snapshots[i].Name, segment, kdbSegment)
+		if err != nil {
+			return 0, RecoveryNone, err
+		}
+		return segment, RecoverySnapshot, nil
+	}
+
+	if store.backend != nil {
+		restored, err := store.RestoreFromBackup()
+		if err != nil {
+			return 0, RecoveryNone, fmt.Errorf("%s, and no snapshot or backup can be loaded: %s", corrupted, err)
+		}
+		if restored {
+			segment, err = store.loadFromFile()
+			if err != nil {
+				return 0, RecoveryNone, err
+			}
+			log.Printf("Recovered %d records from the backup in %s", store.Len(), store.backend)
+			err = store.checkOpLogGap("backup", segment, kdbSegment)
+			if err != nil {
+				return 0, RecoveryNone, err
+			}
+			return segment, RecoveryBackup, nil
+		}
+	}
+	if store.backend == nil {
+		return 0, RecoveryNone, fmt.Errorf("%s, and there is no snapshot to fall back to and no backup backend", corrupted)
+	}
+	return 0, RecoveryNone, fmt.Errorf("%s, and there is no snapshot or backup to fall back to", corrupted)
+}
+
+// checkOpLogGap logs the op log segments which are neither in the kdb loaded from
+// source, which needs segment on, nor in the data dir, because Persist removed
+// them once the corrupted kdb, which needed kdbSegment on, was written. The later
+// segments are still replayed, but every operation in the gap is lost
+func (store *IPDataStore) checkOpLogGap(source string, segment uint64, kdbSegment uint64) error {
+	if segment == 0 {
+		// kdbs before the op log don't record which operations they include
+		return nil
+	}
+	segments, err := opLogSegments(store.dataDir)
+	if err != nil {
+		return err
+	}
+	next := kdbSegment
+	for _, s := range segments {
+		if s >= segment {
+			next = s
+			break
+		}
+	}
+	if next <= segment {
+		return nil
+	}
+
+	store.lostSegments = [2]uint64{segment, next}
+	log.Printf("WARNING: the %s is older than the op log. The operations in %s.%d to %s.%d were "+
+		"removed when the corrupted %s was written, and are lost. Later operations are replayed on top of the %s",
+		source, opLogFile, segment, opLogFile, next-1, kdbFile, source)
+	return nil
+}
+
+// quarantineKDB keeps a copy of the kdb, named for the time it was found
+// corrupted, which snapshots and restores never replace. It returns the copy's name
+func (store *IPDataStore) quarantineKDB(now time.Time) (string, error) {
+	name := kdbFile + ".corrupt." + now.UTC().Format(snapshotTimeFormat)
+	path := filepath.Join(store.dataDir, name)
+	err := os.Link(store.kdbPath(), path)
+	if err != nil {
+		err = copyFile(store.kdbPath(), path)
+	}
+	return name, err
+}
@@ -0,0 +1,160 @@
+package datastore
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type RecoveryS struct{}
+
+var _ = Suite(&RecoveryS{})
+
+// writeCorruptedKDB writes a kdb of blockRecords+1 records to the data dir,
+// cut in its second block, and returns it
+func writeCorruptedKDB(c *C, dataDir string) []byte {
+	kdb := encodeTestStore(c, blockRecords+1)
+	kdb = kdb[0 : len(kdb)-30]
+	c.Assert(ioutil.WriteFile(filepath.Join(dataDir, kdbFile), kdb, 0644), IsNil)
+	return kdb
+}
+
+// quarantined returns the names of the quarantined kdbs in the data dir
+func quarantined(c *C, dataDir string) []string {
+	files, err := ioutil.ReadDir(dataDir)
+	c.Assert(err, IsNil)
+	var names []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), kdbFile+".corrupt.") {
+			names = append(names, file.Name())
+		}
+	}
+	return names
+}
+
+func (s *RecoveryS) TestParseRecoveryPolicy(c *C) {
+	for _, policy := range []RecoveryPolicy{RecoverRefuse, RecoverPartial, RecoverFallback} {
+		parsed, err := ParseRecoveryPolicy(policy.String())
+		c.Check(err, IsNil)
+		c.Check(parsed, Equals, policy)
+	}
+	_, err := ParseRecoveryPolicy("ignore")
+	c.Check(err, NotNil)
+}
+
+func (s *RecoveryS) TestRecoverRefuse(c *C) {
+	dir := c.MkDir()
+	kdb := writeCorruptedKDB(c, dir)
+
+	_, err := New(Config{DataDir: dir})
+	c.Check(err, ErrorMatches, kdbFile+" appears to be corrupted: kdb corrupted .*truncated block")
+
+	// the kdb is left as it was
+	data, err := ioutil.ReadFile(filepath.Join(dir, kdbFile))
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(data, kdb), Equals, true)
+	c.Check(quarantined(c, dir), HasLen, 0)
+}
+
+func (s *RecoveryS) TestRecoverPartial(c *C) {
+	dir := c.MkDir()
+	kdb := writeCorruptedKDB(c, dir)
+
+	store := newStore(c, Config{DataDir: dir, Recovery: RecoverPartial})
+	c.Check(store.Recovery(), Equals, RecoveryPartial)
+	c.Check(store.Len(), Equals, blockRecords)
+
+	names := quarantined(c, dir)
+	c.Assert(names, HasLen, 1)
+	data, err := ioutil.ReadFile(filepath.Join(dir, names[0]))
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(data, kdb), Equals, true)
+
+	// the recovered records replaced the kdb
+	store = newStore(c, Config{DataDir: dir})
+	c.Check(store.Recovery(), Equals, RecoveryNone)
+	c.Check(store.Len(), Equals, blockRecords)
+}
+
+func (s *RecoveryS) TestRecoverFallbackSnapshot(c *C) {
+	dir := c.MkDir()
+	config := Config{DataDir: dir, Snapshots: 3, Recovery: RecoverFallback}
+	store := newStore(c, config)
+	store.LogIP(IPLong(1).IPAddr(), ImpactAmount(1), BWNop)
+	c.Assert(store.Persist(), IsNil)
+	store.LogIP(IPLong(2).IPAddr(), ImpactAmount(1), BWNop)
+	c.Assert(store.Persist(), IsNil)
+
+	// the newest snapshot is a link to the kdb, so is corrupted with it
+	writeCorruptedKDB(c, dir)
+
+	store = newStore(c, config)
+	c.Check(store.Recovery(), Equals, RecoverySnapshot)
+	c.Check(store.Len(), Equals, 1)
+	_, ok := store.GetIP(IPLong(1).IPAddr())
+	c.Check(ok, Equals, true)
+	c.Check(quarantined(c, dir), HasLen, 1)
+	from, to := store.LostOpLogSegments()
+	c.Check(from, Equals, to)
+}
+
+func (s *RecoveryS) TestRecoverFallbackOpLogGap(c *C) {
+	dir := c.MkDir()
+	config := Config{DataDir: dir, Snapshots: 3, OpLog: true, Recovery: RecoverFallback}
+	store := newStore(c, config)
+	store.LogIP(IPLong(1).IPAddr(), ImpactAmount(1), BWNop)
+	c.Assert(store.Persist(), IsNil)
+	older := store.logSegment
+	// the segment with this is removed by the next Persist
+	store.LogIP(IPLong(2).IPAddr(), ImpactAmount(1), BWNop)
+	c.Assert(store.Persist(), IsNil)
+	store.LogIP(IPLong(3).IPAddr(), ImpactAmount(1), BWNop)
+	c.Assert(store.Close(), IsNil)
+
+	writeCorruptedKDB(c, dir)
+
+	store = newStore(c, config)
+	defer store.Close()
+	c.Check(store.Recovery(), Equals, RecoverySnapshot)
+	from, to := store.LostOpLogSegments()
+	c.Check(from, Equals, older)
+	c.Check(to, Equals, older+1)
+
+	// the operations after the gap are still replayed
+	_, ok := store.GetIP(IPLong(1).IPAddr())
+	c.Check(ok, Equals, true)
+	_, ok = store.GetIP(IPLong(2).IPAddr())
+	c.Check(ok, Equals, false)
+	_, ok = store.GetIP(IPLong(3).IPAddr())
+	c.Check(ok, Equals, true)
+}
+
+func (s *RecoveryS) TestRecoverFallbackBackup(c *C) {
+	dir := c.MkDir()
+	config := Config{DataDir: dir, Backend: NewDirBackend(c.MkDir()), Recovery: RecoverFallback}
+	store := newStore(c, config)
+	store.LogIP(IPLong(1).IPAddr(), ImpactAmount(1), BWNop)
+	c.Assert(store.Persist(), IsNil)
+	c.Assert(store.Backup(), IsNil)
+
+	writeCorruptedKDB(c, dir)
+
+	store = newStore(c, config)
+	c.Check(store.Recovery(), Equals, RecoveryBackup)
+	c.Check(store.Len(), Equals, 1)
+}
+
+func (s *RecoveryS) TestRecoverFallbackNothing(c *C) {
+	dir := c.MkDir()
+	writeCorruptedKDB(c, dir)
+
+	_, err := New(Config{DataDir: dir, Backend: NewDirBackend(c.MkDir()), Recovery: RecoverFallback})
+	c.Check(err, ErrorMatches, kdbFile+" appears to be corrupted: .*, and there is no snapshot or backup to fall back to")
+
+	// the kdb is still there to be recovered by hand
+	_, err = os.Stat(filepath.Join(dir, kdbFile))
+	c.Check(err, IsNil)
+}
@@ -2,46 +2,127 @@ package datastore
 
 import (
 	"errors"
+	"fmt"
 	"github.com/rlmcpherson/s3gof3r"
 	"io"
-	"os"
+	"net/http"
+	"strings"
 )
 
-// BackupToS3 writes the kawana.kdb to s3, overwriting an existing backup
-// if one exists
-func (store *IPDataStore) BackupToS3() error {
-	if store.s3Bucket == "" {
-		return errors.New("Empty s3Bucket name")
+// S3Config locates a bucket on S3, or on an S3-compatible service such as MinIO or Ceph
+type S3Config struct {
+	Bucket string
+	// Endpoint is the service's host and optional port, e.g. minio:9000, with an
+	// optional http:// or https:// scheme. https is used without a scheme.
+	// Defaults to the AWS endpoint for Region
+	Endpoint string
+	// Region is the AWS region, only used to choose the default endpoint.
+	// s3gof3r only signs requests with SigV2, so regions which only accept
+	// SigV4, which is every region launched since 2014, are refused
+	Region string
+	// PathStyle addresses the bucket in the path of each request, as most
+	// S3-compatible services need, instead of in the host name
+	PathStyle bool
+	// Keys for the service. Read from AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY in the environment if empty
+	AccessKey string
+	SecretKey string
+}
+
+// endpoint returns the scheme and host of the config's endpoint
+func (config *S3Config) endpoint() (scheme, host string) {
+	host = config.Endpoint
+	if host == "" {
+		if config.Region == "" || config.Region == "us-east-1" {
+			return "https", s3gof3r.DefaultDomain
+		}
+		return "https", "s3." + config.Region + ".amazonaws.com"
+	}
+	scheme = "https"
+	if i := strings.Index(host, "://"); i >= 0 {
+		scheme, host = host[:i], host[i+3:]
 	}
+	return scheme, strings.TrimSuffix(host, "/")
+}
 
-	k, err := s3gof3r.EnvKeys() // get S3 keys from environment
-	if err != nil {
-		return err
+// sigV2Regions are the AWS regions which accept SigV2 signed requests
+var sigV2Regions = map[string]bool{
+	"us-east-1":      true,
+	"us-west-1":      true,
+	"us-west-2":      true,
+	"eu-west-1":      true,
+	"ap-southeast-1": true,
+	"ap-southeast-2": true,
+	"ap-northeast-1": true,
+	"sa-east-1":      true,
+}
+
+// S3Backend is a Backend which stores objects in an S3 bucket. Each object's
+// md5 is stored alongside it, and checked when the object's reader is closed
+type S3Backend struct {
+	bucket *s3gof3r.Bucket
+}
+
+// NewS3Backend returns an S3Backend for the bucket in the config
+func NewS3Backend(config S3Config) (*S3Backend, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("Empty s3Bucket name")
+	}
+	if config.Endpoint == "" && config.Region != "" && !sigV2Regions[config.Region] {
+		return nil, fmt.Errorf("AWS region %s only accepts SigV4 signed requests, but S3 backups are signed with SigV2", config.Region)
 	}
-	// Open bucket to put file into
-	s3 := s3gof3r.New("", k)
-	b := s3.Bucket(store.s3Bucket)
 
-	// open file to upload
-	file, err := os.Open(store.kdbPath())
-	if err != nil {
-		return err
+	keys := s3gof3r.Keys{AccessKey: config.AccessKey, SecretKey: config.SecretKey}
+	if keys.AccessKey == "" && keys.SecretKey == "" {
+		var err error
+		keys, err = s3gof3r.EnvKeys() // get S3 keys from environment
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Open a PutWriter for upload
-	w, err := b.PutWriter(store.s3FilePath(), nil, nil)
+	scheme, host := config.endpoint()
+	b := s3gof3r.New(host, keys).Bucket(config.Bucket)
+	c := *s3gof3r.DefaultConfig
+	c.Scheme = scheme
+	c.PathStyle = config.PathStyle
+	b.Config = &c
+	return &S3Backend{bucket: b}, nil
+}
+
+// Put stores the metadata as x-amz-meta- headers of the object. s3gof3r can't
+// abort an upload once it has started, so if reading r fails the truncated object
+// is deleted after the upload completes, along with any object it replaced
+func (b *S3Backend) Put(key string, r io.Reader, meta map[string]string) error {
+	h := make(http.Header)
+	for name, value := range meta {
+		h.Set("x-amz-meta-"+name, value)
+	}
+	w, err := b.bucket.PutWriter(key, h, nil)
 	if err != nil {
 		return err
 	}
-	if _, err = io.Copy(w, file); err != nil { // Copy into S3
+	if _, err = io.Copy(w, r); err != nil { // Copy into S3
+		if w.Close() == nil {
+			b.Delete(key)
+		}
 		return err
 	}
-	if err = w.Close(); err != nil {
-		return err
+	return w.Close()
+}
+
+func (b *S3Backend) Get(key string) (io.ReadCloser, error) {
+	r, _, err := b.bucket.GetReader(key, nil)
+	if respErr, ok := err.(*s3gof3r.RespError); ok && respErr.StatusCode == http.StatusNotFound {
+		return nil, ErrBackupNotFound
 	}
-	return nil
+	return r, err
+}
+
+func (b *S3Backend) Delete(key string) error {
+	return b.bucket.Delete(key)
 }
 
-func (store *IPDataStore) s3FilePath() string {
-	return kdbFile
+func (b *S3Backend) String() string {
+	return "s3://" + b.bucket.Name
 }
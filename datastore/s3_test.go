@@ -0,0 +1,224 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeS3 is a local stand-in for the parts of S3 that s3gof3r uses: gets, ranged
+// gets, single puts, multipart uploads and deletes, with path style addressing
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	meta    map[string]map[string]string // x-amz-meta- headers of the objects' uploads
+	parts   map[int][]byte               // parts of the upload in progress
+	server  *httptest.Server
+}
+
+func newFakeS3() *fakeS3 {
+	f := &fakeS3{objects: make(map[string][]byte), meta: make(map[string]map[string]string)}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+// backend returns an S3Backend for the named bucket of the stand-in
+func (f *fakeS3) backend(c *C, bucket string) *S3Backend {
+	b, err := NewS3Backend(S3Config{
+		Bucket:    bucket,
+		Endpoint:  f.server.URL,
+		PathStyle: true,
+		AccessKey: "key",
+		SecretKey: "secret",
+	})
+	c.Assert(err, IsNil)
+	return b
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	key := r.URL.Path
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == "GET":
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(404)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			return
+		}
+		var start, end int
+		if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); n == 2 {
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(end+1-start))
+			w.WriteHeader(206)
+			w.Write(data[start : end+1])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		f.parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+
+	case r.Method == "PUT":
+		f.objects[key] = body
+
+	case r.Method == "POST" && r.URL.RawQuery == "uploads":
+		f.parts = make(map[int][]byte)
+		f.meta[key] = make(map[string]string)
+		for name := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				f.meta[key][strings.ToLower(name[len("x-amz-meta-"):])] = r.Header.Get(name)
+			}
+		}
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>1</UploadId></InitiateMultipartUploadResult>")
+
+	case r.Method == "POST":
+		var numbers []int
+		for n := range f.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		sums := md5.New()
+		for _, n := range numbers {
+			data = append(data, f.parts[n]...)
+			sum := md5.Sum(f.parts[n])
+			sums.Write(sum[:])
+		}
+		f.objects[key] = data
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>"%x-%d"</ETag></CompleteMultipartUploadResult>`, sums.Sum(nil), len(numbers))
+
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(204)
+	}
+}
+
+// object returns the stored object at the key in the bucket
+func (f *fakeS3) object(bucket, key string) ([]byte, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	data, ok := f.objects["/"+bucket+"/"+key]
+	return data, ok
+}
+
+// putObject stores data at the key in the bucket, with sum as the md5 which
+// s3gof3r checks. With path style addressing it includes the bucket in its key
+func (f *fakeS3) putObject(bucket, key string, data []byte, sum [md5.Size]byte) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.objects["/"+bucket+"/"+key] = data
+	f.objects["/"+bucket+"/.md5/"+bucket+"/"+key+".md5"] = []byte(fmt.Sprintf("%x", sum))
+}
+
+type S3S struct{}
+
+var _ = Suite(&S3S{})
+
+func (s *S3S) TestS3Backend(c *C) {
+	fake := newFakeS3()
+	defer fake.server.Close()
+
+	b := fake.backend(c, "kawana")
+	checkBackend(c, b)
+	c.Check(b.String(), Equals, "s3://kawana")
+
+	c.Assert(b.Put(kdbFile, bytes.NewReader([]byte("kdb")), map[string]string{KeyIDMetadata: "k1"}), IsNil)
+	data, ok := fake.object("kawana", kdbFile)
+	c.Check(ok, Equals, true)
+	c.Check(string(data), Equals, "kdb")
+	c.Check(fake.meta["/kawana/"+kdbFile], DeepEquals, map[string]string{KeyIDMetadata: "k1"})
+}
+
+func (s *S3S) TestS3BackendFailedPut(c *C) {
+	fake := newFakeS3()
+	defer fake.server.Close()
+
+	b := fake.backend(c, "kawana")
+	err := b.Put(kdbFile, &failingReader{[]byte("truncated")}, nil)
+	c.Check(err, Equals, os.ErrInvalid)
+	_, ok := fake.object("kawana", kdbFile)
+	c.Check(ok, Equals, false)
+	_, err = b.Get(kdbFile)
+	c.Check(err, Equals, ErrBackupNotFound)
+}
+
+func (s *S3S) TestS3BackendMd5Mismatch(c *C) {
+	fake := newFakeS3()
+	defer fake.server.Close()
+
+	kdb := encodeTestStore(c, 3)
+	fake.putObject("kawana", kdbFile, kdb, md5.Sum(bytes.ToUpper(kdb)))
+
+	// the backup is not restored
+	store := newStore(c, Config{DataDir: c.MkDir(), Backend: fake.backend(c, "kawana")})
+	_, err := store.RestoreFromBackup()
+	c.Check(err, ErrorMatches, "MD5 mismatch.*")
+}
+
+func (s *S3S) TestS3Endpoint(c *C) {
+	tests := []struct {
+		config S3Config
+		scheme string
+		host   string
+	}{
+		{S3Config{}, "https", "s3.amazonaws.com"},
+		{S3Config{Region: "us-east-1"}, "https", "s3.amazonaws.com"},
+		{S3Config{Region: "eu-west-1"}, "https", "s3.eu-west-1.amazonaws.com"},
+		{S3Config{Endpoint: "minio:9000", Region: "eu-west-1"}, "https", "minio:9000"},
+		{S3Config{Endpoint: "http://minio:9000/"}, "http", "minio:9000"},
+	}
+	for _, test := range tests {
+		scheme, host := test.config.endpoint()
+		c.Check(scheme, Equals, test.scheme)
+		c.Check(host, Equals, test.host)
+	}
+}
+
+func (s *S3S) TestS3BackendKeys(c *C) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	defer os.Setenv("AWS_ACCESS_KEY_ID", accessKey)
+	os.Setenv("AWS_ACCESS_KEY_ID", "")
+	_, err := NewS3Backend(S3Config{Bucket: "kawana"})
+	c.Check(err, NotNil)
+	_, err = NewS3Backend(S3Config{Bucket: "kawana", AccessKey: "key", SecretKey: "secret"})
+	c.Check(err, IsNil)
+	_, err = NewS3Backend(S3Config{AccessKey: "key", SecretKey: "secret"})
+	c.Check(err, NotNil)
+}
+
+func (s *S3S) TestS3BackendSigV4Region(c *C) {
+	config := S3Config{Bucket: "kawana", Region: "eu-central-1", AccessKey: "key", SecretKey: "secret"}
+	_, err := NewS3Backend(config)
+	c.Check(err, ErrorMatches, "AWS region eu-central-1 only accepts SigV4 .*")
+
+	// regions which accept SigV2, and S3-compatible services, are allowed
+	config.Region = "eu-west-1"
+	_, err = NewS3Backend(config)
+	c.Check(err, IsNil)
+	config.Region = "eu-central-1"
+	config.Endpoint = "minio:9000"
+	_, err = NewS3Backend(config)
+	c.Check(err, IsNil)
+}
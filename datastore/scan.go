@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ScanField selects which impact of a window a scan ranks records by
+type ScanField byte
+
+const (
+	// ScanCur ranks by the window's current impact
+	ScanCur ScanField = iota
+	// ScanMax ranks by the window's max impact
+	ScanMax
+)
+
+// ScanQuery selects the records returned by Scan
+type ScanQuery struct {
+	Window    int          // index into the store's Windows
+	Field     ScanField    // which of the window's impacts to rank by
+	Limit     int          // most records to return, the highest ranked first. 0 for no limit
+	Threshold ImpactAmount // least impact a record must have to be returned
+}
+
+// ScanResult is a copy of a host or prefix record found by Scan,
+// and the impact it was ranked by
+type ScanResult struct {
+	Prefix Prefix
+	Data   *IPData
+	Impact ImpactAmount
+}
+
+// scanResults is a min-heap of ScanResults by Impact, so that the lowest ranked
+// record can be dropped when a scan with a limit finds a higher ranked one
+type scanResults []ScanResult
+
+func (r scanResults) Len() int            { return len(r) }
+func (r scanResults) Less(i, j int) bool  { return r[i].Impact < r[j].Impact }
+func (r scanResults) Swap(i, j int)       { r[i], r[j] = r[j], r[i] }
+func (r *scanResults) Push(x interface{}) { *r = append(*r, x.(ScanResult)) }
+func (r *scanResults) Pop() interface{} {
+	old := *r
+	result := old[len(old)-1]
+	*r = old[:len(old)-1]
+	return result
+}
+
+// Scan returns copies of the host and prefix records whose impact in the query's
+// window is nonzero and at least the query's threshold, highest impact first.
+// Current impacts are as of now, so impacts which have left the window are not counted.
+//
+// Shards are scanned one at a time, so LogIP is only held up by the scan
+// of the shard it needs to insert into
+func (store *IPDataStore) Scan(q ScanQuery) ([]ScanResult, error) {
+	if q.Window < 0 || q.Window >= len(store.counting.windows) {
+		return nil, fmt.Errorf("Invalid window index %d", q.Window)
+	}
+	if q.Field != ScanCur && q.Field != ScanMax {
+		return nil, fmt.Errorf("Invalid scan field %d", q.Field)
+	}
+	if q.Limit < 0 {
+		return nil, fmt.Errorf("Invalid scan limit %d", q.Limit)
+	}
+
+	now := time.Now()
+	results := &scanResults{}
+	for _, shard := range store.shards {
+		store.scanShard(shard, q, now, results)
+	}
+
+	sort.Sort(sort.Reverse(results))
+	return *results, nil
+}
+
+// scanShard adds the shard's matching records to the results. Records which
+// are in the shard's wal during a Persist are scanned there instead of in the shard
+//
+// Takes a read lock on the wal status, and the locks of scanMap
+func (store *IPDataStore) scanShard(shard *ipDataShard, q ScanQuery, now time.Time, results *scanResults) {
+	shard.wal.status.RLock()
+	defer shard.wal.status.RUnlock()
+
+	var inWAL map[Prefix]bool
+	if shard.wal.status.state != walInactive {
+		inWAL = make(map[Prefix]bool)
+		store.scanMap(shard.wal, q, now, results, inWAL, nil)
+	}
+	store.scanMap(shard, q, now, results, nil, inWAL)
+}
+
+// scanMap adds the matching records of m to the results, skipping keys in skip.
+// Every key scanned is added to seen, if it is not nil
+//
+// Takes a read lock on m
+func (store *IPDataStore) scanMap(m syncIPDataStore, q ScanQuery, now time.Time, results *scanResults, seen, skip map[Prefix]bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for key, data := range m.getMap() {
+		if seen != nil {
+			seen[key] = true
+		}
+		if skip[key] {
+			continue
+		}
+
+		impact := store.scanImpact(data, q, now)
+		if impact == 0 || impact < q.Threshold {
+			continue
+		}
+		if q.Limit > 0 && results.Len() == q.Limit {
+			if impact <= (*results)[0].Impact {
+				continue
+			}
+			heap.Pop(results)
+		}
+		heap.Push(results, ScanResult{Prefix: key, Data: data.clone(), Impact: impact})
+	}
+}
+
+// scanImpact returns the impact the record is ranked by
+//
+// Takes a read lock on the IPData
+func (store *IPDataStore) scanImpact(data *IPData, q ScanQuery, now time.Time) ImpactAmount {
+	data.Mutex.RLock()
+	defer data.Mutex.RUnlock()
+
+	if q.Field == ScanMax {
+		if q.Window >= len(data.MaxImpacts) {
+			return 0
+		}
+		return data.MaxImpacts[q.Window]
+	}
+	return data.currentImpact(store.counting, q.Window, now)
+}
@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type ScanS struct{}
+
+var _ = Suite(&ScanS{})
+
+func (s *ScanS) TestScanTopN(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 4})
+	for i := 1; i <= 10; i++ {
+		store.LogIP(IPLong(i).IPAddr(), ImpactAmount(i), BWNop)
+	}
+
+	results, err := store.Scan(ScanQuery{Window: 0, Field: ScanCur, Limit: 3})
+	c.Assert(err, IsNil)
+	c.Assert(len(results), Equals, 3)
+	for i, result := range results {
+		ip := IPLong(10 - i).IPAddr()
+		c.Check(result.Prefix, Equals, ip.HostPrefix())
+		c.Check(result.Impact, Equals, ImpactAmount(10-i))
+		c.Check(result.Data.MaxImpacts[0], Equals, ImpactAmount(10-i))
+	}
+}
+
+func (s *ScanS) TestScanThreshold(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Prefixes4: []int{24}})
+	for i := 1; i <= 10; i++ {
+		store.LogIP(IPLong(i).IPAddr(), ImpactAmount(i), BWNop)
+	}
+	store.LogIP(IPLong(11).IPAddr(), ImpactAmount(0), BWBlacklist)
+
+	results, err := store.Scan(ScanQuery{Window: 1, Field: ScanMax, Threshold: 8})
+	c.Assert(err, IsNil)
+
+	// the /24 prefix holds the sum of every host
+	c.Assert(len(results), Equals, 4)
+	c.Check(results[0].Prefix, Equals, IPLong(1).IPAddr().Prefix(24))
+	c.Check(results[0].Impact, Equals, ImpactAmount(55))
+	c.Check(results[3].Impact, Equals, ImpactAmount(8))
+
+	// records without impact are never returned
+	results, err = store.Scan(ScanQuery{})
+	c.Assert(err, IsNil)
+	c.Check(len(results), Equals, 11)
+}
+
+func (s *ScanS) TestScanDuringPersist(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir()})
+	ip := IPLong(1).IPAddr()
+	store.LogIP(ip, ImpactAmount(1), BWNop)
+
+	// the wal's copy of the record is newer, and is the only one returned
+	store.setWALStatus(walWriting)
+	store.LogIP(ip, ImpactAmount(1), BWNop)
+	results, err := store.Scan(ScanQuery{Field: ScanMax})
+	store.setWALStatus(walInactive)
+	c.Assert(err, IsNil)
+	c.Assert(len(results), Equals, 1)
+	c.Check(results[0].Impact, Equals, ImpactAmount(2))
+}
+
+func (s *ScanS) TestScanInvalid(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir()})
+	_, err := store.Scan(ScanQuery{Window: 3})
+	c.Check(err, NotNil)
+	_, err = store.Scan(ScanQuery{Field: ScanField(2)})
+	c.Check(err, NotNil)
+	_, err = store.Scan(ScanQuery{Limit: -1})
+	c.Check(err, NotNil)
+}
+
+func (s *ScanS) TestCurrentImpact(c *C) {
+	now := time.Unix(1000000, 0)
+
+	fixed := newIPData(fixedCounting)
+	fixed.impactAtTime(fixedCounting, ImpactAmount(3), BWNop, now)
+	c.Check(fixed.currentImpact(fixedCounting, 0, now.Add(time.Minute)), Equals, ImpactAmount(3))
+	c.Check(fixed.currentImpact(fixedCounting, 0, now.Add(10*time.Minute)), Equals, ImpactAmount(0))
+	c.Check(fixed.currentImpact(fixedCounting, 1, now.Add(10*time.Minute)), Equals, ImpactAmount(3))
+
+	sliding := &counting{windows: Windows{time.Minute}, counter: CounterSliding, buckets: 6, halfLife: time.Hour}
+	data := newIPData(sliding)
+	data.impactAtTime(sliding, ImpactAmount(1), BWNop, now)
+	data.impactAtTime(sliding, ImpactAmount(2), BWNop, now.Add(30*time.Second))
+	c.Check(data.currentImpact(sliding, 0, now.Add(30*time.Second)), Equals, ImpactAmount(3))
+	// the first impact's bucket has left the window, the second's has not
+	c.Check(data.currentImpact(sliding, 0, now.Add(65*time.Second)), Equals, ImpactAmount(2))
+	c.Check(data.currentImpact(sliding, 0, now.Add(2*time.Minute)), Equals, ImpactAmount(0))
+	c.Check(data.CurImpacts[0], Equals, ImpactAmount(3))
+}
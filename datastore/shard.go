@@ -0,0 +1,247 @@
+package datastore
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultShards is the number of independently locked partitions of a store
+const DefaultShards = 32
+
+// ipDataShard is a lockable partition of the store's records,
+// with its own write-ahead log for use during Persist
+type ipDataShard struct {
+	sync.RWMutex
+	m   IPDataMap
+	wal *ipWAL
+
+	maxRecords int // 0 if the shard is not capped
+	policy     EvictionPolicy
+	evictions  uint64 // records evicted to stay under maxRecords
+}
+
+func newIPDataShard(maxRecords int, policy EvictionPolicy) *ipDataShard {
+	return &ipDataShard{
+		m:          make(IPDataMap),
+		wal:        newIPWAL(),
+		maxRecords: maxRecords,
+		policy:     policy,
+	}
+}
+
+func (shard *ipDataShard) getMap() IPDataMap {
+	return shard.m
+}
+
+// shardFor returns the shard which holds the key
+func (store *IPDataStore) shardFor(key Prefix) *ipDataShard {
+	return store.shards[store.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard which holds the key,
+// chosen by an FNV-1a hash of the key
+func (store *IPDataStore) shardIndex(key Prefix) int {
+	hash := uint32(2166136261)
+	for _, b := range key.Addr {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	hash ^= uint32(key.Bits)
+	hash *= 16777619
+	return int(hash % uint32(len(store.shards)))
+}
+
+// logKey adds the impact to a single host or prefix record in the shard.
+//
+// Takes a read lock on the wal status, and the locks of ipStoreUpdate or ipStoreInsert
+func (shard *ipDataShard) logKey(c *counting, key Prefix, impact ImpactAmount, blackWhite BWModifier, now time.Time) *IPData {
+	shard.wal.status.RLock()
+	defer shard.wal.status.RUnlock()
+
+	var ipStore syncIPDataStore
+	state := shard.wal.status.state
+
+	if state == walWriting {
+		// copy from store to wal first,
+		// later do normal update
+		copyIPData(shard.wal, shard, key)
+		ipStore = shard.wal
+	} else if state == walDraining {
+		// try update WAL
+		// if not exists in wal, will do the normal update on the store
+		ipData, exists := ipStoreUpdate(shard.wal, c, key, impact, blackWhite, now)
+		if !exists {
+			ipStore = shard
+		} else {
+			return ipData
+		}
+	} else {
+		// wal inactive
+		ipStore = shard
+	}
+
+	ipData, exists := ipStoreUpdate(ipStore, c, key, impact, blackWhite, now)
+	if exists {
+		return ipData
+	}
+	if ipStore == shard.wal {
+		return ipStoreInsert(ipStore, c, key, impact, blackWhite, now)
+	}
+	return shard.insertKey(c, key, impact, blackWhite, now)
+}
+
+// keyImpact is an impact on one record of a batch logged by logKeys
+type keyImpact struct {
+	key    Prefix
+	impact ImpactAmount
+	result **IPData // set to a copy of the updated record, if not nil
+}
+
+// logKeys adds each impact to its record in the shard as logKey would, in order.
+//
+// Takes a read lock on the wal status, a write lock on the wal unless it is
+// inactive, and a write lock on the shard, or a read lock while the wal is
+// writing, once for the whole batch
+func (shard *ipDataShard) logKeys(c *counting, batch []keyImpact, now time.Time) {
+	shard.wal.status.RLock()
+	defer shard.wal.status.RUnlock()
+
+	state := shard.wal.status.state
+	if state != walInactive {
+		shard.wal.Lock()
+		defer shard.wal.Unlock()
+	}
+	if state == walWriting {
+		// the shard's map must not change while it is written
+		shard.RLock()
+		defer shard.RUnlock()
+	} else {
+		shard.Lock()
+		defer shard.Unlock()
+	}
+
+	for _, entry := range batch {
+		var data *IPData
+		if state != walInactive {
+			data = shard.wal.m[entry.key]
+		}
+		if data == nil && state == walWriting {
+			// copy from store to wal first
+			if src, ok := shard.m[entry.key]; ok {
+				data = src.clone()
+			} else {
+				data = newIPData(c)
+			}
+			shard.wal.m[entry.key] = data
+		}
+		if data == nil {
+			data = shard.m[entry.key]
+		}
+		if data == nil {
+			if shard.maxRecords > 0 {
+				shard.evictOver(shard.maxRecords - 1)
+			}
+			data = newIPData(c)
+			shard.m[entry.key] = data
+		}
+
+		data.impactAtTime(c, entry.impact, BWNop, now)
+		if entry.result != nil {
+			*entry.result = data.clone()
+		}
+	}
+}
+
+// insertKey adds the impact to the key's record in the shard, creating the record
+// if it does not exist. Room is made for a new record if the shard is at its cap
+//
+// Takes a write lock on the shard
+func (shard *ipDataShard) insertKey(c *counting, key Prefix, impact ImpactAmount, blackWhite BWModifier, now time.Time) *IPData {
+	shard.Lock()
+	defer shard.Unlock()
+
+	data, ok := shard.m[key]
+	if !ok {
+		if shard.maxRecords > 0 {
+			shard.evictOver(shard.maxRecords - 1)
+		}
+		data = newIPData(c)
+		shard.m[key] = data
+	}
+
+	data.impactAtTime(c, impact, blackWhite, now)
+	return data.clone()
+}
+
+// forgiveKey subtracts the impacts from a single host or prefix record in the shard.
+//
+// Takes a read lock on the wal status, and the locks of ipStoreForgive
+func (shard *ipDataShard) forgiveKey(c *counting, key Prefix, impacts ImpactAmounts, now time.Time) (*IPData, bool) {
+	shard.wal.status.RLock()
+	defer shard.wal.status.RUnlock()
+
+	var ipStore syncIPDataStore
+	state := shard.wal.status.state
+
+	if state == walWriting {
+		// copy from store to wal first,
+		// later do normal update
+		copyIPData(shard.wal, shard, key)
+		ipStore = shard.wal
+	} else if state == walDraining {
+		// try update WAL
+		// if not exists in wal, will operate on store
+		ipData, exists := ipStoreForgive(shard.wal, c, key, impacts, now)
+		if !exists {
+			ipStore = shard
+		} else {
+			return ipData, true
+		}
+	} else {
+		// wal inactive
+		ipStore = shard
+	}
+
+	return ipStoreForgive(ipStore, c, key, impacts, now)
+}
+
+// lookupKey returns a copy of the record for the key without modifying the shard.
+//
+// Takes a read lock on the wal status, and the locks of ipStoreGet
+func (shard *ipDataShard) lookupKey(key Prefix) (*IPData, bool) {
+	shard.wal.status.RLock()
+	defer shard.wal.status.RUnlock()
+
+	if shard.wal.status.state != walInactive {
+		// records updated during a persist live in the wal until it is drained
+		ipData, exists := ipStoreGet(shard.wal, key)
+		if exists {
+			return ipData, true
+		}
+	}
+	return ipStoreGet(shard, key)
+}
+
+func (shard *ipDataShard) drainWAL() {
+	keys := shard.wal.getIPs()
+	for _, key := range keys {
+		moveIPData(shard, shard.wal, key)
+	}
+}
+
+func (shard *ipDataShard) setWALStatus(state int) {
+	shard.wal.status.Lock()
+	defer shard.wal.status.Unlock()
+
+	shard.wal.status.state = state
+}
+
+// len returns the number of records in the shard, not counting its wal
+//
+// Takes a read lock on the shard
+func (shard *ipDataShard) len() int {
+	shard.RLock()
+	defer shard.RUnlock()
+
+	return len(shard.m)
+}
@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	. "gopkg.in/check.v1"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type ShardS struct{}
+
+var _ = Suite(&ShardS{})
+
+func (s *ShardS) TestShardFor(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 8})
+	c.Assert(len(store.shards), Equals, 8)
+
+	// keys always map to the same shard, and are spread across shards
+	used := make(map[*ipDataShard]bool)
+	for i := 0; i < 1000; i++ {
+		key := IPLong(i).IPAddr().HostPrefix()
+		c.Check(store.shardFor(key), Equals, store.shardFor(key))
+		used[store.shardFor(key)] = true
+	}
+	c.Check(len(used), Equals, 8)
+}
+
+func (s *ShardS) TestDefaultShards(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir()})
+	c.Check(len(store.shards), Equals, DefaultShards)
+}
+
+func (s *ShardS) TestPersistLoadShards(c *C) {
+	dir := c.MkDir()
+	store := newStore(c, Config{DataDir: dir, Shards: 4})
+	for i := 0; i < 100; i++ {
+		store.LogIP(IPLong(i).IPAddr(), ImpactAmount(1), BWNop)
+	}
+	c.Assert(store.Persist(), IsNil)
+
+	// a kdb does not depend on the number of shards which wrote it
+	store = newStore(c, Config{DataDir: dir, Shards: 16})
+	c.Check(store.Len(), Equals, 100)
+	for i := 0; i < 100; i++ {
+		c.Check(getRecord(store, IPLong(i).IPAddr().HostPrefix()), NotNil)
+	}
+}
+
+func (s *ShardS) TestConcurrentLogIPDuringPersist(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), Shards: 4})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				store.LogIP(IPLong(g*500+i).IPAddr(), ImpactAmount(1), BWNop)
+			}
+		}(g)
+	}
+	for i := 0; i < 5; i++ {
+		c.Check(store.Persist(), IsNil)
+	}
+	wg.Wait()
+
+	c.Check(store.Len(), Equals, 2000)
+	c.Check(walLen(store), Equals, 0)
+}
+
+func benchmarkLogNewIPs(b *testing.B, shards int) {
+	store, err := New(Config{DataDir: b.TempDir(), Shards: shards})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ip := IPLong(atomic.AddUint32(&next, 1)).IPAddr()
+			store.LogIP(ip, ImpactAmount(1), BWNop)
+		}
+	})
+}
+
+func BenchmarkLogNewIPs1Shard(b *testing.B)   { benchmarkLogNewIPs(b, 1) }
+func BenchmarkLogNewIPs32Shards(b *testing.B) { benchmarkLogNewIPs(b, 32) }
+
+func benchmarkLogExistingIPs(b *testing.B, shards int) {
+	store, err := New(Config{DataDir: b.TempDir(), Shards: shards})
+	if err != nil {
+		b.Fatal(err)
+	}
+	const numIPs = 1 << 16
+	for i := 0; i < numIPs; i++ {
+		store.LogIP(IPLong(i).IPAddr(), ImpactAmount(1), BWNop)
+	}
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ip := IPLong(atomic.AddUint32(&next, 1) % numIPs).IPAddr()
+			store.LogIP(ip, ImpactAmount(1), BWNop)
+		}
+	})
+}
+
+func BenchmarkLogExistingIPs1Shard(b *testing.B)   { benchmarkLogExistingIPs(b, 1) }
+func BenchmarkLogExistingIPs32Shards(b *testing.B) { benchmarkLogExistingIPs(b, 32) }
+
+// benchmarkLogIPsBatch logs new IPs in batches of the size, from parallel goroutines
+func benchmarkLogIPsBatch(b *testing.B, size int) {
+	store, err := New(Config{DataDir: b.TempDir()})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		batch := make([]IPImpact, 0, size)
+		for pb.Next() {
+			batch = append(batch, IPImpact{IPLong(atomic.AddUint32(&next, 1)).IPAddr(), 1})
+			if len(batch) == size {
+				store.LogIPs(batch)
+				batch = batch[:0]
+			}
+		}
+		store.LogIPs(batch)
+	})
+}
+
+func BenchmarkLogIPsBatch1(b *testing.B)   { benchmarkLogIPsBatch(b, 1) }
+func BenchmarkLogIPsBatch100(b *testing.B) { benchmarkLogIPsBatch(b, 100) }
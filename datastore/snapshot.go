@@ -0,0 +1,176 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotTimeFormat is the UTC time in each snapshot's name, which is kdbFile
+// followed by a dot and the time. Names sort in the order the snapshots were taken
+const snapshotTimeFormat = "20060102T150405.000000000Z"
+
+// Snapshot is a timestamped copy of the kdb, kept in the data dir by Persist
+type Snapshot struct {
+	Name string
+	Path string
+	Time time.Time // when the snapshot was taken
+	Size int64
+}
+
+// ListSnapshots returns the snapshots in the data dir, oldest first
+func ListSnapshots(dataDir string) ([]Snapshot, error) {
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, kdbFile+".") {
+			continue
+		}
+		t, err := time.Parse(snapshotTimeFormat, name[len(kdbFile)+1:])
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{
+			Name: name,
+			Path: filepath.Join(dataDir, name),
+			Time: t,
+			Size: file.Size(),
+		})
+	}
+	sort.Sort(snapshotSlice(snapshots))
+	return snapshots, nil
+}
+
+type snapshotSlice []Snapshot
+
+func (s snapshotSlice) Len() int           { return len(s) }
+func (s snapshotSlice) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+func (s snapshotSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// snapshotsEnabled returns true if Persist keeps snapshots
+func (store *IPDataStore) snapshotsEnabled() bool {
+	return store.snapshots > 0 || store.snapshotMaxAge > 0
+}
+
+// saveSnapshot keeps the kdb as a snapshot taken at now, and then removes the
+// snapshots beyond the store's retention. The snapshot is a hard link to the kdb
+// where the file system allows it, as the kdb is only ever replaced, not rewritten
+func (store *IPDataStore) saveSnapshot(now time.Time) error {
+	name := kdbFile + "." + now.UTC().Format(snapshotTimeFormat)
+	path := filepath.Join(store.dataDir, name)
+	err := os.Link(store.kdbPath(), path)
+	if err != nil {
+		err = copyFile(store.kdbPath(), path)
+		if err != nil {
+			return err
+		}
+	}
+	return store.pruneSnapshots(now)
+}
+
+// pruneSnapshots removes the snapshots older than the store's max age, and the
+// oldest snapshots beyond the number the store keeps
+func (store *IPDataStore) pruneSnapshots(now time.Time) error {
+	snapshots, err := ListSnapshots(store.dataDir)
+	if err != nil {
+		return err
+	}
+
+	keep := len(snapshots)
+	if store.snapshots > 0 && store.snapshots < keep {
+		keep = store.snapshots
+	}
+	for i, snapshot := range snapshots {
+		tooMany := i < len(snapshots)-keep
+		tooOld := store.snapshotMaxAge > 0 && now.Sub(snapshot.Time) > store.snapshotMaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		err = os.Remove(snapshot.Path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreSnapshot replaces the kdb with the named snapshot, which is either
+// the name of a snapshot in the data dir or a path to one. The op log is
+// removed, as its operations happened after the snapshot was taken. Replacing
+// an existing kdb is logged loudly, as a restore left configured repeats on every start
+func (store *IPDataStore) restoreSnapshot(snapshot string) error {
+	path := snapshot
+	if !strings.ContainsRune(snapshot, filepath.Separator) {
+		path = filepath.Join(store.dataDir, snapshot)
+	}
+
+	_, statErr := os.Stat(store.kdbPath())
+	replacing := statErr == nil
+
+	err := store.installKDB(path)
+	if err != nil {
+		return fmt.Errorf("Snapshot %s can't be restored: %s", snapshot, err)
+	}
+
+	if replacing {
+		log.Printf("WARNING: snapshot %s replaced the existing %s, and everything logged since it was taken is discarded. "+
+			"The snapshot is restored again on every start until it is no longer configured", snapshot, kdbFile)
+	}
+
+	log.Printf("Restored %s from snapshot %s, discarding the op log", kdbFile, snapshot)
+	return removeOpLogSegments(store.dataDir, math.MaxUint64)
+}
+
+// installKDB replaces the kdb with a copy of the kdb at path, once the
+// whole of it has been decoded
+func (store *IPDataStore) installKDB(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = NewDecoder(file).DecodeEvery(func(Prefix, *IPData) {})
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := store.kdbPath() + ".part"
+	err = copyFile(path, tmpFilename)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, store.kdbPath())
+}
+
+// copyFile copies the file at src to a new file at dst, and fsyncs it
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	. "gopkg.in/check.v1"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type SnapshotS struct{}
+
+var _ = Suite(&SnapshotS{})
+
+func (s *SnapshotS) TestPersistKeepsSnapshots(c *C) {
+	dir := c.MkDir()
+	ip := IPLong(1).IPAddr()
+	store := newStore(c, Config{DataDir: dir, Snapshots: 2})
+	for i := 0; i < 3; i++ {
+		store.LogIP(ip, ImpactAmount(1), BWNop)
+		c.Assert(store.Persist(), IsNil)
+	}
+
+	snapshots, err := ListSnapshots(dir)
+	c.Assert(err, IsNil)
+	c.Assert(len(snapshots), Equals, 2)
+	c.Check(snapshots[0].Time.Before(snapshots[1].Time), Equals, true)
+
+	// each snapshot keeps the kdb as it was, although the kdb has since been replaced
+	for i, snapshot := range snapshots {
+		file, err := os.Open(snapshot.Path)
+		c.Assert(err, IsNil)
+		m := make(IPDataMap)
+		c.Assert(NewDecoder(file).Decode(&m), IsNil)
+		file.Close()
+		c.Check(m[ip.HostPrefix()].MaxImpacts[0], Equals, ImpactAmount(2+i))
+	}
+}
+
+func (s *SnapshotS) TestNoSnapshotsByDefault(c *C) {
+	dir := c.MkDir()
+	store := newStore(c, Config{DataDir: dir})
+	c.Assert(store.Persist(), IsNil)
+
+	snapshots, err := ListSnapshots(dir)
+	c.Assert(err, IsNil)
+	c.Check(len(snapshots), Equals, 0)
+}
+
+func (s *SnapshotS) TestPruneSnapshotsByAge(c *C) {
+	dir := c.MkDir()
+	store := newStore(c, Config{DataDir: dir, SnapshotMaxAge: time.Hour})
+	c.Assert(store.Persist(), IsNil)
+
+	now := time.Now()
+	c.Assert(store.pruneSnapshots(now.Add(30*time.Minute)), IsNil)
+	snapshots, _ := ListSnapshots(dir)
+	c.Check(len(snapshots), Equals, 1)
+
+	c.Assert(store.pruneSnapshots(now.Add(2*time.Hour)), IsNil)
+	snapshots, _ = ListSnapshots(dir)
+	c.Check(len(snapshots), Equals, 0)
+	// the kdb itself is never pruned
+	_, err := os.Stat(filepath.Join(dir, kdbFile))
+	c.Check(err, IsNil)
+}
+
+func (s *SnapshotS) TestListSnapshotsIgnoresOtherFiles(c *C) {
+	dir := c.MkDir()
+	for _, name := range []string{kdbFile, kdbFile + ".part", kdbFile + ".old", opLogFile + ".1"} {
+		file, err := os.Create(filepath.Join(dir, name))
+		c.Assert(err, IsNil)
+		file.Close()
+	}
+	snapshots, err := ListSnapshots(dir)
+	c.Assert(err, IsNil)
+	c.Check(len(snapshots), Equals, 0)
+}
+
+func (s *SnapshotS) TestRestoreSnapshot(c *C) {
+	dir := c.MkDir()
+	ip := IPLong(1).IPAddr()
+	config := Config{DataDir: dir, Snapshots: 5, OpLog: true}
+	store := newStore(c, config)
+	store.LogIP(ip, ImpactAmount(1), BWNop)
+	c.Assert(store.Persist(), IsNil)
+	store.LogIP(ip, ImpactAmount(1), BWBlacklist)
+	c.Assert(store.Persist(), IsNil)
+	// only in the op log
+	store.LogIP(IPLong(2).IPAddr(), ImpactAmount(1), BWNop)
+	c.Assert(store.Close(), IsNil)
+
+	snapshots, err := ListSnapshots(dir)
+	c.Assert(err, IsNil)
+	c.Assert(len(snapshots), Equals, 2)
+
+	config.Snapshot = snapshots[0].Name
+	store = newStore(c, config)
+	c.Check(store.Len(), Equals, 1)
+	data := getRecord(store, ip.HostPrefix())
+	c.Check(data.MaxImpacts[0], Equals, ImpactAmount(1))
+	c.Check(data.BlackWhite, Equals, byte(0))
+	c.Assert(store.Close(), IsNil)
+
+	// the restored kdb is loaded on the next startup
+	config.Snapshot = ""
+	store = newStore(c, config)
+	c.Check(store.Len(), Equals, 1)
+	c.Check(getRecord(store, ip.HostPrefix()).MaxImpacts[0], Equals, ImpactAmount(1))
+	c.Assert(store.Close(), IsNil)
+}
@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// sweepBatchSize is the number of idle records deleted per write lock on a shard
+const sweepBatchSize = 1000
+
+// Stats holds counters about the store's activity
+type Stats struct {
+	IdleEvictions uint64 // records removed by the idle sweeper
+	CapEvictions  uint64 // records removed to stay under MaxRecords or MaxBytes
+}
+
+// Stats returns a snapshot of the store's counters
+func (store *IPDataStore) Stats() Stats {
+	var capEvictions uint64
+	for _, shard := range store.shards {
+		capEvictions += atomic.LoadUint64(&shard.evictions)
+	}
+	return Stats{
+		IdleEvictions: atomic.LoadUint64(&store.stats.IdleEvictions),
+		CapEvictions:  capEvictions,
+	}
+}
+
+// SweepEvery starts a background goroutine which removes idle records
+// every interval. It does nothing if the interval or the store's TTL is 0
+func (store *IPDataStore) SweepEvery(interval time.Duration) {
+	if interval == 0 || store.ttl == 0 {
+		return
+	}
+
+	go func() {
+		for {
+			timer := time.NewTimer(interval)
+			<-timer.C
+			evicted := store.SweepIdle()
+			if evicted > 0 {
+				log.Printf("Evicted %d idle records", evicted)
+			}
+		}
+	}()
+}
+
+// SweepIdle removes every host and prefix record which has not been logged or
+// forgiven for longer than the store's TTL, and returns how many were removed.
+// Whitelisted and blacklisted records are kept unless the store evicts listed records.
+//
+// Records are only removed while the wal is inactive. If a Persist begins during
+// the sweep, the sweep stops early and the remaining records wait for the next one
+func (store *IPDataStore) SweepIdle() int {
+	return store.sweepIdleAtTime(time.Now())
+}
+
+// sweepIdleAtTime performs the real work of SweepIdle, and takes the current time as
+// a parameter to aid in testing.
+func (store *IPDataStore) sweepIdleAtTime(now time.Time) int {
+	if store.ttl == 0 {
+		return 0
+	}
+
+	evicted := 0
+	for _, shard := range store.shards {
+		n, ok := store.sweepShard(shard, now)
+		evicted += n
+		if !ok {
+			break
+		}
+	}
+
+	atomic.AddUint64(&store.stats.IdleEvictions, uint64(evicted))
+	return evicted
+}
+
+// sweepShard removes the shard's idle records. It returns false if
+// the sweep was stopped early by a Persist
+func (store *IPDataStore) sweepShard(shard *ipDataShard, now time.Time) (evicted int, ok bool) {
+	// find candidates under a read lock, so LogIP of existing IPs is not blocked
+	var candidates []Prefix
+	shard.RLock()
+	for key, data := range shard.m {
+		if store.isIdle(data, now) {
+			candidates = append(candidates, key)
+		}
+	}
+	shard.RUnlock()
+
+	for start := 0; start < len(candidates); start += sweepBatchSize {
+		end := start + sweepBatchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		n, ok := store.evictIdle(shard, candidates[start:end], now)
+		evicted += n
+		if !ok {
+			return evicted, false
+		}
+	}
+	return evicted, true
+}
+
+// evictIdle deletes the keys which are still idle from the shard. It returns
+// false without deleting anything if the shard's wal is not inactive
+//
+// Takes a read lock on the wal status and a write lock on the shard
+func (store *IPDataStore) evictIdle(shard *ipDataShard, keys []Prefix, now time.Time) (evicted int, ok bool) {
+	shard.wal.status.RLock()
+	defer shard.wal.status.RUnlock()
+
+	if shard.wal.status.state != walInactive {
+		return 0, false
+	}
+
+	shard.Lock()
+	defer shard.Unlock()
+
+	for _, key := range keys {
+		// the record may have been touched since it was found
+		data, exists := shard.m[key]
+		if exists && store.isIdle(data, now) {
+			delete(shard.m, key)
+			evicted++
+		}
+	}
+	return evicted, true
+}
+
+// isIdle returns true if the record may be evicted by the sweeper
+//
+// Takes a read lock on the IPData
+func (store *IPDataStore) isIdle(data *IPData, now time.Time) bool {
+	data.Mutex.RLock()
+	defer data.Mutex.RUnlock()
+
+	if data.BlackWhite != 0 && !store.evictListed {
+		return false
+	}
+	return now.Sub(time.Unix(data.lastActive(), 0)) > store.ttl
+}
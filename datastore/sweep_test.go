@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type SweepS struct{}
+
+var _ = Suite(&SweepS{})
+
+func (s *SweepS) TestSweepIdle(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), TTL: time.Hour, Prefixes4: []int{24}})
+	idle := IPLong(1).IPAddr()
+	listed := IPLong(2).IPAddr()
+	store.LogIP(idle, ImpactAmount(1), BWNop)
+	store.LogIP(listed, ImpactAmount(1), BWBlacklist)
+
+	// nothing is idle yet
+	c.Check(store.sweepIdleAtTime(time.Now()), Equals, 0)
+
+	// the idle host and the shared prefix are removed, the blacklisted host is kept
+	evicted := store.sweepIdleAtTime(time.Now().Add(2 * time.Hour))
+	c.Check(evicted, Equals, 2)
+	c.Check(store.Len(), Equals, 1)
+	exists := getRecord(store, listed.HostPrefix()) != nil
+	c.Check(exists, Equals, true)
+	c.Check(store.Stats().IdleEvictions, Equals, uint64(2))
+}
+
+func (s *SweepS) TestSweepIdleEvictListed(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), TTL: time.Hour, EvictListed: true})
+	store.LogIP(IPLong(1).IPAddr(), ImpactAmount(1), BWWhitelist)
+
+	c.Check(store.sweepIdleAtTime(time.Now().Add(2*time.Hour)), Equals, 1)
+	c.Check(store.Len(), Equals, 0)
+}
+
+func (s *SweepS) TestSweepIdleDuringPersist(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir(), TTL: time.Hour})
+	store.LogIP(IPLong(1).IPAddr(), ImpactAmount(1), BWNop)
+
+	// records are left alone while the wal is active
+	store.setWALStatus(walWriting)
+	c.Check(store.sweepIdleAtTime(time.Now().Add(2*time.Hour)), Equals, 0)
+	store.setWALStatus(walDraining)
+	c.Check(store.sweepIdleAtTime(time.Now().Add(2*time.Hour)), Equals, 0)
+	c.Check(store.Len(), Equals, 1)
+
+	store.setWALStatus(walInactive)
+	c.Check(store.sweepIdleAtTime(time.Now().Add(2*time.Hour)), Equals, 1)
+}
+
+func (s *SweepS) TestSweepIdleDisabled(c *C) {
+	store := newStore(c, Config{DataDir: c.MkDir()})
+	store.LogIP(IPLong(1).IPAddr(), ImpactAmount(1), BWNop)
+
+	c.Check(store.sweepIdleAtTime(time.Now().Add(24*365*time.Hour)), Equals, 0)
+}
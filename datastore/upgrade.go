@@ -0,0 +1,47 @@
+package datastore
+
+import (
+	"io"
+)
+
+// UpgradeKDB decodes the kdb from r and writes it to w in the current encoding
+// version, keeping its windows, counter type, half-life and compression. It
+// returns the version that was read and the version that was written
+func UpgradeKDB(r io.Reader, w io.Writer) (from, to uint32, err error) {
+	return upgradeKDB(r, w, nil)
+}
+
+// UpgradeKDBCompressed is UpgradeKDB, but writes w with the given compression
+func UpgradeKDBCompressed(r io.Reader, w io.Writer, compression Compression) (from, to uint32, err error) {
+	return upgradeKDB(r, w, &compression)
+}
+
+// upgradeKDB upgrades the kdb from r to w, keeping its compression if compression is nil
+func upgradeKDB(r io.Reader, w io.Writer, compression *Compression) (from, to uint32, err error) {
+	dec := NewDecoder(r)
+	err = dec.ReadHeader()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	shard := newIPDataShard(0, EvictLRU)
+	err = dec.DecodeEvery(func(key Prefix, ipData *IPData) {
+		shard.m[key] = ipData
+	})
+	if err != nil {
+		return dec.Version(), 0, err
+	}
+
+	store := &IPDataStore{counting: dec.counting, shards: []*ipDataShard{shard}}
+	enc := newEncoder(w)
+	enc.logSegment = dec.LogSegment()
+	enc.compression = dec.Compression()
+	if compression != nil {
+		enc.compression = *compression
+	}
+	err = enc.encode(store)
+	if err != nil {
+		return dec.Version(), 0, err
+	}
+	return dec.Version(), encodingVersion, nil
+}
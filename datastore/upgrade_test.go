@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type UpgradeS struct{}
+
+var _ = Suite(&UpgradeS{})
+
+// v1KDB returns a version 1 kdb with a single record for 10.0.0.1
+func v1KDB() []byte {
+	buf := make([]byte, 4+4+39)
+	binary.LittleEndian.PutUint32(buf[0:4], 1)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(0x0A000001)) // 10.0.0.1
+	binary.LittleEndian.PutUint32(buf[20:24], 9)                // MaxImpacts[0]
+	return buf
+}
+
+func (s *UpgradeS) TestUpgradeKDB(c *C) {
+	var out bytes.Buffer
+	from, to, err := UpgradeKDB(bytes.NewReader(v1KDB()), &out)
+	c.Assert(err, IsNil)
+	c.Check(from, Equals, uint32(1))
+	c.Check(to, Equals, encodingVersion)
+
+	dec := NewDecoder(&out)
+	m := make(IPDataMap)
+	c.Assert(dec.Decode(&m), IsNil)
+	c.Check(dec.Version(), Equals, encodingVersion)
+	c.Check(dec.Windows(), DeepEquals, DefaultWindows)
+	c.Assert(len(m), Equals, 1)
+	c.Check(m[IPLong(0x0A000001).IPAddr().HostPrefix()].MaxImpacts[0], Equals, ImpactAmount(9))
+}
+
+func (s *UpgradeS) TestUpgradeKDBCompression(c *C) {
+	var gzipped bytes.Buffer
+	_, _, err := UpgradeKDBCompressed(bytes.NewReader(v1KDB()), &gzipped, CompressGzip)
+	c.Assert(err, IsNil)
+
+	// upgrading keeps the input's compression
+	var out bytes.Buffer
+	_, _, err = UpgradeKDB(bytes.NewReader(gzipped.Bytes()), &out)
+	c.Assert(err, IsNil)
+	dec := NewDecoder(&out)
+	m := make(IPDataMap)
+	c.Assert(dec.Decode(&m), IsNil)
+	c.Check(dec.Compression(), Equals, CompressGzip)
+	c.Check(len(m), Equals, 1)
+
+	out.Reset()
+	_, _, err = UpgradeKDBCompressed(bytes.NewReader(gzipped.Bytes()), &out, CompressNone)
+	c.Assert(err, IsNil)
+	dec = NewDecoder(&out)
+	c.Assert(dec.Decode(&m), IsNil)
+	c.Check(dec.Compression(), Equals, CompressNone)
+}
+
+func (s *UpgradeS) TestUpgradeKDBCorrupted(c *C) {
+	kdb := v1KDB()
+	_, _, err := UpgradeKDB(bytes.NewReader(kdb[0:len(kdb)-1]), ioutil.Discard)
+	_, ok := err.(*CorruptionError)
+	c.Check(ok, Equals, true)
+}
+
+func (s *UpgradeS) TestPersistRewritesOldVersion(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, kdbFile)
+	c.Assert(ioutil.WriteFile(path, v1KDB(), 0644), IsNil)
+
+	store := newStore(c, Config{DataDir: dir})
+	c.Check(store.Len(), Equals, 1)
+	c.Assert(store.Persist(), IsNil)
+
+	file, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer file.Close()
+	dec := NewDecoder(file)
+	c.Assert(dec.ReadHeader(), IsNil)
+	c.Check(dec.Version(), Equals, encodingVersion)
+	c.Check(dec.RecordCount(), Equals, uint64(1))
+}
+
+func (s *UpgradeS) TestEveryVersionHasFormat(c *C) {
+	for v := uint32(1); v <= encodingVersion; v++ {
+		_, ok := kdbFormats[v]
+		c.Check(ok, Equals, true, Commentf("version %d", v))
+	}
+}
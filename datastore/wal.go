@@ -29,11 +29,11 @@ func newIPWAL() *ipWAL {
 	return wal
 }
 
-func (wal *ipWAL) getIPs() []IPLong {
+func (wal *ipWAL) getIPs() []Prefix {
 	wal.RLock()
 	defer wal.RUnlock()
 
-	var keys []IPLong
+	var keys []Prefix
 	for k := range wal.m {
 		keys = append(keys, k)
 	}
@@ -0,0 +1,212 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Windows is an ordered list of the time window durations that impacts
+// are counted over. Every IPData holds one cur, max and start time per window
+type Windows []time.Duration
+
+// DefaultWindows are the 5 minute, 1 hour and 1 day windows
+var DefaultWindows = Windows{5 * time.Minute, time.Hour, 24 * time.Hour}
+
+// maxWindows is the largest number of windows a kdb header can hold
+const maxWindows = 255
+
+// CounterType selects how impacts are counted within a time window
+type CounterType byte
+
+const (
+	// CounterFixed counts impacts in tumbling windows which start at the first
+	// impact after the previous window has ended, and then reset to zero
+	CounterFixed CounterType = iota
+	// CounterSliding counts impacts in a ring of fixed width buckets per window,
+	// giving the impact over the last window duration at bucket granularity
+	CounterSliding
+)
+
+// DefaultBuckets is the number of buckets per window used by CounterSliding
+const DefaultBuckets = 10
+
+// maxBuckets is the largest number of buckets per window a kdb header can hold
+const maxBuckets = 255
+
+// ParseCounterType parses "fixed" or "sliding"
+func ParseCounterType(s string) (CounterType, error) {
+	switch s {
+	case "fixed":
+		return CounterFixed, nil
+	case "sliding":
+		return CounterSliding, nil
+	default:
+		return CounterFixed, fmt.Errorf("Unknown counter type %q", s)
+	}
+}
+
+func (t CounterType) String() string {
+	switch t {
+	case CounterFixed:
+		return "fixed"
+	case CounterSliding:
+		return "sliding"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(t))
+	}
+}
+
+// DefaultHalfLife is the time it takes for an IP's score to decay by half
+const DefaultHalfLife = time.Hour
+
+// counting describes the time windows a store counts impacts over, and how
+type counting struct {
+	windows  Windows
+	counter  CounterType
+	buckets  int           // buckets per window, only used by CounterSliding
+	halfLife time.Duration // half-life of the decaying score
+}
+
+func (c *counting) validate() error {
+	err := c.windows.validate()
+	if err != nil {
+		return err
+	}
+	if c.halfLife < time.Second || c.halfLife%time.Second != 0 || c.halfLife/time.Second > 1<<32-1 {
+		return fmt.Errorf("Half-life %s must be a whole number of seconds", c.halfLife)
+	}
+	switch c.counter {
+	case CounterFixed:
+		return nil
+	case CounterSliding:
+		if c.buckets < 1 || c.buckets > maxBuckets {
+			return fmt.Errorf("Buckets must be between 1 and %d", maxBuckets)
+		}
+		for _, d := range c.windows {
+			if int64(d/time.Second)%int64(c.buckets) != 0 {
+				return fmt.Errorf("Window %s cannot be split into %d whole second buckets", windowName(d), c.buckets)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown counter type %d", byte(c.counter))
+	}
+}
+
+// numBuckets returns the total number of buckets an IPData holds across all windows
+func (c *counting) numBuckets() int {
+	if c.counter != CounterSliding {
+		return 0
+	}
+	return len(c.windows) * c.buckets
+}
+
+func (c *counting) equal(other *counting) bool {
+	return c.windows.equal(other.windows) && c.numBuckets() == other.numBuckets()
+}
+
+func (c *counting) String() string {
+	if c.counter == CounterSliding {
+		return fmt.Sprintf("%s %s/%d", c.counter, c.windows, c.buckets)
+	}
+	return fmt.Sprintf("%s %s", c.counter, c.windows)
+}
+
+// ParseWindows parses a comma separated list of window durations, e.g. "1m,5m,1h,1d,7d".
+// Durations are in time.ParseDuration format, with an additional "d" suffix for days
+func ParseWindows(s string) (Windows, error) {
+	var windows Windows
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var d time.Duration
+		var err error
+		if strings.HasSuffix(part, "d") {
+			var days int
+			days, err = strconv.Atoi(strings.TrimSuffix(part, "d"))
+			d = time.Duration(days) * 24 * time.Hour
+		} else {
+			d, err = time.ParseDuration(part)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid window %q: %s", part, err)
+		}
+		windows = append(windows, d)
+	}
+
+	err := windows.validate()
+	if err != nil {
+		return nil, err
+	}
+	return windows, nil
+}
+
+// validate checks that the windows can be stored in a kdb header
+func (windows Windows) validate() error {
+	if len(windows) == 0 {
+		return errors.New("No windows specified")
+	}
+	if len(windows) > maxWindows {
+		return fmt.Errorf("Too many windows, at most %d are allowed", maxWindows)
+	}
+	for _, d := range windows {
+		if d < time.Second || d%time.Second != 0 {
+			return fmt.Errorf("Window %s must be a whole number of seconds", d)
+		}
+		if d/time.Second > 1<<32-1 {
+			return fmt.Errorf("Window %s is too long", d)
+		}
+	}
+	return nil
+}
+
+// equal returns true if both lists hold the same durations in the same order
+func (windows Windows) equal(other Windows) bool {
+	if len(windows) != len(other) {
+		return false
+	}
+	for i := range windows {
+		if windows[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// index returns the position of the window with duration d, or -1
+func (windows Windows) index(d time.Duration) int {
+	for i, w := range windows {
+		if w == d {
+			return i
+		}
+	}
+	return -1
+}
+
+// Names returns a short name for every window, e.g. "5m", "1h", "7d"
+func (windows Windows) Names() []string {
+	names := make([]string, len(windows))
+	for i, d := range windows {
+		names[i] = windowName(d)
+	}
+	return names
+}
+
+func (windows Windows) String() string {
+	return strings.Join(windows.Names(), ",")
+}
+
+func windowName(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
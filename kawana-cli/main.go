@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"encoding/csv"
 	"fmt"
 	"github.com/chriskite/kawana/datastore"
 	"github.com/chriskite/kawana/kawana-cli/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"io"
 	"os"
+	"text/tabwriter"
+	"time"
 )
 
 func check(err error) {
@@ -15,40 +19,148 @@ func check(err error) {
 	}
 }
 
+// openKDB opens the kdb at path, decrypting it with the keys in the
+// --keyFile if it is an encrypted backup. It returns the keys, which are
+// nil without a --keyFile, and whether the kdb was encrypted
+func openKDB(c *cli.Context, path string) (*os.File, io.Reader, *datastore.EncryptionKeys, bool) {
+	var keys *datastore.EncryptionKeys
+	if c.String("keyFile") != "" {
+		var err error
+		keys, err = datastore.LoadKeyFile(c.String("keyFile"))
+		check(err)
+	}
+
+	file, err := os.Open(path)
+	check(err)
+	r := bufio.NewReader(file)
+	encrypted := datastore.IsEncrypted(r)
+	kdb, err := datastore.OpenKDB(r, keys)
+	if err != nil {
+		file.Close()
+		check(err)
+	}
+	return file, kdb, keys, encrypted
+}
+
 func kdbExport(c *cli.Context) {
 	input := c.Args().First()
 	output := c.String("output")
 
 	if input == "" {
-		fmt.Println("kdb-export: No input filename provided\n")
+		fmt.Print("kdb-export: No input filename provided\n\n")
 		cli.ShowAppHelp(c)
 		os.Exit(1)
 	}
 
-	inputFile, err := os.Open(input)
-	check(err)
+	inputFile, kdb, _, _ := openKDB(c, input)
 	defer inputFile.Close()
 
 	outputFile, err := os.Create(output)
 	check(err)
 	defer outputFile.Close()
 
-	dec := datastore.NewDecoder(inputFile)
+	dec := datastore.NewDecoder(kdb)
+	err = dec.ReadHeader()
+	check(err)
 
 	writer := csv.NewWriter(outputFile)
-	writer.Write(append([]string{"IP"}, datastore.IPDataHeaders()...))
+	err = writer.Write(append([]string{"IP"}, datastore.IPDataHeaders(dec.Windows())...))
 	check(err)
 
-	dec.DecodeEvery(func(ip datastore.IPLong, ipData *datastore.IPData) {
-		record := append([]string{ip.String()}, ipData.Strings()...)
+	err = dec.DecodeEvery(func(key datastore.Prefix, ipData *datastore.IPData) {
+		record := append([]string{key.String()}, ipData.Strings()...)
 		err := writer.Write(record)
 		check(err)
 	})
 	writer.Flush()
+	check(err)
 
 	fmt.Println("Exported contents of " + input + " to " + output)
 }
 
+func kdbUpgrade(c *cli.Context) {
+	input := c.Args().First()
+	output := c.String("output")
+
+	if input == "" {
+		fmt.Print("kdb-upgrade: No input filename provided\n\n")
+		cli.ShowAppHelp(c)
+		os.Exit(1)
+	}
+	if output == "" {
+		output = input
+	}
+	var compression datastore.Compression
+	if c.String("compression") != "" {
+		var err error
+		compression, err = datastore.ParseCompression(c.String("compression"))
+		check(err)
+	}
+
+	inputFile, kdb, keys, encrypted := openKDB(c, input)
+	defer inputFile.Close()
+
+	// write to a temp file, so a failed upgrade never replaces the input
+	tmpOutput := output + ".part"
+	outputFile, err := os.Create(tmpOutput)
+	check(err)
+	defer outputFile.Close()
+
+	// an encrypted input stays encrypted, unless plaintext is asked for
+	var out io.Writer = outputFile
+	var encryptWriter io.WriteCloser
+	if encrypted && !c.Bool("plaintext") {
+		encryptWriter, err = keys.NewEncryptWriter(outputFile)
+		check(err)
+		out = encryptWriter
+	}
+
+	var from, to uint32
+	if c.String("compression") == "" {
+		from, to, err = datastore.UpgradeKDB(kdb, out)
+	} else {
+		from, to, err = datastore.UpgradeKDBCompressed(kdb, out, compression)
+	}
+	if err == nil && encryptWriter != nil {
+		err = encryptWriter.Close()
+	}
+	if err != nil {
+		os.Remove(tmpOutput)
+		check(err)
+	}
+	check(outputFile.Sync())
+	check(os.Rename(tmpOutput, output))
+
+	fmt.Printf("Upgraded %s from version %d to version %d in %s\n", input, from, to, output)
+}
+
+func listSnapshots(c *cli.Context) {
+	dataDir := c.Args().First()
+	if dataDir == "" {
+		dataDir = "/var/lib/kawana"
+	}
+
+	snapshots, err := datastore.ListSnapshots(dataDir)
+	check(err)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTAKEN\tSIZE\tVERSION\tRECORDS\tCOMPRESSION")
+	for _, snapshot := range snapshots {
+		taken := snapshot.Time.Local().Format(time.RFC3339)
+		file, err := os.Open(snapshot.Path)
+		check(err)
+		dec := datastore.NewDecoder(file)
+		err = dec.ReadHeader()
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%s\t%d\tunreadable: %s\t\t\n", snapshot.Name, taken, snapshot.Size, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", snapshot.Name, taken, snapshot.Size, dec.Version(), dec.RecordCount(), dec.Compression())
+	}
+	check(w.Flush())
+}
+
 func main() {
 	cli.AppHelpTemplate = `VERSION: {{.Version}}
 
@@ -76,8 +188,44 @@ GLOBAL OPTIONS:
 					Value: "kawana.csv",
 					Usage: "output csv filename",
 				},
+				cli.StringFlag{
+					Name:  "keyFile",
+					Value: "",
+					Usage: "key file to decrypt an encrypted backup with",
+				},
 			},
 		},
+		{
+			Name:   "kdb-upgrade",
+			Usage:  "rewrite a .kdb file of any older version in the current version",
+			Action: kdbUpgrade,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output",
+					Value: "",
+					Usage: "output kdb filename. the input is replaced if empty",
+				},
+				cli.StringFlag{
+					Name:  "compression",
+					Value: "",
+					Usage: "compression of the output kdb: none or gzip. the input's compression is kept if empty",
+				},
+				cli.StringFlag{
+					Name:  "keyFile",
+					Value: "",
+					Usage: "key file to decrypt an encrypted backup with. the output is encrypted with the file's current key",
+				},
+				cli.BoolFlag{
+					Name:  "plaintext",
+					Usage: "write the output of an encrypted backup unencrypted",
+				},
+			},
+		},
+		{
+			Name:   "snapshots",
+			Usage:  "list the kdb snapshots in a data directory, oldest first. defaults to /var/lib/kawana",
+			Action: listSnapshots,
+		},
 	}
 
 	app.Run(os.Args)
@@ -1,76 +1,304 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
-	"github.com/chriskite/kawana/kawana-server/Godeps/_workspace/src/github.com/rlmcpherson/s3gof3r"
+	"github.com/chriskite/kawana/datastore"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type options struct {
 	port            int
 	dataDir         string
+	backendType     string
+	backupDir       string
 	s3Bucket        string
+	s3Endpoint      string
+	s3Region        string
+	s3PathStyle     bool
+	backup          datastore.BackupConfig
+	backupKeyFile   string // loaded into backup.Keys
 	persistInterval int
 	backupInterval  int
+	windows         datastore.Windows
+	counter         datastore.CounterType
+	buckets         int
+	halfLife        time.Duration
+	prefixes4       []int
+	prefixes6       []int
+	ttl             time.Duration
+	sweepInterval   time.Duration
+	evictListed     bool
+	shards          int
+	maxRecords      int
+	maxBytes        int64
+	eviction        datastore.EvictionPolicy
+	opLog           bool
+	opLogSync       datastore.SyncPolicy
+	compression     datastore.Compression
+	snapshots       int
+	snapshotMaxAge  time.Duration
+	snapshot        string
+	restore         bool
+	recovery        datastore.RecoveryPolicy
+	shutdownTimeout time.Duration
+	idleTimeout     time.Duration
+	legacyConns     bool
+	shutdownBackup  bool
+	backend         datastore.Backend // built from the backend options by newBackend
 }
 
 func (o options) String() string {
 	s := ""
 	s += fmt.Sprintf("port: %d, ", o.port)
 	s += fmt.Sprintf("dataDir: %s, ", o.dataDir)
+	s += fmt.Sprintf("backend: %s, ", o.backendType)
+	s += fmt.Sprintf("backupDir: %s, ", o.backupDir)
 	s += fmt.Sprintf("s3Bucket: %s, ", o.s3Bucket)
+	s += fmt.Sprintf("s3Endpoint: %s, ", o.s3Endpoint)
+	s += fmt.Sprintf("s3Region: %s, ", o.s3Region)
+	s += fmt.Sprintf("s3PathStyle: %t, ", o.s3PathStyle)
+	s += fmt.Sprintf("backupPrefix: %s, ", o.backup.Prefix)
+	s += fmt.Sprintf("backupHost: %s, ", o.backup.Host)
+	s += fmt.Sprintf("backupKeep: %d, ", o.backup.Keep)
+	s += fmt.Sprintf("backupMaxAge: %s, ", o.backup.MaxAge)
+	s += fmt.Sprintf("backupKeyFile: %s, ", o.backupKeyFile)
 	s += fmt.Sprintf("persistInterval: %d, ", o.persistInterval)
 	s += fmt.Sprintf("backupInterval: %d, ", o.backupInterval)
+	s += fmt.Sprintf("windows: %s, ", o.windows)
+	s += fmt.Sprintf("counter: %s, ", o.counter)
+	s += fmt.Sprintf("buckets: %d, ", o.buckets)
+	s += fmt.Sprintf("halfLife: %s, ", o.halfLife)
+	s += fmt.Sprintf("prefixes4: %v, ", o.prefixes4)
+	s += fmt.Sprintf("prefixes6: %v, ", o.prefixes6)
+	s += fmt.Sprintf("ttl: %s, ", o.ttl)
+	s += fmt.Sprintf("sweepInterval: %s, ", o.sweepInterval)
+	s += fmt.Sprintf("evictListed: %t, ", o.evictListed)
+	s += fmt.Sprintf("shards: %d, ", o.shards)
+	s += fmt.Sprintf("maxRecords: %d, ", o.maxRecords)
+	s += fmt.Sprintf("maxBytes: %d, ", o.maxBytes)
+	s += fmt.Sprintf("eviction: %s, ", o.eviction)
+	s += fmt.Sprintf("opLog: %t, ", o.opLog)
+	s += fmt.Sprintf("opLogSync: %s, ", o.opLogSync)
+	s += fmt.Sprintf("compression: %s, ", o.compression)
+	s += fmt.Sprintf("snapshots: %d, ", o.snapshots)
+	s += fmt.Sprintf("snapshotMaxAge: %s, ", o.snapshotMaxAge)
+	s += fmt.Sprintf("snapshot: %s, ", o.snapshot)
+	s += fmt.Sprintf("restore: %t, ", o.restore)
+	s += fmt.Sprintf("recovery: %s, ", o.recovery)
+	s += fmt.Sprintf("shutdownTimeout: %s, ", o.shutdownTimeout)
+	s += fmt.Sprintf("idleTimeout: %s, ", o.idleTimeout)
+	s += fmt.Sprintf("legacyConns: %t, ", o.legacyConns)
+	s += fmt.Sprintf("shutdownBackup: %t, ", o.shutdownBackup)
 	return s
 }
 
 func main() {
 	port := flag.Int("port", 9291, "port number")
 	dataDir := flag.String("dataDir", "/var/lib/kawana", "data directory")
+	backendType := flag.String("backend", "s3", "where backups are stored: s3 or dir")
+	backupDir := flag.String("backupDir", "", "directory for backups with -backend dir, e.g. an NFS mount")
 	s3Bucket := flag.String("s3Bucket", "", "S3 bucket for backup")
+	s3Endpoint := flag.String("s3Endpoint", "", "host[:port] of an S3-compatible service, optionally with http://. defaults to AWS")
+	s3Region := flag.String("s3Region", "", "AWS region of the S3 bucket, used for the default endpoint. only regions which accept SigV2 signatures work, which excludes every region launched since 2014")
+	backupPrefix := flag.String("backupPrefix", "", "key prefix of backups in the backend")
+	backupHost := flag.String("backupHost", "", "host name that backups are stored and restored under. defaults to the hostname")
+	backupKeep := flag.Int("backupKeep", 0, "number of backups to keep in the backend. 0 to keep all unless -backupMaxAge is set")
+	backupMaxAge := flag.Duration("backupMaxAge", 0, "remove backups older than this from the backend, e.g. 720h. 0 to disable")
+	backupKeyFile := flag.String("backupKeyFile", "", "file of AES-256 keys to encrypt backups with, one \"id hexkey\" per line, current key first")
+	s3PathStyle := flag.Bool("s3PathStyle", false, "address the bucket in the request path, as MinIO and Ceph need")
 	persistInterval := flag.Int("persist", 300, "persistence interval in seconds. 0 to disable")
 	backupInterval := flag.Int("backup", 0, "backup interval in seconds. 0 to disable")
+	windows := flag.String("windows", datastore.DefaultWindows.String(), "comma separated impact time windows, e.g. 1m,5m,1h,1d,7d")
+	counter := flag.String("counter", "fixed", "impact counter type: fixed or sliding")
+	buckets := flag.Int("buckets", datastore.DefaultBuckets, "buckets per window for the sliding counter")
+	halfLife := flag.Duration("halfLife", datastore.DefaultHalfLife, "half-life of each IP's decaying score")
+	prefixes4 := flag.String("prefixes4", "", "comma separated ipv4 prefix lengths to aggregate impacts into, e.g. 24,16")
+	prefixes6 := flag.String("prefixes6", "", "comma separated ipv6 prefix lengths to aggregate impacts into, e.g. 64")
+	ttl := flag.Duration("ttl", 0, "remove records idle for longer than this. 0 to disable")
+	sweepInterval := flag.Duration("sweep", time.Minute, "interval between idle record sweeps")
+	evictListed := flag.Bool("evictListed", false, "allow idle whitelisted and blacklisted records to be removed")
+	shards := flag.Int("shards", datastore.DefaultShards, "number of independently locked partitions of the store")
+	maxRecords := flag.Int("maxRecords", 0, "most records to keep before evicting, split evenly across the shards and rounded down. 0 for no cap")
+	maxBytes := flag.Int64("maxBytes", 0, "most estimated bytes of records to keep before evicting. 0 for no cap")
+	eviction := flag.String("eviction", "lru", "which records to evict when a cap is reached: lru or lfu")
+	opLog := flag.Bool("oplog", false, "append every operation to a log on disk, replayed on startup")
+	opLogSync := flag.String("oplogSync", "second", "how often the op log is fsynced: always, second or never")
+	compression := flag.String("compression", "none", "compression of persisted kdbs: none or gzip")
+	snapshots := flag.Int("snapshots", 0, "number of timestamped kdb snapshots to keep in the data directory")
+	snapshotMaxAge := flag.Duration("snapshotMaxAge", 0, "remove kdb snapshots older than this. 0 to keep them until -snapshots is reached")
+	snapshot := flag.String("snapshot", "", "snapshot to restore on startup, discarding newer data. see kawana-cli snapshots. only pass it for one start, as it is restored again on every start it is given for")
+	restore := flag.Bool("restore", false, "download the kdb from the configured backup backend on startup if there is no local kdb")
+	recovery := flag.String("recovery", "refuse", "what to do on startup if the kdb is corrupted: refuse, partial (keep the records decoded before the corruption) or fallback (to the newest good snapshot, then the backup if a backend is configured)")
+	idleTimeout := flag.Duration("idleTimeout", time.Minute, "close connections which send no command for this long. 0 to keep them open")
+	legacyConns := flag.Bool("legacyConns", false, "close each connection after its first command, and write responses without a status byte, as clients before persistent connections expect")
+	shutdownTimeout := flag.Duration("shutdownTimeout", 10*time.Second, "how long to wait for in-flight commands on SIGTERM or SIGINT before the final save")
+	shutdownBackup := flag.Bool("shutdownBackup", false, "back up to the backend after the final save on SIGTERM or SIGINT")
 	flag.Parse()
 
+	parsedWindows, err := datastore.ParseWindows(*windows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedCounter, err := datastore.ParseCounterType(*counter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedEviction, err := datastore.ParseEvictionPolicy(*eviction)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedOpLogSync, err := datastore.ParseSyncPolicy(*opLogSync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedCompression, err := datastore.ParseCompression(*compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedRecovery, err := datastore.ParseRecoveryPolicy(*recovery)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var keys *datastore.EncryptionKeys
+	if *backupKeyFile != "" {
+		keys, err = datastore.LoadKeyFile(*backupKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	parsedPrefixes4, err := parseInts(*prefixes4)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedPrefixes6, err := parseInts(*prefixes6)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	opts := options{
-		port:            *port,
-		dataDir:         *dataDir,
-		s3Bucket:        *s3Bucket,
+		port:        *port,
+		dataDir:     *dataDir,
+		backendType: *backendType,
+		backupDir:   *backupDir,
+		s3Bucket:    *s3Bucket,
+		s3Endpoint:  *s3Endpoint,
+		s3Region:    *s3Region,
+		s3PathStyle: *s3PathStyle,
+		backup: datastore.BackupConfig{
+			Prefix: *backupPrefix,
+			Host:   *backupHost,
+			Keep:   *backupKeep,
+			MaxAge: *backupMaxAge,
+			Keys:   keys,
+		},
+		backupKeyFile:   *backupKeyFile,
 		persistInterval: *persistInterval,
 		backupInterval:  *backupInterval,
+		windows:         parsedWindows,
+		counter:         parsedCounter,
+		buckets:         *buckets,
+		halfLife:        *halfLife,
+		prefixes4:       parsedPrefixes4,
+		prefixes6:       parsedPrefixes6,
+		ttl:             *ttl,
+		sweepInterval:   *sweepInterval,
+		evictListed:     *evictListed,
+		shards:          *shards,
+		maxRecords:      *maxRecords,
+		maxBytes:        *maxBytes,
+		eviction:        parsedEviction,
+		opLog:           *opLog,
+		opLogSync:       parsedOpLogSync,
+		compression:     parsedCompression,
+		snapshots:       *snapshots,
+		snapshotMaxAge:  *snapshotMaxAge,
+		snapshot:        *snapshot,
+		restore:         *restore,
+		recovery:        parsedRecovery,
+		shutdownTimeout: *shutdownTimeout,
+		idleTimeout:     *idleTimeout,
+		legacyConns:     *legacyConns,
+		shutdownBackup:  *shutdownBackup,
 	}
 
 	log.Println("Kawana startup -", opts)
 
-	if opts.backupInterval > 0 {
-		if opts.s3Bucket != "" {
-			err := testS3(opts.s3Bucket)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			log.Fatal("Backup enabled but s3Bucket not specified")
+	if needsBackend(opts) {
+		opts.backend, err = newBackend(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = testBackend(opts.backend)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
-	server := New(opts.port, opts.dataDir, opts.persistInterval, opts.backupInterval, opts.s3Bucket)
+	server, err := New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
 	server.Start()
 }
 
-func testS3(s3Bucket string) error {
-	// test aws s3 connection
-	k, err := s3gof3r.EnvKeys() // get S3 keys from environment
-	if err != nil {
-		return err
+// parseInts parses a comma separated list of integers. An empty string is an empty list
+func parseInts(s string) ([]int, error) {
+	var result []int
+	if s == "" {
+		return result, nil
 	}
-	// Open bucket to put file into
-	s3 := s3gof3r.New("", k)
-	b := s3.Bucket(s3Bucket)
-	// Open a PutWriter for upload
-	_, err = b.PutWriter("kawana-test", nil, nil)
-	if err != nil {
-		return err
+	for _, part := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, i)
+	}
+	return result, nil
+}
+
+// needsBackend returns true if the options use a backup backend. Fallback recovery
+// only falls back to the backup, after the snapshots, if a backend is configured
+func needsBackend(opts options) bool {
+	if opts.backupInterval > 0 || opts.restore || opts.shutdownBackup {
+		return true
 	}
+	configured := opts.s3Bucket != "" || opts.backupDir != ""
+	return opts.recovery == datastore.RecoverFallback && configured
+}
 
-	return nil
+// newBackend returns the backup backend chosen by the options
+func newBackend(opts options) (datastore.Backend, error) {
+	switch opts.backendType {
+	case "s3":
+		if opts.s3Bucket == "" {
+			return nil, fmt.Errorf("Backups to s3 need -s3Bucket")
+		}
+		return datastore.NewS3Backend(datastore.S3Config{
+			Bucket:    opts.s3Bucket,
+			Endpoint:  opts.s3Endpoint,
+			Region:    opts.s3Region,
+			PathStyle: opts.s3PathStyle,
+		})
+	case "dir":
+		if opts.backupDir == "" {
+			return nil, fmt.Errorf("Backups to a dir need -backupDir")
+		}
+		return datastore.NewDirBackend(opts.backupDir), nil
+	default:
+		return nil, fmt.Errorf("Unknown backend %q", opts.backendType)
+	}
+}
+
+// testBackend checks that the backend can be written to
+func testBackend(backend datastore.Backend) error {
+	err := backend.Put("kawana-test", bytes.NewReader([]byte("kawana")), nil)
+	if err != nil {
+		return fmt.Errorf("Can't write to %s: %s", backend, err)
+	}
+	return backend.Delete("kawana-test")
 }
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/chriskite/kawana/datastore"
+
+	. "github.com/chriskite/kawana/kawana-server/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type MainS struct{}
+
+var _ = Suite(&MainS{})
+
+func (s *MainS) TestNeedsBackend(c *C) {
+	c.Check(needsBackend(options{backendType: "s3"}), Equals, false)
+	c.Check(needsBackend(options{backendType: "s3", backupInterval: 60}), Equals, true)
+	c.Check(needsBackend(options{backendType: "s3", restore: true}), Equals, true)
+
+	// fallback recovery uses snapshots alone when no backend is configured
+	fallback := options{backendType: "s3", recovery: datastore.RecoverFallback}
+	c.Check(needsBackend(fallback), Equals, false)
+	fallback.s3Bucket = "kawana"
+	c.Check(needsBackend(fallback), Equals, true)
+	fallback = options{backendType: "dir", backupDir: "/backups", recovery: datastore.RecoverFallback}
+	c.Check(needsBackend(fallback), Equals, true)
+}
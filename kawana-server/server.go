@@ -1,26 +1,76 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
-	"errors"
 	"expvar"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/chriskite/kawana/datastore"
 )
 
-const tcpTimeout = 5 // seconds
+const tcpTimeout = 5 * time.Second // default time to read the rest of a command, and write its response
 
+// Commands whose name ends in 6 take a 16 byte network order address
+// (ipv6, or IPv4-mapped ipv4) in place of the 4 byte little endian ipv4 address,
+// and respond with the IP's score and prefix records, which the original
+// commands leave out so that their responses stay the same for existing clients
 const (
-	cmdLogIP        = 0x01
-	cmdForgiveIP    = 0x02
-	cmdBlackWhiteIP = 0x03
+	cmdLogIP         = 0x01
+	cmdForgiveIP     = 0x02
+	cmdBlackWhiteIP  = 0x03
+	cmdLogIP6        = 0x04
+	cmdForgiveIP6    = 0x05
+	cmdBlackWhiteIP6 = 0x06
+	cmdGetIP         = 0x07
+	cmdGetIP6        = 0x08
+	cmdScan          = 0x09
+	cmdLogIPs        = 0x0A
+	cmdLogIPs6       = 0x0B
+)
+
+// Every response starts with a status byte. statusOK is followed by the command's
+// response, and any other status by an error message: [2 byte LE length][message].
+// After an error other than statusInvalidArgument the connection is closed, as
+// the rest of the command can't be told apart from the next one
+const (
+	statusOK              = 0x00
+	statusUnknownCommand  = 0x01
+	statusInvalidArgument = 0x02 // the whole command was read, but an argument is invalid
+	statusTruncated       = 0x03 // the rest of the command was not received in time
+	statusInternalError   = 0x04
+)
+
+// statusError is an error which is reported to the client with its status
+type statusError struct {
+	status byte
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// invalidArgument returns a statusError with statusInvalidArgument
+func invalidArgument(format string, args ...interface{}) error {
+	return &statusError{status: statusInvalidArgument, msg: fmt.Sprintf(format, args...)}
+}
+
+// LogIPs response formats
+const (
+	logIPsRecords = 0 // each IP's records, as LogIP responds with
+	logIPsSummary = 1 // each IP's blackwhite and score
 )
 
 // Server is a Kawana TCP server that accepts commands
@@ -29,9 +79,28 @@ type Server struct {
 	port            int
 	persistInterval time.Duration
 	backupInterval  time.Duration
-	s3Bucket        string
+	sweepInterval   time.Duration
+	shutdownTimeout time.Duration // how long Shutdown waits for in-flight commands
+	shutdownBackup  bool          // back up after the final save on Shutdown
+	idleTimeout     time.Duration // how long a connection waits for its next command. 0 to wait forever
+	tcpTimeout      time.Duration // how long a command has to be read, and its response written
+	legacyConns     bool          // close each connection after one command, and write no status bytes
 	store           *datastore.IPDataStore
 	stats           stats
+
+	mu       sync.Mutex // guards listener, stopping and conns
+	listener net.Listener
+	stopping chan struct{} // closed by Stop
+	conns    map[*clientConn]struct{}
+	handling sync.WaitGroup // connections being handled
+}
+
+// clientConn is a connection being handled, which Stop
+// interrupts while it is waiting for a command
+type clientConn struct {
+	net.Conn
+	mu   sync.Mutex
+	idle bool
 }
 
 type stats struct {
@@ -40,25 +109,75 @@ type stats struct {
 
 type command uint8
 
+// ipReader reads an IP address argument from a command's data
+type ipReader func(r io.Reader) (datastore.IPAddr, error)
+
+// ipWriter writes an IP's records in a command's response
+type ipWriter func(ip datastore.IPAddr, ipData *datastore.IPData, conn io.ReadWriter) error
+
 var cmdsPerSec = expvar.NewInt("cmdsPerSec")
+var idleEvictions = expvar.NewInt("idleEvictions")
+var capEvictions = expvar.NewInt("capEvictions")
+var kdbRecovery = expvar.NewString("kdbRecovery")                // how the kdb was recovered on startup, see datastore.Recovery
+var kdbLostOpLogSegments = expvar.NewInt("kdbLostOpLogSegments") // op log segments lost by falling back to an older kdb on startup
 
 // New creates a new Kawana Server
-func New(port int, dataDir string, persistInterval int, backupInterval int, s3Bucket string) *Server {
+func New(opts options) (*Server, error) {
 	s := new(Server)
-	s.port = port
-	s.persistInterval = time.Duration(persistInterval) * time.Second
-	s.backupInterval = time.Duration(backupInterval) * time.Second
-	s.s3Bucket = s3Bucket
-
-	s.store = datastore.New(dataDir, s3Bucket)
-	return s
+	s.port = opts.port
+	s.persistInterval = time.Duration(opts.persistInterval) * time.Second
+	s.backupInterval = time.Duration(opts.backupInterval) * time.Second
+	s.shutdownTimeout = opts.shutdownTimeout
+	s.shutdownBackup = opts.shutdownBackup
+	s.idleTimeout = opts.idleTimeout
+	s.tcpTimeout = tcpTimeout
+	s.legacyConns = opts.legacyConns
+	s.stopping = make(chan struct{})
+	s.conns = make(map[*clientConn]struct{})
+
+	store, err := datastore.New(datastore.Config{
+		DataDir:           opts.dataDir,
+		Backend:           opts.backend,
+		Backup:            opts.backup,
+		Windows:           opts.windows,
+		Counter:           opts.counter,
+		Buckets:           opts.buckets,
+		HalfLife:          opts.halfLife,
+		Prefixes4:         opts.prefixes4,
+		Prefixes6:         opts.prefixes6,
+		TTL:               opts.ttl,
+		EvictListed:       opts.evictListed,
+		Shards:            opts.shards,
+		MaxRecords:        opts.maxRecords,
+		MaxBytes:          opts.maxBytes,
+		Eviction:          opts.eviction,
+		OpLog:             opts.opLog,
+		OpLogSync:         opts.opLogSync,
+		Compression:       opts.compression,
+		Snapshots:         opts.snapshots,
+		SnapshotMaxAge:    opts.snapshotMaxAge,
+		Snapshot:          opts.snapshot,
+		RestoreFromBackup: opts.restore,
+		Recovery:          opts.recovery,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.store = store
+	kdbRecovery.Set(store.Recovery().String())
+	from, to := store.LostOpLogSegments()
+	kdbLostOpLogSegments.Set(int64(to - from))
+	s.sweepInterval = opts.sweepInterval
+	return s, nil
 }
 
-// Start begins accepting connections and loops forever. Also
-// saves the data store to disk periodically
+// Start begins accepting connections, and saves the data store to disk
+// periodically. On SIGTERM or SIGINT it stops accepting connections and
+// shuts down, exiting non-zero if the final save fails
 func (server *Server) Start() {
 	server.persistEvery(server.persistInterval)
 	server.backupEvery(server.backupInterval)
+	server.store.SweepEvery(server.sweepInterval)
 
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", server.port))
 	if err != nil {
@@ -74,136 +193,563 @@ func (server *Server) Start() {
 			<-tc
 			cmdsPerSec.Set(int64(server.stats.cmdsThisSec))
 			server.stats.cmdsThisSec = 0
+			storeStats := server.store.Stats()
+			idleEvictions.Set(int64(storeStats.IdleEvictions))
+			capEvictions.Set(int64(storeStats.CapEvictions))
 		}
 	}()
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down...", sig)
+		server.Stop()
+	}()
+
 	log.Println("Server started")
+	server.Serve(ln)
+
+	err = server.Shutdown()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Server stopped")
+}
+
+// Serve handles connections accepted from ln until Stop is called
+func (server *Server) Serve(ln net.Listener) {
+	server.mu.Lock()
+	server.listener = ln
+	select {
+	case <-server.stopping:
+		// stopped before the listener was known
+		ln.Close()
+		server.mu.Unlock()
+		return
+	default:
+	}
+	server.mu.Unlock()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			select {
+			case <-server.stopping:
+				return
+			default:
+			}
 			log.Println(err)
 			continue
 		}
-		go server.handleConnection(conn)
+		client := &clientConn{Conn: conn}
+		server.mu.Lock()
+		server.conns[client] = struct{}{}
+		server.mu.Unlock()
+		server.handling.Add(1)
+		go func() {
+			defer server.handling.Done()
+			server.handleConnection(client)
+			server.mu.Lock()
+			delete(server.conns, client)
+			server.mu.Unlock()
+		}()
+	}
+}
+
+// Stop closes the listener, so Serve returns and no more connections are accepted,
+// and closes the connections waiting for a command. Connections in the middle of a
+// command are closed once its response has been written
+func (server *Server) Stop() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	select {
+	case <-server.stopping:
+		return
+	default:
+	}
+	close(server.stopping)
+	if server.listener != nil {
+		server.listener.Close()
+	}
+	for client := range server.conns {
+		client.mu.Lock()
+		if client.idle {
+			// interrupt the wait, rather than racing with the read of a command
+			client.SetReadDeadline(time.Now())
+		}
+		client.mu.Unlock()
 	}
 }
 
+// Shutdown waits up to the shutdown timeout for the connections being handled
+// to finish, then persists the store, backs it up if the server backs up on
+// shutdown, and closes it. It returns the first error of the final save
+func (server *Server) Shutdown() error {
+	done := make(chan struct{})
+	go func() {
+		server.handling.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(server.shutdownTimeout):
+		log.Printf("Commands still running after %s, saving anyway", server.shutdownTimeout)
+	}
+
+	log.Println("Starting final save...")
+	err := server.store.Persist()
+	if err != nil {
+		server.store.Close()
+		return fmt.Errorf("Final save failed: %s", err)
+	}
+	log.Println("Final save finished")
+
+	if server.shutdownBackup {
+		log.Println("Starting final backup...")
+		err = server.store.Backup()
+		if err != nil {
+			server.store.Close()
+			return fmt.Errorf("Final backup failed: %s", err)
+		}
+		log.Println("Final backup finished")
+	}
+	return server.store.Close()
+}
+
 func (server *Server) startExpVar() {
 	http.ListenAndServe(":9292", nil)
 }
 
-func (server *Server) handleConnection(conn net.Conn) {
+// handleConnection handles commands from the connection until it is closed, it
+// is idle for longer than the idle timeout, or the server stops. Clients may send
+// several commands before reading their responses, which are written in order
+func (server *Server) handleConnection(conn *clientConn) {
 	defer conn.Close()
 
-	conn.SetReadDeadline(time.Now().Add(tcpTimeout * time.Second))
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	rw := bufio.NewReadWriter(r, w)
+	for {
+		// commands already received are handled even when the server is stopping
+		if r.Buffered() == 0 && !server.waitForCommand(conn) {
+			return
+		}
 
-	var buf [1]byte
+		// read the first byte which contains the command
+		cmd, err := r.ReadByte()
+		conn.setIdle(false)
+		if err != nil {
+			return
+		}
+		// the response may be written as soon as the write buffer fills, so the
+		// write deadline is set now rather than only before an explicit flush
+		conn.SetDeadline(time.Now().Add(server.tcpTimeout))
 
-	// read the first byte which contains the command
-	_, err := io.ReadFull(conn, buf[0:])
-	if err != nil {
-		return
+		err = server.handleCommand(command(cmd), rw)
+		keepOpen := !server.legacyConns
+		if err != nil {
+			log.Println(err)
+			var status byte
+			status, keepOpen = errorStatus(err)
+			if server.legacyConns {
+				// legacy clients only see the connection close
+				return
+			}
+			err = writeError(w, status, err.Error())
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		if !keepOpen || r.Buffered() == 0 {
+			// respond to the pipelined commands before waiting for more
+			conn.SetWriteDeadline(time.Now().Add(server.tcpTimeout))
+			err = w.Flush()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		if !keepOpen {
+			return
+		}
 	}
+}
 
-	err = server.handleCommand(command(buf[0]), conn)
-	if err != nil {
-		log.Println(err)
-		return
+// errorStatus returns the status which reports the error from handling a command,
+// and whether the connection can be used for more commands after it
+func errorStatus(err error) (byte, bool) {
+	if statusErr, ok := err.(*statusError); ok {
+		return statusErr.status, statusErr.status == statusInvalidArgument
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return statusTruncated, false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return statusTruncated, false
+	}
+	return statusInternalError, false
+}
+
+// waitForCommand marks the connection as idle until its next command is read,
+// with the idle timeout as its read deadline. It returns false if the server is stopping
+func (server *Server) waitForCommand(conn *clientConn) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	select {
+	case <-server.stopping:
+		return false
+	default:
+	}
+
+	conn.idle = true
+	var deadline time.Time
+	if server.idleTimeout > 0 {
+		deadline = time.Now().Add(server.idleTimeout)
 	}
+	conn.SetReadDeadline(deadline)
+	return true
+}
+
+func (conn *clientConn) setIdle(idle bool) {
+	conn.mu.Lock()
+	conn.idle = idle
+	conn.mu.Unlock()
 }
 
 func (server *Server) handleCommand(cmd command, conn io.ReadWriter) error {
 	atomic.AddUint64(&server.stats.cmdsThisSec, 1)
+
 	switch cmd {
 	case cmdLogIP:
-		return server.handleLogIP(conn)
+		return server.handleLogIP(conn, readIPLong, writeLegacyIPData)
 	case cmdForgiveIP:
-		return server.handleForgiveIP(conn)
+		return server.handleForgiveIP(conn, readIPLong, writeLegacyIPData)
 	case cmdBlackWhiteIP:
-		return server.handleBlackWhiteIP(conn)
+		return server.handleBlackWhiteIP(conn, readIPLong, writeLegacyIPData)
+	case cmdLogIP6:
+		return server.handleLogIP(conn, readIPAddr, server.writeIPRecords)
+	case cmdForgiveIP6:
+		return server.handleForgiveIP(conn, readIPAddr, server.writeIPRecords)
+	case cmdBlackWhiteIP6:
+		return server.handleBlackWhiteIP(conn, readIPAddr, server.writeIPRecords)
+	case cmdGetIP:
+		return server.handleGetIP(conn, readIPLong)
+	case cmdGetIP6:
+		return server.handleGetIP(conn, readIPAddr)
+	case cmdScan:
+		return server.handleScan(conn)
+	case cmdLogIPs:
+		return server.handleLogIPs(conn, readIPLong)
+	case cmdLogIPs6:
+		return server.handleLogIPs(conn, readIPAddr)
 	default:
-		return errors.New("Unknown command")
+		return &statusError{status: statusUnknownCommand, msg: fmt.Sprintf("Unknown command 0x%02x", byte(cmd))}
 	}
 }
 
-func (server *Server) handleBlackWhiteIP(conn io.ReadWriter) error {
+func (server *Server) handleBlackWhiteIP(conn io.ReadWriter, readIP ipReader, writeIP ipWriter) error {
 	// BW command data is:
-	// [4 byte little endian IP][1 byte bw modifier]
-	var buf [5]byte
-	_, err := io.ReadFull(conn, buf[0:])
+	// [IP][1 byte bw modifier]
+	ip, err := readIP(conn)
+	if err != nil {
+		return err
+	}
+
+	var buf [1]byte
+	_, err = io.ReadFull(conn, buf[0:])
 	if err != nil {
 		return err
 	}
 
-	ip := binary.LittleEndian.Uint32(buf[0:4])
-	bwMod := buf[4] // blackwhite modifier. see datastore.BW*
+	bwMod := datastore.BWModifier(buf[0]) // see datastore.BW*
+	// legacy clients get the record back with an invalid modifier ignored, as they always have
+	if !bwMod.Valid() && !server.legacyConns {
+		return invalidArgument("Invalid BlackWhite modifier %d", bwMod)
+	}
 
-	ipData := server.store.LogIP(datastore.IPLong(ip), datastore.ImpactAmount(0), datastore.BWModifier(bwMod))
+	ipData := server.store.LogIP(ip, datastore.ImpactAmount(0), bwMod)
 
-	return writeIPData(ipData, conn)
+	err = server.writeOK(conn)
+	if err != nil {
+		return err
+	}
+	return writeIP(ip, ipData, conn)
 }
 
-func (server *Server) handleLogIP(conn io.ReadWriter) error {
+func (server *Server) handleLogIP(conn io.ReadWriter, readIP ipReader, writeIP ipWriter) error {
 	// LogIP command data is:
-	// [4 byte little endian IP][4 byte little endian impact]
-	var buf [8]byte
-	_, err := io.ReadFull(conn, buf[0:])
+	// [IP][4 byte little endian impact]
+	ip, err := readIP(conn)
+	if err != nil {
+		return err
+	}
+
+	var buf [4]byte
+	_, err = io.ReadFull(conn, buf[0:])
+	if err != nil {
+		return err
+	}
+
+	impact := binary.LittleEndian.Uint32(buf[0:4])
+
+	ipData := server.store.LogIP(ip, datastore.ImpactAmount(impact), datastore.BWNop)
+
+	err = server.writeOK(conn)
 	if err != nil {
 		return err
 	}
+	return writeIP(ip, ipData, conn)
+}
 
-	ip := binary.LittleEndian.Uint32(buf[0:4])
-	impact := binary.LittleEndian.Uint32(buf[4:8])
+func (server *Server) handleLogIPs(conn io.ReadWriter, readIP ipReader) error {
+	// LogIPs command data is:
+	// [2 byte LE count][1 byte response format, see logIPs*]([IP][4 byte LE impact])...
+	// and the response is, for each IP in order, either its records as for LogIP,
+	// or a summary of [1 byte blackwhite][8 byte LE float64 score]
+	var buf [9]byte
+	_, err := io.ReadFull(conn, buf[0:3])
+	if err != nil {
+		return err
+	}
+	count := int(binary.LittleEndian.Uint16(buf[0:2]))
+	format := buf[2]
 
-	ipData := server.store.LogIP(datastore.IPLong(ip), datastore.ImpactAmount(impact), datastore.BWNop)
+	impacts := make([]datastore.IPImpact, count)
+	for i := range impacts {
+		impacts[i].IP, err = readIP(conn)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, buf[0:4])
+		if err != nil {
+			return err
+		}
+		impacts[i].Impact = datastore.ImpactAmount(binary.LittleEndian.Uint32(buf[0:4]))
+	}
+	if format != logIPsRecords && format != logIPsSummary {
+		return invalidArgument("Unknown LogIPs response format %d", format)
+	}
+
+	results := server.store.LogIPs(impacts)
 
-	return writeIPData(ipData, conn)
+	err = server.writeOK(conn)
+	if err != nil {
+		return err
+	}
+	for i, ipData := range results {
+		if format == logIPsRecords {
+			err = server.writeIPRecords(impacts[i].IP, ipData, conn)
+		} else {
+			buf[0] = ipData.BlackWhite
+			binary.LittleEndian.PutUint64(buf[1:9], math.Float64bits(ipData.Score))
+			_, err = conn.Write(buf[0:9])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (server *Server) handleForgiveIP(conn io.ReadWriter) error {
+func (server *Server) handleForgiveIP(conn io.ReadWriter, readIP ipReader, writeIP ipWriter) error {
 	// ForgiveIP command data is:
-	// [4 byte little endian IP][4 byte little endian 5m impact][4 byte LE hour impact][4 byte LE day impact]
-	var buf [16]byte
+	// [IP][4 byte little endian impact for each of the store's windows]
+	ip, err := readIP(conn)
+	if err != nil {
+		return err
+	}
+
+	numWindows := len(server.store.Windows())
+	buf := make([]byte, 4*numWindows)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+
+	impacts := make(datastore.ImpactAmounts, numWindows)
+	for i := range impacts {
+		impacts[i] = datastore.ImpactAmount(binary.LittleEndian.Uint32(buf[4*i : 4*i+4]))
+	}
+	ipData := server.store.ForgiveIP(ip, impacts)
+
+	err = server.writeOK(conn)
+	if err != nil {
+		return err
+	}
+	return writeIP(ip, ipData, conn)
+}
+
+func (server *Server) handleGetIP(conn io.ReadWriter, readIP ipReader) error {
+	// GetIP command data is:
+	// [IP]
+	// and the response is a 1 byte found flag, followed by the IP's records if it was found:
+	// [1 byte 0 not found or 1 found]([IP records])
+	ip, err := readIP(conn)
+	if err != nil {
+		return err
+	}
+
+	ipData, exists := server.store.GetIP(ip)
+	err = server.writeOK(conn)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = conn.Write([]byte{0})
+		return err
+	}
+
+	_, err = conn.Write([]byte{1})
+	if err != nil {
+		return err
+	}
+	return server.writeIPRecords(ip, ipData, conn)
+}
+
+func (server *Server) handleScan(conn io.ReadWriter) error {
+	// Scan command data is:
+	// [1 byte window index][1 byte field, 0 current or 1 max][4 byte LE limit, 0 for all][4 byte LE threshold]
+	// and the response is the matching host and prefix records, highest impact first:
+	// [4 byte LE count]([16 byte network order address][1 byte prefix length][IPData])...
+	var buf [10]byte
 	_, err := io.ReadFull(conn, buf[0:])
 	if err != nil {
 		return err
 	}
 
-	ip := binary.LittleEndian.Uint32(buf[0:4])
-	fiveMinImpact := binary.LittleEndian.Uint32(buf[4:8])
-	hourImpact := binary.LittleEndian.Uint32(buf[8:12])
-	dayImpact := binary.LittleEndian.Uint32(buf[12:16])
+	results, err := server.store.Scan(datastore.ScanQuery{
+		Window:    int(buf[0]),
+		Field:     datastore.ScanField(buf[1]),
+		Limit:     int(binary.LittleEndian.Uint32(buf[2:6])),
+		Threshold: datastore.ImpactAmount(binary.LittleEndian.Uint32(buf[6:10])),
+	})
+	if err != nil {
+		return invalidArgument("%s", err)
+	}
+
+	err = server.writeOK(conn)
+	if err != nil {
+		return err
+	}
+
+	var countBuf [4]byte
+	binary.LittleEndian.PutUint32(countBuf[0:4], uint32(len(results)))
+	_, err = conn.Write(countBuf[0:])
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		var keyBuf [17]byte
+		copy(keyBuf[0:16], result.Prefix.Addr[0:])
+		keyBuf[16] = result.Prefix.Bits
+		_, err = conn.Write(keyBuf[0:])
+		if err != nil {
+			return err
+		}
+		err = writeIPData(result.Data, conn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	impacts := datastore.ImpactAmounts{
-		FiveMin: datastore.ImpactAmount(fiveMinImpact),
-		Hour:    datastore.ImpactAmount(hourImpact),
-		Day:     datastore.ImpactAmount(dayImpact),
+// readIPLong reads a 4 byte little endian ipv4 address
+func readIPLong(r io.Reader) (datastore.IPAddr, error) {
+	var buf [4]byte
+	_, err := io.ReadFull(r, buf[0:])
+	if err != nil {
+		return datastore.IPAddr{}, err
 	}
-	ipData := server.store.ForgiveIP(datastore.IPLong(ip), impacts)
+	return datastore.IPLong(binary.LittleEndian.Uint32(buf[0:4])).IPAddr(), nil
+}
 
-	return writeIPData(ipData, conn)
+// readIPAddr reads a 16 byte network order ipv6 or IPv4-mapped ipv4 address
+func readIPAddr(r io.Reader) (datastore.IPAddr, error) {
+	var ip datastore.IPAddr
+	_, err := io.ReadFull(r, ip[0:])
+	return ip, err
 }
 
-// writeOK writes a single zero byte to the client to indicate success
-func writeOK(conn io.ReadWriter) error {
-	var buf [1]byte
-	_, err := conn.Write(buf[0:])
+// writeOK writes the statusOK byte which starts a successful response,
+// unless the server speaks the legacy protocol, which has no status
+func (server *Server) writeOK(conn io.ReadWriter) error {
+	if server.legacyConns {
+		return nil
+	}
+	_, err := conn.Write([]byte{statusOK})
+	return err
+}
+
+// writeError writes an error response with the status and message
+func writeError(w io.Writer, status byte, msg string) error {
+	if len(msg) > math.MaxUint16 {
+		msg = msg[0:math.MaxUint16]
+	}
+	buf := make([]byte, 3+len(msg))
+	buf[0] = status
+	binary.LittleEndian.PutUint16(buf[1:3], uint16(len(msg)))
+	copy(buf[3:], msg)
+	_, err := w.Write(buf)
 	return err
 }
 
-func writeIPData(ipData datastore.IPData, conn io.ReadWriter) error {
-	var buf [15]byte
-	binary.LittleEndian.PutUint32(buf[0:4], uint32(ipData.MaxImpacts.FiveMin))
-	binary.LittleEndian.PutUint32(buf[4:8], uint32(ipData.MaxImpacts.Hour))
-	binary.LittleEndian.PutUint32(buf[8:12], uint32(ipData.MaxImpacts.Day))
-	binary.LittleEndian.PutUint16(buf[12:14], uint16(ipData.Forgiven))
-	buf[14] = ipData.BlackWhite
+// writeIPData writes the IPData to the client as:
+// [4 byte little endian max impact for each of the store's windows][2 byte LE forgiven][1 byte blackwhite]
+// [8 byte LE float64 score]
+func writeIPData(ipData *datastore.IPData, conn io.ReadWriter) error {
+	_, err := conn.Write(ipDataBytes(ipData))
+	return err
+}
 
-	_, err := conn.Write(buf[0:])
+// writeLegacyIPData writes the IPData as the original commands always have,
+// which is writeIPData's response without the score, and without prefix records
+func writeLegacyIPData(ip datastore.IPAddr, ipData *datastore.IPData, conn io.ReadWriter) error {
+	buf := ipDataBytes(ipData)
+	_, err := conn.Write(buf[0 : len(buf)-8])
 	return err
 }
 
+func ipDataBytes(ipData *datastore.IPData) []byte {
+	n := len(ipData.MaxImpacts)
+	buf := make([]byte, 4*n+11)
+	for i, maxImpact := range ipData.MaxImpacts {
+		binary.LittleEndian.PutUint32(buf[4*i:4*i+4], uint32(maxImpact))
+	}
+	binary.LittleEndian.PutUint16(buf[4*n:4*n+2], uint16(ipData.Forgiven))
+	buf[4*n+2] = ipData.BlackWhite
+	binary.LittleEndian.PutUint64(buf[4*n+3:4*n+11], math.Float64bits(ipData.Score))
+	return buf
+}
+
+// writeIPRecords writes the IP's IPData followed by its enclosing prefix records as:
+// [IPData][1 byte prefix count]([1 byte prefix length][IPData])...
+func (server *Server) writeIPRecords(ip datastore.IPAddr, ipData *datastore.IPData, conn io.ReadWriter) error {
+	err := writeIPData(ipData, conn)
+	if err != nil {
+		return err
+	}
+
+	prefixes := server.store.Prefixes(ip)
+	_, err = conn.Write([]byte{byte(len(prefixes))})
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		_, err = conn.Write([]byte{prefix.Prefix.Bits})
+		if err != nil {
+			return err
+		}
+		err = writeIPData(prefix.Data, conn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (server *Server) persistEvery(interval time.Duration) {
 	doEvery(interval, func() {
 		log.Println("Starting background save...")
@@ -219,7 +765,7 @@ func (server *Server) persistEvery(interval time.Duration) {
 func (server *Server) backupEvery(interval time.Duration) {
 	doEvery(interval, func() {
 		log.Println("Starting backup...")
-		err := server.store.BackupToS3()
+		err := server.store.Backup()
 		if err != nil {
 			log.Println(err)
 		} else {
@@ -4,8 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
+	"io/ioutil"
+	"math"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -42,17 +47,14 @@ func (s *ServerS) TestBlackWhiteIP(c *C) {
 	cmdBuf[4] = bw
 
 	expected := datastore.IPData{
-		MaxImpacts: datastore.ImpactAmounts{
-			FiveMin: impact,
-			Hour:    impact,
-			Day:     impact,
-		},
+		MaxImpacts: datastore.ImpactAmounts{impact, impact, impact},
 		Forgiven:   datastore.ForgivenNum(0),
 		BlackWhite: bw,
 	}
-	helpTestCommand(c, cmdBuf[0:], expected, func(s *Server, f faker) {
-		s.handleBlackWhiteIP(f)
+	resp := helpTestCommand(c, cmdBuf[0:], func(s *Server, f faker) {
+		s.handleBlackWhiteIP(f, readIPLong, writeLegacyIPData)
 	})
+	checkLegacyResponse(resp, &expected, c)
 }
 
 func (s *ServerS) TestLogIP(c *C) {
@@ -64,17 +66,67 @@ func (s *ServerS) TestLogIP(c *C) {
 	binary.LittleEndian.PutUint32(cmdBuf[4:8], uint32(impact))
 
 	expected := datastore.IPData{
-		MaxImpacts: datastore.ImpactAmounts{
-			FiveMin: impact,
-			Hour:    impact,
-			Day:     impact,
-		},
+		MaxImpacts: datastore.ImpactAmounts{impact, impact, impact},
 		Forgiven:   datastore.ForgivenNum(0),
 		BlackWhite: byte(0),
+		Score:      float64(impact),
 	}
-	helpTestCommand(c, cmdBuf[0:], expected, func(s *Server, f faker) {
-		s.handleLogIP(f)
+	resp := helpTestCommand(c, cmdBuf[0:], func(s *Server, f faker) {
+		s.handleLogIP(f, readIPLong, writeLegacyIPData)
 	})
+	checkLegacyResponse(resp, &expected, c)
+}
+
+func (s *ServerS) TestLogIP6(c *C) {
+	ip, err := datastore.ParseIPAddr("2001:db8::1")
+	c.Assert(err, IsNil)
+	impact := datastore.ImpactAmount(2)
+
+	var cmdBuf [20]byte
+	copy(cmdBuf[0:16], ip[0:])
+	binary.LittleEndian.PutUint32(cmdBuf[16:20], uint32(impact))
+
+	expected := datastore.IPData{
+		MaxImpacts: datastore.ImpactAmounts{impact, impact, impact},
+		Forgiven:   datastore.ForgivenNum(0),
+		BlackWhite: byte(0),
+		Score:      float64(impact),
+	}
+	resp := helpTestCommand(c, cmdBuf[0:], func(s *Server, f faker) {
+		s.handleLogIP(f, readIPAddr, s.writeIPRecords)
+	})
+	checkResponse(resp, &expected, c)
+	// no prefix records
+	c.Check(resp.Next(1), DeepEquals, []byte{0})
+}
+
+func (s *ServerS) TestLogIPPrefixes(c *C) {
+	var ip uint32 = 0x0A010203 // 10.1.2.3
+	impact := datastore.ImpactAmount(2)
+
+	var cmdBuf [8]byte
+	binary.LittleEndian.PutUint32(cmdBuf[0:4], ip)
+	binary.LittleEndian.PutUint32(cmdBuf[4:8], uint32(impact))
+
+	var respBuf bytes.Buffer
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(cmdBuf[0:])), bufio.NewWriter(&respBuf))
+
+	server := newServer(c, options{port: 9291, dataDir: c.MkDir(), prefixes4: []int{24}})
+	err := server.handleLogIP(fake, readIPLong, server.writeIPRecords)
+	c.Assert(err, IsNil)
+	fake.ReadWriter.(*bufio.ReadWriter).Flush()
+
+	expected := datastore.IPData{
+		MaxImpacts: datastore.ImpactAmounts{impact, impact, impact},
+		Score:      float64(impact),
+	}
+	c.Check(respBuf.Next(1), DeepEquals, []byte{statusOK})
+	checkResponse(&respBuf, &expected, c)
+
+	// one /24 prefix record follows the host record
+	c.Check(respBuf.Next(2), DeepEquals, []byte{1, 24})
+	checkResponse(&respBuf, &expected, c)
 }
 
 func (s *ServerS) TestForgiveIP(c *C) {
@@ -89,46 +141,579 @@ func (s *ServerS) TestForgiveIP(c *C) {
 	binary.LittleEndian.PutUint32(cmdBuf[12:16], uint32(impact))
 
 	expected := datastore.IPData{
-		MaxImpacts: datastore.ImpactAmounts{
-			FiveMin: exp,
-			Hour:    exp,
-			Day:     exp,
-		},
+		MaxImpacts: datastore.ImpactAmounts{exp, exp, exp},
 		Forgiven:   datastore.ForgivenNum(0),
 		BlackWhite: byte(0),
 	}
-	helpTestCommand(c, cmdBuf[0:], expected, func(s *Server, f faker) {
-		s.handleForgiveIP(f)
+	resp := helpTestCommand(c, cmdBuf[0:], func(s *Server, f faker) {
+		s.handleForgiveIP(f, readIPLong, writeLegacyIPData)
 	})
+	checkLegacyResponse(resp, &expected, c)
 }
 
-func helpTestCommand(c *C, cmdBuf []byte, expected datastore.IPData, cmd func(s *Server, f faker)) {
+// logIPsCommand returns the data of a LogIPs command logging the impact on each of the ipv4 addresses
+func logIPsCommand(format byte, impact uint32, ips ...uint32) []byte {
+	buf := make([]byte, 3+8*len(ips))
+	binary.LittleEndian.PutUint16(buf[0:2], uint16(len(ips)))
+	buf[2] = format
+	for i, ip := range ips {
+		binary.LittleEndian.PutUint32(buf[3+8*i:7+8*i], ip)
+		binary.LittleEndian.PutUint32(buf[7+8*i:11+8*i], impact)
+	}
+	return buf
+}
+
+func (s *ServerS) TestLogIPs(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir()})
+	cmd := logIPsCommand(logIPsRecords, 2, 1, 2, 1)
+
+	var respBuf bytes.Buffer
+	fake := faker{bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(cmd)), bufio.NewWriter(&respBuf))}
+	c.Assert(server.handleLogIPs(fake, readIPLong), IsNil)
+	fake.ReadWriter.(*bufio.ReadWriter).Flush()
+
+	// each IP's records, in the order of the batch
+	c.Check(respBuf.Next(1), DeepEquals, []byte{statusOK})
+	for _, impact := range []datastore.ImpactAmount{2, 2, 4} {
+		checkResponse(&respBuf, &datastore.IPData{
+			MaxImpacts: datastore.ImpactAmounts{impact, impact, impact},
+			Score:      float64(impact),
+		}, c)
+		c.Check(respBuf.Next(1), DeepEquals, []byte{0})
+	}
+	c.Check(respBuf.Len(), Equals, 0)
+}
+
+func (s *ServerS) TestLogIPsSummary(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir()})
+	server.store.LogIP(datastore.IPLong(2).IPAddr(), 0, datastore.BWBlacklist)
+	cmd := logIPsCommand(logIPsSummary, 3, 1, 2)
+
+	var respBuf bytes.Buffer
+	fake := faker{bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(cmd)), bufio.NewWriter(&respBuf))}
+	c.Assert(server.handleLogIPs(fake, readIPLong), IsNil)
+	fake.ReadWriter.(*bufio.ReadWriter).Flush()
+
+	c.Assert(respBuf.Len(), Equals, 1+2*9)
+	c.Check(respBuf.Next(1), DeepEquals, []byte{statusOK})
+	c.Check(respBuf.Next(1), DeepEquals, []byte{0})
+	c.Check(math.Float64frombits(binary.LittleEndian.Uint64(respBuf.Next(8))), Equals, float64(3))
+	blacklisted, _ := server.store.GetIP(datastore.IPLong(2).IPAddr())
+	c.Check(respBuf.Next(1), DeepEquals, []byte{blacklisted.BlackWhite})
+	c.Check(math.Float64frombits(binary.LittleEndian.Uint64(respBuf.Next(8))), Equals, float64(3))
+
+	fake = faker{bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(logIPsCommand(2, 3, 1))), bufio.NewWriter(&respBuf))}
+	err := server.handleLogIPs(fake, readIPLong)
+	c.Check(err, ErrorMatches, "Unknown LogIPs response format 2")
+	status, keepOpen := errorStatus(err)
+	c.Check(status, Equals, byte(statusInvalidArgument))
+	c.Check(keepOpen, Equals, true)
+}
+
+func (s *ServerS) TestGetIP(c *C) {
+	var ip uint32 = 1
+	impact := datastore.ImpactAmount(2)
+
+	var cmdBuf [4]byte
+	binary.LittleEndian.PutUint32(cmdBuf[0:4], ip)
+
+	server := newServer(c, options{port: 9291, dataDir: c.MkDir()})
+
+	// not found, and not created
+	var respBuf bytes.Buffer
+	bRespBuf := bufio.NewWriter(&respBuf)
+	fake := faker{bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(cmdBuf[0:])), bRespBuf)}
+	c.Assert(server.handleGetIP(fake, readIPLong), IsNil)
+	bRespBuf.Flush()
+	c.Check(respBuf.Bytes(), DeepEquals, []byte{statusOK, 0})
+	c.Check(server.store.Len(), Equals, 0)
+
+	server.store.LogIP(datastore.IPLong(ip).IPAddr(), impact, datastore.BWNop)
+
+	// found, followed by the IP's records
+	respBuf.Reset()
+	fake = faker{bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(cmdBuf[0:])), bRespBuf)}
+	c.Assert(server.handleGetIP(fake, readIPLong), IsNil)
+	bRespBuf.Flush()
+
+	c.Check(respBuf.Next(2), DeepEquals, []byte{statusOK, 1})
+	var buf [23]byte
+	io.ReadFull(&respBuf, buf[0:])
+	for i := 0; i < 3; i++ {
+		c.Check(datastore.ImpactAmount(binary.LittleEndian.Uint32(buf[4*i:4*i+4])), Equals, impact)
+	}
+	c.Check(math.Float64frombits(binary.LittleEndian.Uint64(buf[15:23])) > 0, Equals, true)
+	// no prefix records
+	c.Check(respBuf.Next(1), DeepEquals, []byte{0})
+}
+
+func (s *ServerS) TestScan(c *C) {
+	server := newServer(c, options{port: 9291, dataDir: c.MkDir()})
+	for i := 1; i <= 5; i++ {
+		server.store.LogIP(datastore.IPLong(i).IPAddr(), datastore.ImpactAmount(i), datastore.BWNop)
+	}
+
+	// top 2 by the first window's current impact
+	var cmdBuf [10]byte
+	cmdBuf[0] = 0
+	cmdBuf[1] = byte(datastore.ScanCur)
+	binary.LittleEndian.PutUint32(cmdBuf[2:6], 2)
+
+	var respBuf bytes.Buffer
+	bRespBuf := bufio.NewWriter(&respBuf)
+	fake := faker{bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(cmdBuf[0:])), bRespBuf)}
+	c.Assert(server.handleScan(fake), IsNil)
+	bRespBuf.Flush()
+
+	c.Check(respBuf.Next(1), DeepEquals, []byte{statusOK})
+	c.Check(binary.LittleEndian.Uint32(respBuf.Next(4)), Equals, uint32(2))
+	for i := 5; i >= 4; i-- {
+		ip := datastore.IPLong(i).IPAddr()
+		c.Check(respBuf.Next(16), DeepEquals, ip[0:])
+		c.Check(respBuf.Next(1), DeepEquals, []byte{32})
+		impact := datastore.ImpactAmount(i)
+		expected := datastore.IPData{
+			MaxImpacts: datastore.ImpactAmounts{impact, impact, impact},
+			Score:      float64(impact),
+		}
+		checkResponse(&respBuf, &expected, c)
+	}
+	c.Check(respBuf.Len(), Equals, 0)
+}
+
+// newServer returns a new server with the options, failing the test if it can't be created
+func newServer(c *C, opts options) *Server {
+	server, err := New(opts)
+	c.Assert(err, IsNil)
+	return server
+}
+
+// helpTestCommand runs the command on a new server, and returns its response after the status byte
+func helpTestCommand(c *C, cmdBuf []byte, cmd func(s *Server, f faker)) *bytes.Buffer {
 	var respBuf bytes.Buffer
 	bRespBuf := bufio.NewWriter(&respBuf)
 	var fake faker
 	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(cmdBuf[0:])), bRespBuf)
 
-	server := New(9291, "/tmp", 0, 0, "")
+	server := newServer(c, options{port: 9291, dataDir: "/tmp"})
 
 	cmd(server, fake)
 
 	bRespBuf.Flush()
-	checkResponse(&respBuf, expected, c)
+	c.Check(respBuf.Next(1), DeepEquals, []byte{statusOK})
+	return &respBuf
 }
 
-func checkResponse(respBuf *bytes.Buffer, expected datastore.IPData, c *C) {
-	var buf [15]byte
-	io.ReadFull(bufio.NewReader(respBuf), buf[0:])
+func checkResponse(respBuf *bytes.Buffer, expected *datastore.IPData, c *C) {
+	var buf [23]byte
+	io.ReadFull(respBuf, buf[0:])
 
 	fiveMinImpact := datastore.ImpactAmount(binary.LittleEndian.Uint32(buf[0:4]))
 	hourImpact := datastore.ImpactAmount(binary.LittleEndian.Uint32(buf[4:8]))
 	dayImpact := datastore.ImpactAmount(binary.LittleEndian.Uint32(buf[8:12]))
 	forgiven := datastore.ForgivenNum(binary.LittleEndian.Uint16(buf[12:14]))
 	bw := buf[14]
+	score := math.Float64frombits(binary.LittleEndian.Uint64(buf[15:23]))
 
-	c.Check(fiveMinImpact, Equals, expected.MaxImpacts.FiveMin)
-	c.Check(hourImpact, Equals, expected.MaxImpacts.Hour)
-	c.Check(dayImpact, Equals, expected.MaxImpacts.Day)
+	c.Check(fiveMinImpact, Equals, expected.MaxImpacts[0])
+	c.Check(hourImpact, Equals, expected.MaxImpacts[1])
+	c.Check(dayImpact, Equals, expected.MaxImpacts[2])
 	c.Check(forgiven, Equals, expected.Forgiven)
 	c.Check(bw, Equals, expected.BlackWhite)
+	c.Check(score, Equals, expected.Score)
+}
+
+// checkLegacyResponse checks the response of one of the original commands, which is the IPData without its score
+func checkLegacyResponse(respBuf *bytes.Buffer, expected *datastore.IPData, c *C) {
+	c.Assert(respBuf.Len(), Equals, logIPResponseSize)
+	var buf [logIPResponseSize]byte
+	io.ReadFull(respBuf, buf[0:])
+
+	for i := 0; i < 3; i++ {
+		c.Check(datastore.ImpactAmount(binary.LittleEndian.Uint32(buf[4*i:4*i+4])), Equals, expected.MaxImpacts[i])
+	}
+	c.Check(datastore.ForgivenNum(binary.LittleEndian.Uint16(buf[12:14])), Equals, expected.Forgiven)
+	c.Check(buf[14], Equals, expected.BlackWhite)
+}
+
+// serve starts the server on a local port, and returns a function which
+// stops it and waits for Serve to return
+func serve(c *C, server *Server) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	done := make(chan struct{})
+	go func() {
+		server.Serve(ln)
+		close(done)
+	}()
+	return ln.Addr().String(), func() {
+		server.Stop()
+		<-done
+	}
+}
+
+// logIPCommand returns a LogIP command for the ipv4 address
+func logIPCommand(ip uint32, impact uint32) []byte {
+	var buf [9]byte
+	buf[0] = cmdLogIP
+	binary.LittleEndian.PutUint32(buf[1:5], ip)
+	binary.LittleEndian.PutUint32(buf[5:9], impact)
+	return buf[0:]
 }
+
+// logIPResponseSize is the size of a LogIP response for the default windows,
+// without the status byte of the current protocol
+const logIPResponseSize = 4*3 + 3
+
+// logIP6ResponseSize is the size of a LogIP6 response for the default windows, without
+// prefixes, and without the status byte of the current protocol
+const logIP6ResponseSize = 4*3 + 11 + 1
+
+// readLogIPImpact reads a successful LogIP response, and returns its first window's max impact
+func readLogIPImpact(c *C, r io.Reader) uint32 {
+	var buf [1 + logIPResponseSize]byte
+	_, err := io.ReadFull(r, buf[0:])
+	c.Assert(err, IsNil)
+	c.Assert(buf[0], Equals, byte(statusOK))
+	return binary.LittleEndian.Uint32(buf[1:5])
+}
+
+// readError reads an error response, and returns its status and message
+func readError(c *C, r io.Reader) (byte, string) {
+	var buf [3]byte
+	_, err := io.ReadFull(r, buf[0:])
+	c.Assert(err, IsNil)
+	msg := make([]byte, binary.LittleEndian.Uint16(buf[1:3]))
+	_, err = io.ReadFull(r, msg)
+	c.Assert(err, IsNil)
+	return buf[0], string(msg)
+}
+
+// persistedImpact returns the first window's max impact of the ip in the data dir's kdb
+func persistedImpact(c *C, dataDir string, ip uint32) datastore.ImpactAmount {
+	store, err := datastore.New(datastore.Config{DataDir: dataDir})
+	c.Assert(err, IsNil)
+	defer store.Close()
+	ipData, ok := store.GetIP(datastore.IPLong(ip).IPAddr())
+	c.Assert(ok, Equals, true)
+	return ipData.MaxImpacts[0]
+}
+
+func (s *ServerS) TestShutdownPersists(c *C) {
+	dataDir := c.MkDir()
+	server := newServer(c, options{dataDir: dataDir, shutdownTimeout: time.Second})
+	addr, stop := serve(c, server)
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	_, err = conn.Write(logIPCommand(1, 3))
+	c.Assert(err, IsNil)
+	readLogIPImpact(c, conn)
+	conn.Close()
+
+	stop()
+	// no more connections are accepted
+	_, err = net.Dial("tcp", addr)
+	c.Check(err, NotNil)
+
+	c.Assert(server.Shutdown(), IsNil)
+	c.Check(persistedImpact(c, dataDir, 1), Equals, datastore.ImpactAmount(3))
+}
+
+func (s *ServerS) TestShutdownWaitsForCommands(c *C) {
+	dataDir := c.MkDir()
+	server := newServer(c, options{dataDir: dataDir, shutdownTimeout: 10 * time.Second})
+	addr, stop := serve(c, server)
+
+	// a command that has started, but not yet been fully sent
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	cmd := logIPCommand(1, 3)
+	_, err = conn.Write(cmd[0:5])
+	c.Assert(err, IsNil)
+	time.Sleep(50 * time.Millisecond)
+
+	stop()
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- server.Shutdown()
+	}()
+	select {
+	case <-shutdown:
+		c.Fatal("Shutdown returned before the command finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = conn.Write(cmd[5:])
+	c.Assert(err, IsNil)
+	c.Assert(<-shutdown, IsNil)
+	c.Check(persistedImpact(c, dataDir, 1), Equals, datastore.ImpactAmount(3))
+}
+
+func (s *ServerS) TestShutdownTimeout(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir(), shutdownTimeout: 50 * time.Millisecond})
+	addr, stop := serve(c, server)
+
+	// a command that never finishes
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte{cmdLogIP})
+	c.Assert(err, IsNil)
+	time.Sleep(50 * time.Millisecond)
+
+	stop()
+	start := time.Now()
+	c.Assert(server.Shutdown(), IsNil)
+	c.Check(time.Since(start) < time.Second, Equals, true)
+}
+
+func (s *ServerS) TestShutdownSaveFails(c *C) {
+	dataDir := c.MkDir()
+	server := newServer(c, options{dataDir: dataDir})
+	_, stop := serve(c, server)
+	// the kdb can't be written once the data dir is replaced by a file
+	c.Assert(os.RemoveAll(dataDir), IsNil)
+	c.Assert(ioutil.WriteFile(dataDir, nil, 0644), IsNil)
+	stop()
+	c.Check(server.Shutdown(), ErrorMatches, "Final save failed: .*")
+}
+
+func (s *ServerS) TestShutdownBackup(c *C) {
+	backupDir := c.MkDir()
+	server := newServer(c, options{
+		dataDir:        c.MkDir(),
+		backend:        datastore.NewDirBackend(backupDir),
+		backup:         datastore.BackupConfig{Host: "a"},
+		shutdownBackup: true,
+	})
+	_, stop := serve(c, server)
+	stop()
+	c.Assert(server.Shutdown(), IsNil)
+
+	latest, err := ioutil.ReadFile(filepath.Join(backupDir, "a", "latest"))
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(backupDir, string(latest)))
+	c.Check(err, IsNil)
+}
+
+func (s *ServerS) TestPipelining(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir(), idleTimeout: time.Minute})
+	server.tcpTimeout = 100 * time.Millisecond
+	addr, stop := serve(c, server)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// several commands sent before any response is read
+	var cmds []byte
+	for i := 0; i < 3; i++ {
+		cmds = append(cmds, logIPCommand(1, 2)...)
+	}
+	_, err = conn.Write(cmds)
+	c.Assert(err, IsNil)
+	for i := 1; i <= 3; i++ {
+		c.Check(readLogIPImpact(c, conn), Equals, uint32(2*i))
+	}
+
+	// the connection stays open for more
+	_, err = conn.Write(logIPCommand(1, 2))
+	c.Assert(err, IsNil)
+	c.Check(readLogIPImpact(c, conn), Equals, uint32(8))
+
+	// idle for longer than the tcp timeout, then pipeline more responses
+	// than fit in the write buffer
+	time.Sleep(3 * server.tcpTimeout)
+	const n = 500
+	cmds = nil
+	for i := 0; i < n; i++ {
+		cmds = append(cmds, logIPCommand(1, 1)...)
+	}
+	c.Assert(n*(1+logIPResponseSize) > 4096, Equals, true)
+	_, err = conn.Write(cmds)
+	c.Assert(err, IsNil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 1; i <= n; i++ {
+		c.Assert(readLogIPImpact(c, conn), Equals, uint32(8+i))
+	}
+}
+
+func (s *ServerS) TestIdleTimeout(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir(), idleTimeout: 50 * time.Millisecond})
+	addr, stop := serve(c, server)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write(logIPCommand(1, 2))
+	c.Assert(err, IsNil)
+	readLogIPImpact(c, conn)
+
+	// closed once idle
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *ServerS) TestLegacyConns(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir(), legacyConns: true})
+	addr, stop := serve(c, server)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write(append(logIPCommand(1, 2), logIPCommand(1, 2)...))
+	c.Assert(err, IsNil)
+
+	// only the first command is answered before the connection is closed, without a status byte
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, logIPResponseSize)
+	c.Check(data, DeepEquals, []byte{2, 0, 0, 0, 2, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0})
+
+	// the new commands still respond with the score and prefix records
+	conn, err = net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	ip := datastore.IPLong(1).IPAddr()
+	cmd := append([]byte{cmdLogIP6}, ip[0:]...)
+	_, err = conn.Write(append(cmd, 2, 0, 0, 0))
+	c.Assert(err, IsNil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err = ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Check(data, HasLen, logIP6ResponseSize)
+}
+
+func (s *ServerS) TestLegacyInvalidModifier(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir(), legacyConns: true})
+
+	var respBuf bytes.Buffer
+	cmd := []byte{1, 0, 0, 0, 9}
+	fake := faker{bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(cmd)), bufio.NewWriter(&respBuf))}
+	c.Assert(server.handleBlackWhiteIP(fake, readIPLong, writeLegacyIPData), IsNil)
+	fake.ReadWriter.(*bufio.ReadWriter).Flush()
+	c.Check(respBuf.Bytes(), DeepEquals, make([]byte, logIPResponseSize))
+}
+
+func (s *ServerS) TestStopClosesIdleConns(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir(), shutdownTimeout: 10 * time.Second})
+	addr, stop := serve(c, server)
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write(logIPCommand(1, 2))
+	c.Assert(err, IsNil)
+	readLogIPImpact(c, conn)
+
+	stop()
+	start := time.Now()
+	c.Assert(server.Shutdown(), IsNil)
+	c.Check(time.Since(start) < time.Second, Equals, true)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *ServerS) TestErrorStatus(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir()})
+	addr, stop := serve(c, server)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// an invalid argument, after which the connection is still usable
+	bw := []byte{cmdBlackWhiteIP, 1, 0, 0, 0, 9}
+	_, err = conn.Write(append(bw, logIPCommand(1, 2)...))
+	c.Assert(err, IsNil)
+	status, msg := readError(c, conn)
+	c.Check(status, Equals, byte(statusInvalidArgument))
+	c.Check(msg, Equals, "Invalid BlackWhite modifier 9")
+	c.Check(readLogIPImpact(c, conn), Equals, uint32(2))
+
+	// an unknown command, after which the connection is closed
+	_, err = conn.Write([]byte{0xFF, 1, 2, 3})
+	c.Assert(err, IsNil)
+	status, msg = readError(c, conn)
+	c.Check(status, Equals, byte(statusUnknownCommand))
+	c.Check(msg, Equals, "Unknown command 0xff")
+	_, err = conn.Read(make([]byte, 1))
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *ServerS) TestLegacyErrors(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir(), legacyConns: true})
+	addr, stop := serve(c, server)
+	defer stop()
+
+	// legacy clients only see the connection close
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte{0xFF})
+	c.Assert(err, IsNil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Check(data, HasLen, 0)
+}
+
+// failingWriter is a writer whose writes fail
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func (s *ServerS) TestErrorWriteFails(c *C) {
+	server := newServer(c, options{dataDir: c.MkDir()})
+
+	// enough invalid commands to fill the response buffer, but not the command buffer, then a LogIP
+	var cmds []byte
+	for i := 0; i < 200; i++ {
+		cmds = append(cmds, cmdBlackWhiteIP, 1, 0, 0, 0, 9)
+	}
+	cmds = append(cmds, logIPCommand(1, 2)...)
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(cmds), failingWriter{}}
+
+	// the connection is closed once an error can't be written
+	server.handleConnection(&clientConn{Conn: faker{conn}})
+	c.Check(server.store.Len(), Equals, 0)
+}
+
+func (s *ServerS) TestErrorStatusMapping(c *C) {
+	tests := []struct {
+		err      error
+		status   byte
+		keepOpen bool
+	}{
+		{invalidArgument("bad"), statusInvalidArgument, true},
+		{&statusError{status: statusUnknownCommand}, statusUnknownCommand, false},
+		{io.ErrUnexpectedEOF, statusTruncated, false},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, statusTruncated, false},
+		{errors.New("disk full"), statusInternalError, false},
+	}
+	for _, test := range tests {
+		status, keepOpen := errorStatus(test.err)
+		c.Check(status, Equals, test.status, Commentf("%v", test.err))
+		c.Check(keepOpen, Equals, test.keepOpen, Commentf("%v", test.err))
+	}
+}
+
+// timeoutError is a net.Error which timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }